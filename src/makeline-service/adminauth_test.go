@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminKeysFromEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		wantNames []string
+		wantErr   bool
+	}{
+		{name: "unset"},
+		{name: "one key", raw: "alice=secret", wantNames: []string{"alice"}},
+		{name: "several keys", raw: "alice=secret, bob=hunter2", wantNames: []string{"alice", "bob"}},
+		{name: "key with an equals sign", raw: "alice=se=cret", wantNames: []string{"alice"}},
+		{name: "key without a name", raw: "=secret", wantErr: true},
+		{name: "name without a key", raw: "alice=", wantErr: true},
+		{name: "key without a separator", raw: "secret", wantErr: true},
+		{name: "trailing comma", raw: "alice=secret,", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_API_KEYS", tt.raw)
+
+			keys, err := adminKeysFromEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %d keys, want an error", len(keys))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, key := range keys {
+				names = append(names, key.name)
+			}
+			if !slices.Equal(names, tt.wantNames) {
+				t.Errorf("got keys for %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	t.Setenv("ADMIN_API_KEYS", "alice=secret,bob=se=cret")
+	keys, err := adminKeysFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/admin/whoami", adminAuth(keys), func(c *gin.Context) {
+		c.String(http.StatusOK, adminActor(c))
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantActor     string
+	}{
+		{name: "first key", authorization: "Bearer secret", wantStatus: http.StatusOK, wantActor: "alice"},
+		{name: "second key", authorization: "Bearer se=cret", wantStatus: http.StatusOK, wantActor: "bob"},
+		{name: "no key", wantStatus: http.StatusUnauthorized},
+		{name: "wrong key", authorization: "Bearer secret2", wantStatus: http.StatusUnauthorized},
+		{name: "key without the bearer scheme", authorization: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "basic auth", authorization: "Basic YWxpY2U6c2VjcmV0", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/whoami", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized {
+				if got := w.Header().Get("WWW-Authenticate"); got != "Bearer" {
+					t.Errorf("got WWW-Authenticate %q, want Bearer", got)
+				}
+				return
+			}
+			if got := w.Body.String(); got != tt.wantActor {
+				t.Errorf("got actor %q, want %q", got, tt.wantActor)
+			}
+		})
+	}
+}
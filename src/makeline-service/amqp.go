@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/gofrs/uuid"
+)
+
+// Application properties added to a message when it is moved to the
+// dead-letter queue, named after the Service Bus message properties
+const (
+	DEAD_LETTER_REASON_PROPERTY      = "deadLetterReason"
+	DEAD_LETTER_DESCRIPTION_PROPERTY = "deadLetterErrorDescription"
+	DELIVERY_COUNT_PROPERTY          = "deliveryCount"
+)
+
+// AMQPOrderSource consumes orders from an AMQP 1.0 queue, such as a RabbitMQ
+// queue or an Azure Service Bus queue with SAS authentication. Poison messages
+// are moved to a dead-letter queue, which is declared on RabbitMQ if it
+// doesn't exist.
+type AMQPOrderSource struct {
+	queueName           string
+	deadLetterQueueName string
+	// prefetch is the link credit, and how many messages are received at
+	// once
+	prefetch int
+	conn     *amqp.Conn
+	receiver *amqp.Receiver
+	// deadLetters sends to the dead-letter queue. It is nil if the queue
+	// can't be opened, and messages are rejected instead.
+	deadLetters *amqp.Sender
+}
+
+func NewAMQPOrderSource(queueName string, deadLetterQueueName string, prefetch int) *AMQPOrderSource {
+	return &AMQPOrderSource{queueName: queueName, deadLetterQueueName: deadLetterQueueName, prefetch: prefetch}
+}
+
+func (s *AMQPOrderSource) Transport() string {
+	return AMQP_TRANSPORT
+}
+
+func (s *AMQPOrderSource) Name() string {
+	return s.queueName
+}
+
+func (s *AMQPOrderSource) Open(ctx context.Context) error {
+	conn, err := dialOrderQueue(ctx)
+	if err != nil {
+		return err
+	}
+
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	// RabbitMQ 4.x requires AMQP 1.0 address v2 format: /queues/<name>
+	// the broker sends up to prefetch messages ahead, and tops the credit up
+	// as they are settled
+	receiver, err := session.NewReceiver(ctx, "/queues/"+s.queueName, &amqp.ReceiverOptions{
+		Credit: int32(s.prefetch),
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create receiver: %w", err)
+	}
+
+	s.conn, s.receiver = conn, receiver
+	s.deadLetters = s.openDeadLetterQueue(ctx)
+	return nil
+}
+
+// openDeadLetterQueue declares the dead-letter queue and opens a sender to it.
+// Brokers without the RabbitMQ management node, such as Service Bus, fail
+// both; Service Bus dead-letters rejected messages itself.
+func (s *AMQPOrderSource) openDeadLetterQueue(ctx context.Context) *amqp.Sender {
+	if err := declareQueue(ctx, s.conn, s.deadLetterQueueName); err != nil {
+		slog.DebugContext(ctx, "Failed to declare dead-letter queue", "queue", s.deadLetterQueueName, errAttr(err))
+	}
+
+	// the sender gets a session of its own, so a failed attach can't end the
+	// receiver's session
+	session, err := s.conn.NewSession(ctx, nil)
+	if err == nil {
+		var sender *amqp.Sender
+		sender, err = session.NewSender(ctx, "/queues/"+s.deadLetterQueueName, nil)
+		if err == nil {
+			return sender
+		}
+		session.Close(ctx)
+	}
+	slog.WarnContext(ctx, "Dead-letter queue unavailable, poison messages will be rejected", "queue", s.deadLetterQueueName, errAttr(err))
+	return nil
+}
+
+func (s *AMQPOrderSource) Close(ctx context.Context) error {
+	if s.deadLetters != nil {
+		s.deadLetters.Close(ctx)
+	}
+	s.receiver.Close(ctx)
+	return s.conn.Close()
+}
+
+// Receive waits up to 5 seconds for the next message, and takes the messages
+// that arrived with it up to the prefetch
+func (s *AMQPOrderSource) Receive(ctx context.Context) ([]*QueueMessage, error) {
+	recvCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	msg, err := s.receiver.Receive(recvCtx, nil)
+	if err != nil {
+		// Timeout just means no messages available, keep polling
+		if ctx.Err() == nil && recvCtx.Err() != nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	messages := []*QueueMessage{amqpQueueMessage(msg)}
+	for len(messages) < s.prefetch {
+		msg := s.receiver.Prefetched()
+		if msg == nil {
+			break
+		}
+		messages = append(messages, amqpQueueMessage(msg))
+	}
+	return messages, nil
+}
+
+func amqpQueueMessage(msg *amqp.Message) *QueueMessage {
+	deliveryCount := 1
+	if msg.Header != nil {
+		deliveryCount += int(msg.Header.DeliveryCount)
+	}
+
+	queueMessage := &QueueMessage{
+		ID:            amqpIdempotencyKey(msg),
+		Body:          msg.GetData(),
+		Properties:    msg.ApplicationProperties,
+		DeliveryCount: deliveryCount,
+		raw:           msg,
+	}
+	if msg.Properties != nil && msg.Properties.ContentType != nil {
+		queueMessage.ContentType = *msg.Properties.ContentType
+	}
+	return queueMessage
+}
+
+func (s *AMQPOrderSource) Ack(ctx context.Context, msg *QueueMessage) error {
+	return s.receiver.AcceptMessage(ctx, msg.raw.(*amqp.Message))
+}
+
+// Nack releases the message. A failed delivery is marked as such, so the
+// broker counts it in the message's delivery count.
+func (s *AMQPOrderSource) Nack(ctx context.Context, msg *QueueMessage, failed bool) error {
+	if failed {
+		return s.receiver.ModifyMessage(ctx, msg.raw.(*amqp.Message), &amqp.ModifyMessageOptions{DeliveryFailed: true})
+	}
+	return s.receiver.ReleaseMessage(ctx, msg.raw.(*amqp.Message))
+}
+
+// DeadLetter sends a copy of the message to the dead-letter queue, with the
+// reason and description added to its application properties, then accepts
+// the original. Without a dead-letter queue the message is rejected with the
+// reason as the error condition, which Service Bus records as the
+// dead-letter reason.
+func (s *AMQPOrderSource) DeadLetter(ctx context.Context, msg *QueueMessage, reason string, description string) error {
+	original := msg.raw.(*amqp.Message)
+	if s.deadLetters == nil {
+		return s.receiver.RejectMessage(ctx, original, &amqp.Error{
+			Condition:   amqp.ErrCond(reason),
+			Description: description,
+		})
+	}
+
+	properties := make(map[string]any, len(original.ApplicationProperties)+3)
+	for key, value := range original.ApplicationProperties {
+		properties[key] = value
+	}
+	properties[DEAD_LETTER_REASON_PROPERTY] = reason
+	properties[DEAD_LETTER_DESCRIPTION_PROPERTY] = description
+	properties[DELIVERY_COUNT_PROPERTY] = int64(msg.DeliveryCount)
+
+	// the message-id identifies the message in the dead-letter queue
+	messageProperties := amqp.MessageProperties{}
+	if original.Properties != nil {
+		messageProperties = *original.Properties
+	}
+	if messageProperties.MessageID == nil {
+		messageProperties.MessageID = uuid.Must(uuid.NewV4()).String()
+	}
+
+	deadLetter := &amqp.Message{
+		Header:                &amqp.MessageHeader{Durable: true},
+		Properties:            &messageProperties,
+		ApplicationProperties: properties,
+		Data:                  original.Data,
+		Value:                 original.Value,
+	}
+	if err := s.deadLetters.Send(ctx, deadLetter, nil); err != nil {
+		return fmt.Errorf("failed to send to dead-letter queue: %w", err)
+	}
+	return s.receiver.AcceptMessage(ctx, original)
+}
+
+// Ping opens and closes a session, which is a round trip to the broker over
+// the consumer's connection
+func (s *AMQPOrderSource) Ping(ctx context.Context) error {
+	session, err := s.conn.NewSession(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return session.Close(ctx)
+}
+
+// AMQPDeadLetterQueue is the queue the AMQP order source moves poison
+// messages to. Messages are identified by their message-id.
+type AMQPDeadLetterQueue struct {
+	queueName string
+	conn      *amqp.Conn
+	receiver  *amqp.Receiver
+}
+
+func NewAMQPDeadLetterQueue(queueName string) *AMQPDeadLetterQueue {
+	return &AMQPDeadLetterQueue{queueName: queueName}
+}
+
+func (q *AMQPDeadLetterQueue) Name() string {
+	return q.queueName
+}
+
+func (q *AMQPDeadLetterQueue) Open(ctx context.Context) error {
+	conn, err := dialOrderQueue(ctx)
+	if err != nil {
+		return err
+	}
+
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	// credit for a whole scan, as messages are held until the scan is done
+	receiver, err := session.NewReceiver(ctx, "/queues/"+q.queueName, &amqp.ReceiverOptions{
+		Credit: MAX_DEAD_LETTER_SCAN,
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create receiver: %w", err)
+	}
+
+	q.conn, q.receiver = conn, receiver
+	return nil
+}
+
+func (q *AMQPDeadLetterQueue) Close(ctx context.Context) error {
+	q.receiver.Close(ctx)
+	return q.conn.Close()
+}
+
+// Peek receives messages and releases them straight away, as AMQP can't
+// browse a queue. Released messages may not keep their place in the queue.
+func (q *AMQPDeadLetterQueue) Peek(ctx context.Context, max int) ([]*DeadLetteredMessage, error) {
+	messages, err := q.Receive(ctx, max)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		if err := q.Release(ctx, msg); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+func (q *AMQPDeadLetterQueue) Receive(ctx context.Context, max int) ([]*DeadLetteredMessage, error) {
+	var messages []*DeadLetteredMessage
+	for len(messages) < max {
+		recvCtx, cancel := context.WithTimeout(ctx, DEAD_LETTER_RECEIVE_TIMEOUT)
+		msg, err := q.receiver.Receive(recvCtx, nil)
+		cancel()
+		if err != nil {
+			// Timeout just means the queue has no more messages
+			if ctx.Err() == nil && recvCtx.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+		messages = append(messages, amqpDeadLetter(msg))
+	}
+	return messages, nil
+}
+
+func (q *AMQPDeadLetterQueue) Remove(ctx context.Context, msg *DeadLetteredMessage) error {
+	return q.receiver.AcceptMessage(ctx, msg.raw.(*amqp.Message))
+}
+
+func (q *AMQPDeadLetterQueue) Release(ctx context.Context, msg *DeadLetteredMessage) error {
+	return q.receiver.ReleaseMessage(ctx, msg.raw.(*amqp.Message))
+}
+
+// amqpDeadLetter converts a message from the dead-letter queue, reading the
+// reason from the properties added by AMQPOrderSource.DeadLetter
+func amqpDeadLetter(message *amqp.Message) *DeadLetteredMessage {
+	msg := &DeadLetteredMessage{
+		Body:       string(message.GetData()),
+		key:        amqpIdempotencyKey(message),
+		properties: message.ApplicationProperties,
+		raw:        message,
+	}
+	if message.Properties != nil && message.Properties.MessageID != nil {
+		msg.ID = fmt.Sprint(message.Properties.MessageID)
+	}
+	if message.Properties != nil && message.Properties.ContentType != nil {
+		msg.contentType = *message.Properties.ContentType
+	}
+	msg.Reason, _ = message.ApplicationProperties[DEAD_LETTER_REASON_PROPERTY].(string)
+	msg.Description, _ = message.ApplicationProperties[DEAD_LETTER_DESCRIPTION_PROPERTY].(string)
+	if count, ok := message.ApplicationProperties[DELIVERY_COUNT_PROPERTY].(int64); ok {
+		msg.DeliveryCount = int(count)
+	}
+	return msg
+}
+
+// AMQPEventPublisher sends lifecycle events to an AMQP 1.0 address on the
+// order queue broker, such as /exchanges/order-events on RabbitMQ
+type AMQPEventPublisher struct {
+	address string
+	mode    string
+	conn    *amqp.Conn
+	sender  *amqp.Sender
+}
+
+func NewAMQPEventPublisher(address string, mode string) *AMQPEventPublisher {
+	return &AMQPEventPublisher{address: address, mode: mode}
+}
+
+func (p *AMQPEventPublisher) Name() string {
+	return p.address
+}
+
+func (p *AMQPEventPublisher) Open(ctx context.Context) error {
+	conn, err := dialOrderQueue(ctx)
+	if err != nil {
+		return err
+	}
+
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	sender, err := session.NewSender(ctx, p.address, nil)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create sender: %w", err)
+	}
+
+	p.conn, p.sender = conn, sender
+	return nil
+}
+
+func (p *AMQPEventPublisher) Close(ctx context.Context) error {
+	p.sender.Close(ctx)
+	return p.conn.Close()
+}
+
+// Publish sends the event as a durable message. The message-id is the event
+// ID, so consumers can drop events that were published twice.
+func (p *AMQPEventPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	cloudEvent, err := newLifecycleCloudEvent(event)
+	if err != nil {
+		return err
+	}
+	body, contentType, properties, err := encodeCloudEvent(cloudEvent, p.mode)
+	if err != nil {
+		return err
+	}
+
+	return p.sender.Send(ctx, &amqp.Message{
+		Header: &amqp.MessageHeader{Durable: true},
+		Properties: &amqp.MessageProperties{
+			MessageID:    event.ID,
+			Subject:      &event.Type,
+			ContentType:  &contentType,
+			CreationTime: &event.Timestamp,
+		},
+		ApplicationProperties: properties,
+		Data:                  [][]byte{body},
+	}, nil)
+}
+
+// dialOrderQueue connects to the broker at ORDER_QUEUE_URI with the
+// ORDER_QUEUE_USERNAME and ORDER_QUEUE_PASSWORD credentials
+func dialOrderQueue(ctx context.Context) (*amqp.Conn, error) {
+	orderQueueUri := os.Getenv("ORDER_QUEUE_URI")
+	if orderQueueUri == "" {
+		return nil, errors.New("ORDER_QUEUE_URI is not set")
+	}
+
+	orderQueueUsername := os.Getenv("ORDER_QUEUE_USERNAME")
+	orderQueuePassword := os.Getenv("ORDER_QUEUE_PASSWORD")
+
+	conn, err := amqp.Dial(ctx, orderQueueUri, &amqp.ConnOptions{
+		SASLType: amqp.SASLTypePlain(orderQueueUsername, orderQueuePassword),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to queue: %w", err)
+	}
+	return conn, nil
+}
+
+// declareQueue declares a durable queue through the HTTP over AMQP management
+// node of RabbitMQ 4.x. A queue that already exists is left as it is.
+func declareQueue(ctx context.Context, conn *amqp.Conn, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer session.Close(ctx)
+
+	// requests and responses go over a pair of links with the same name
+	linkProperties := map[string]any{"paired": true}
+	settled := amqp.SenderSettleModeSettled
+	first := amqp.ReceiverSettleModeFirst
+
+	sender, err := session.NewSender(ctx, "/management", &amqp.SenderOptions{
+		Name:                        "makeline-management",
+		Properties:                  linkProperties,
+		SettlementMode:              &settled,
+		RequestedReceiverSettleMode: &first,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open management sender: %w", err)
+	}
+	defer sender.Close(ctx)
+
+	receiver, err := session.NewReceiver(ctx, "/management", &amqp.ReceiverOptions{
+		Name:                      "makeline-management",
+		Properties:                linkProperties,
+		RequestedSenderSettleMode: &settled,
+		SettlementMode:            &first,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open management receiver: %w", err)
+	}
+	defer receiver.Close(ctx)
+
+	to := "/queues/" + url.PathEscape(name)
+	subject := "PUT"
+	replyTo := "$me"
+	request := &amqp.Message{
+		Properties: &amqp.MessageProperties{
+			MessageID: "declare-" + name,
+			To:        &to,
+			Subject:   &subject,
+			ReplyTo:   &replyTo,
+		},
+		Value: map[string]any{
+			"durable":     true,
+			"exclusive":   false,
+			"auto_delete": false,
+			"arguments":   map[string]any{},
+		},
+	}
+	if err := sender.Send(ctx, request, nil); err != nil {
+		return fmt.Errorf("failed to send declare request: %w", err)
+	}
+
+	response, err := receiver.Receive(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to receive declare response: %w", err)
+	}
+	receiver.AcceptMessage(ctx, response)
+
+	status := ""
+	if response.Properties != nil && response.Properties.Subject != nil {
+		status = *response.Properties.Subject
+	}
+	switch status {
+	case "200", "201", "409":
+		return nil
+	default:
+		return fmt.Errorf("declare request failed with status %q: %v", status, response.Value)
+	}
+}
+
+// amqpIdempotencyKey returns the key used to deduplicate an AMQP message: the
+// producer's idempotency key if set, otherwise the message-id property
+func amqpIdempotencyKey(msg *amqp.Message) string {
+	if key, ok := msg.ApplicationProperties[IDEMPOTENCY_KEY_PROPERTY].(string); ok && key != "" {
+		return key
+	}
+	if msg.Properties != nil && msg.Properties.MessageID != nil {
+		return fmt.Sprint(msg.Properties.MessageID)
+	}
+	return ""
+}
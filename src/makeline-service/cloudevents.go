@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+)
+
+const (
+	CLOUDEVENTS_SPEC_VERSION = "1.0"
+	// CLOUDEVENTS_CONTENT_TYPE is the content type of a structured mode
+	// event, with its attributes and data in one JSON body
+	CLOUDEVENTS_CONTENT_TYPE = "application/cloudevents+json"
+)
+
+// Prefixes of the attributes of a binary mode event, whose body is the event
+// data and whose attributes are message properties. AMQP and Service Bus use
+// application properties, with the older "cloudEvents:" prefix still sent by
+// some producers, and Kafka uses headers.
+var cloudEventsPrefixes = []string{"cloudEvents_", "cloudEvents:", "ce_"}
+
+// Content modes of published lifecycle events, set by
+// ORDER_EVENTS_CONTENT_MODE
+const (
+	STRUCTURED_CONTENT_MODE = "structured"
+	BINARY_CONTENT_MODE     = "binary"
+)
+
+const (
+	// LIFECYCLE_EVENT_SOURCE is the source of published lifecycle events
+	LIFECYCLE_EVENT_SOURCE = "/makeline-service"
+	// LIFECYCLE_EVENT_TYPE_PREFIX is put before the lifecycle event type to
+	// make the CloudEvents type, such as
+	// com.aks-store-demo.makeline.OrderReceived
+	LIFECYCLE_EVENT_TYPE_PREFIX = "com.aks-store-demo.makeline."
+)
+
+// CloudEvent is a CloudEvents 1.0 event, as sent by Dapr, Event Grid and other
+// producers. An order is the data of the event.
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time,omitzero"`
+	DataContentType string    `json:"datacontenttype,omitempty"`
+	// Data is the event data as JSON, which may be a JSON string for
+	// producers that send their payload as text
+	Data json.RawMessage `json:"data,omitempty"`
+	// DataBase64 is the event data of a structured event with binary data
+	DataBase64 []byte `json:"data_base64,omitempty"`
+}
+
+// unwrapCloudEvent reads the CloudEvent msg carries, if any, and replaces the
+// message body with the event data. The message is then deduplicated by the
+// event's source and id, unless the producer set an idempotency key. It
+// returns nil for a message that isn't a CloudEvent, and an error for an
+// event that can't be read.
+func unwrapCloudEvent(msg *QueueMessage) (*CloudEvent, error) {
+	event, data, err := readCloudEvent(msg.Body, msg.ContentType, msg.Properties)
+	if event == nil || err != nil {
+		return event, err
+	}
+	msg.Body = data
+	if key, ok := msg.Properties[IDEMPOTENCY_KEY_PROPERTY].(string); !ok || key == "" {
+		msg.ID = event.Source + "#" + event.ID
+	}
+	return event, nil
+}
+
+// readCloudEvent returns the event in a message and its data. A binary mode
+// event is recognised by its attributes in properties, and a structured mode
+// event by its content type or its specversion attribute.
+func readCloudEvent(body []byte, contentType string, properties map[string]any) (*CloudEvent, []byte, error) {
+	for _, prefix := range cloudEventsPrefixes {
+		if _, ok := properties[prefix+"specversion"]; ok {
+			event := binaryCloudEvent(prefix, properties)
+			return event, body, event.validate()
+		}
+	}
+
+	structured := false
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		structured = mediaType == CLOUDEVENTS_CONTENT_TYPE
+	}
+	var event CloudEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		if structured {
+			return nil, nil, fmt.Errorf("failed to unmarshal CloudEvent: %w", err)
+		}
+		// not a CloudEvent, and fails to unmarshal as an order
+		return nil, body, nil
+	}
+	if !structured && event.SpecVersion == "" {
+		return nil, body, nil
+	}
+	if err := event.validate(); err != nil {
+		return &event, nil, err
+	}
+
+	data, err := event.data()
+	return &event, data, err
+}
+
+// binaryCloudEvent reads the attributes of a binary mode event from the
+// message properties with prefix
+func binaryCloudEvent(prefix string, properties map[string]any) *CloudEvent {
+	attr := func(name string) string {
+		value, _ := properties[prefix+name].(string)
+		return value
+	}
+	return &CloudEvent{
+		SpecVersion:     attr("specversion"),
+		ID:              attr("id"),
+		Source:          attr("source"),
+		Type:            attr("type"),
+		Subject:         attr("subject"),
+		DataContentType: attr("datacontenttype"),
+	}
+}
+
+func (e *CloudEvent) validate() error {
+	if e.SpecVersion != CLOUDEVENTS_SPEC_VERSION {
+		return fmt.Errorf("unsupported CloudEvents specversion %q", e.SpecVersion)
+	}
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return errors.New("CloudEvent must have an id, source and type")
+	}
+	return nil
+}
+
+// data returns the data of a structured mode event. Data sent as a JSON
+// string is unquoted, like the body of a Service Bus message.
+func (e *CloudEvent) data() ([]byte, error) {
+	switch {
+	case e.DataBase64 != nil:
+		return e.DataBase64, nil
+	case len(e.Data) == 0 || string(e.Data) == "null":
+		return nil, errors.New("CloudEvent has no data")
+	case e.Data[0] == '"':
+		var text string
+		if err := json.Unmarshal(e.Data, &text); err != nil {
+			return nil, err
+		}
+		return []byte(text), nil
+	}
+	return e.Data, nil
+}
+
+// attributes are the span attributes of the event
+func (e *CloudEvent) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.CloudEventsEventID(e.ID),
+		semconv.CloudEventsEventSource(e.Source),
+		semconv.CloudEventsEventType(e.Type),
+		semconv.CloudEventsEventSpecVersion(e.SpecVersion),
+	}
+}
+
+// acceptsEventType reports whether orders are read from events of type. Any
+// type is accepted if ORDER_QUEUE_EVENT_TYPES isn't set.
+func (c ConsumerConfig) acceptsEventType(eventType string) bool {
+	return len(c.EventTypes) == 0 || slices.Contains(c.EventTypes, eventType)
+}
+
+// newLifecycleCloudEvent wraps a lifecycle event in a CloudEvent, with the
+// lifecycle event as JSON data and the order as its subject
+func newLifecycleCloudEvent(event OutboxEvent) (CloudEvent, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return CloudEvent{}, err
+	}
+	return CloudEvent{
+		SpecVersion:     CLOUDEVENTS_SPEC_VERSION,
+		ID:              event.ID,
+		Source:          LIFECYCLE_EVENT_SOURCE,
+		Type:            LIFECYCLE_EVENT_TYPE_PREFIX + event.Type,
+		Subject:         event.OrderID,
+		Time:            event.Timestamp,
+		DataContentType: "application/json",
+		Data:            data,
+	}, nil
+}
+
+// encodeCloudEvent returns the body, content type and application properties
+// of an AMQP or Service Bus message carrying event in the content mode
+func encodeCloudEvent(event CloudEvent, mode string) ([]byte, string, map[string]any, error) {
+	if mode == BINARY_CONTENT_MODE {
+		prefix := cloudEventsPrefixes[0]
+		properties := map[string]any{
+			prefix + "specversion": event.SpecVersion,
+			prefix + "id":          event.ID,
+			prefix + "source":      event.Source,
+			prefix + "type":        event.Type,
+			prefix + "time":        event.Time.Format(time.RFC3339Nano),
+		}
+		if event.Subject != "" {
+			properties[prefix+"subject"] = event.Subject
+		}
+		return event.Data, event.DataContentType, properties, nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return body, CLOUDEVENTS_CONTENT_TYPE + "; charset=utf-8", nil, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReadCloudEvent(t *testing.T) {
+	order := `{"customerId":"1","items":[]}`
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		properties  map[string]any
+		// wantEvent is the id of the event read, if any
+		wantEvent string
+		wantData  string
+		wantErr   bool
+	}{
+		{name: "plain order", body: order, wantData: order},
+		{name: "body that isn't JSON", body: "not an order", wantData: "not an order"},
+		{
+			name:      "structured event",
+			body:      `{"specversion":"1.0","id":"e1","source":"/test","type":"com.test.order","data":` + order + `}`,
+			wantEvent: "e1",
+			wantData:  order,
+		},
+		{
+			name:        "structured event by its content type",
+			body:        `{"specversion":"1.0","id":"e1","source":"/test","type":"com.test.order","data":` + order + `}`,
+			contentType: CLOUDEVENTS_CONTENT_TYPE + "; charset=utf-8",
+			wantEvent:   "e1",
+			wantData:    order,
+		},
+		{
+			name:      "structured event with the data as a string",
+			body:      `{"specversion":"1.0","id":"e1","source":"/test","type":"com.test.order","data":` + string(mustMarshal(t, order)) + `}`,
+			wantEvent: "e1",
+			wantData:  order,
+		},
+		{
+			name:      "structured event with binary data",
+			body:      `{"specversion":"1.0","id":"e1","source":"/test","type":"com.test.order","data_base64":` + string(mustMarshal(t, []byte(order))) + `}`,
+			wantEvent: "e1",
+			wantData:  order,
+		},
+		{name: "structured event that isn't JSON", body: "not an event", contentType: CLOUDEVENTS_CONTENT_TYPE, wantErr: true},
+		{name: "structured event without an id", body: `{"specversion":"1.0","source":"/test","type":"com.test.order","data":{}}`, wantErr: true},
+		{name: "structured event of another spec version", body: `{"specversion":"0.3","id":"e1","source":"/test","type":"com.test.order","data":{}}`, wantErr: true},
+		{name: "structured event without data", body: `{"specversion":"1.0","id":"e1","source":"/test","type":"com.test.order"}`, wantErr: true},
+		{
+			name:       "binary event",
+			body:       order,
+			properties: map[string]any{"cloudEvents_specversion": "1.0", "cloudEvents_id": "e1", "cloudEvents_source": "/test", "cloudEvents_type": "com.test.order"},
+			wantEvent:  "e1",
+			wantData:   order,
+		},
+		{
+			name:       "binary event with the older prefix",
+			body:       order,
+			properties: map[string]any{"cloudEvents:specversion": "1.0", "cloudEvents:id": "e1", "cloudEvents:source": "/test", "cloudEvents:type": "com.test.order"},
+			wantEvent:  "e1",
+			wantData:   order,
+		},
+		{
+			name:       "binary event in Kafka headers",
+			body:       order,
+			properties: map[string]any{"ce_specversion": "1.0", "ce_id": "e1", "ce_source": "/test", "ce_type": "com.test.order"},
+			wantEvent:  "e1",
+			wantData:   order,
+		},
+		{
+			name:       "binary event without a source",
+			body:       order,
+			properties: map[string]any{"ce_specversion": "1.0", "ce_id": "e1", "ce_type": "com.test.order"},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, data, err := readCloudEvent([]byte(tt.body), tt.contentType, tt.properties)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got event %+v, want an error", event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.wantEvent == "" && event != nil:
+				t.Errorf("got event %+v, want none", event)
+			case tt.wantEvent != "" && (event == nil || event.ID != tt.wantEvent):
+				t.Errorf("got event %+v, want event %s", event, tt.wantEvent)
+			}
+			if string(data) != tt.wantData {
+				t.Errorf("got data %s, want %s", data, tt.wantData)
+			}
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUnwrapCloudEvent(t *testing.T) {
+	body := `{"specversion":"1.0","id":"e1","source":"/test","type":"com.test.order","data":{"customerId":"1","items":[]}}`
+
+	tests := []struct {
+		name       string
+		properties map[string]any
+		wantID     string
+	}{
+		{name: "deduplicated by the event", wantID: "/test#e1"},
+		{name: "deduplicated by the producer's key", properties: map[string]any{IDEMPOTENCY_KEY_PROPERTY: "key-1"}, wantID: "m1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &QueueMessage{ID: "m1", Body: []byte(body), Properties: tt.properties}
+			if _, err := unwrapCloudEvent(msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.ID != tt.wantID {
+				t.Errorf("got message id %s, want %s", msg.ID, tt.wantID)
+			}
+			if got, want := string(msg.Body), `{"customerId":"1","items":[]}`; got != want {
+				t.Errorf("got body %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestEncodeCloudEvent(t *testing.T) {
+	status := Pending
+	lifecycle := OutboxEvent{
+		ID:             "e1",
+		Type:           ORDER_STATUS_CHANGED_LIFECYCLE_EVENT,
+		OrderID:        "42",
+		Status:         Processing,
+		PreviousStatus: &status,
+		Actor:          "store-admin",
+		Timestamp:      time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	event, err := newLifecycleCloudEvent(lifecycle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != LIFECYCLE_EVENT_TYPE_PREFIX+ORDER_STATUS_CHANGED_LIFECYCLE_EVENT || event.Source != LIFECYCLE_EVENT_SOURCE || event.Subject != "42" {
+		t.Errorf("got event type %s from %s about %s, want %s from %s about 42", event.Type, event.Source, event.Subject, LIFECYCLE_EVENT_TYPE_PREFIX+ORDER_STATUS_CHANGED_LIFECYCLE_EVENT, LIFECYCLE_EVENT_SOURCE)
+	}
+
+	for _, mode := range []string{STRUCTURED_CONTENT_MODE, BINARY_CONTENT_MODE} {
+		t.Run(mode, func(t *testing.T) {
+			body, contentType, properties, err := encodeCloudEvent(event, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode == BINARY_CONTENT_MODE && properties["cloudEvents_time"] != "2024-05-01T12:00:00Z" {
+				t.Errorf("got time %v, want 2024-05-01T12:00:00Z", properties["cloudEvents_time"])
+			}
+
+			// a consumer reads back the same event and data
+			got, data, err := readCloudEvent(body, contentType, properties)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || got.ID != event.ID || got.Source != event.Source || got.Type != event.Type || got.Subject != event.Subject {
+				t.Errorf("got event %+v, want %+v", got, event)
+			}
+			var decoded OutboxEvent
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.ID != lifecycle.ID || decoded.Status != Processing || decoded.PreviousStatus == nil || *decoded.PreviousStatus != Pending {
+				t.Errorf("got data %s, want the lifecycle event", data)
+			}
+		})
+	}
+}
@@ -2,202 +2,672 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
-	"github.com/Azure/go-amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// IDEMPOTENCY_KEY_PROPERTY is the application property producers can set to
+// deduplicate orders across their own retries. It takes precedence over the
+// broker message ID, which changes every time a producer resends.
+const IDEMPOTENCY_KEY_PROPERTY = "idempotencyKey"
+
+// DEFAULT_MAX_DELIVERIES is how many times a message is delivered before it is
+// dead-lettered, unless ORDER_QUEUE_MAX_DELIVERIES is set. It matches the
+// default maximum delivery count of a Service Bus queue.
+const DEFAULT_MAX_DELIVERIES = 10
+
+// DEFAULT_CONSUMER_CONCURRENCY is how many batches are written at once,
+// unless ORDER_QUEUE_CONCURRENCY is set. The prefetch defaults to enough
+// messages for a full batch on every worker.
+const DEFAULT_CONSUMER_CONCURRENCY = 4
+
+const (
+	// DEFAULT_BATCH_SIZE is how many orders are written to the database in
+	// one InsertOrders call, unless ORDER_QUEUE_BATCH_SIZE is set
+	DEFAULT_BATCH_SIZE = 10
+	// DEFAULT_BATCH_WAIT is how long the consumer waits for more messages to
+	// fill the batches, unless ORDER_QUEUE_BATCH_WAIT is set
+	DEFAULT_BATCH_WAIT = 50 * time.Millisecond
+	// DEFAULT_MAX_LOCK_RENEWAL is how long the lock on a Service Bus message
+	// is kept while it is processed, unless ORDER_QUEUE_MAX_LOCK_RENEWAL is set
+	DEFAULT_MAX_LOCK_RENEWAL = 5 * time.Minute
+)
+
+const (
+	// RETRY_BACKOFF_MIN is how long the consumer waits after an order fails
+	// to be stored
+	RETRY_BACKOFF_MIN = 1 * time.Second
+	// RETRY_BACKOFF_MAX caps the wait, which doubles with every failure in a row
+	RETRY_BACKOFF_MAX = 30 * time.Second
+)
+
+// Reasons a message is dead-lettered, named after the reasons Service Bus uses
+const (
+	DEAD_LETTER_INVALID_ORDER     = "InvalidOrder"
+	DEAD_LETTER_MAX_DELIVERIES    = "MaxDeliveryCountExceeded"
+	DEAD_LETTER_UNSUPPORTED_EVENT = "UnsupportedEventType"
+)
+
+// maxTrackedDeliveries caps how many failing messages the consumer counts
+// deliveries for. Messages settled by other replicas are never forgotten, so
+// the counts are dropped once there are this many.
+const maxTrackedDeliveries = 10000
+
+// OrderSource is a queue or topic that orders are consumed from. The consumer
+// drives every source through the same pipeline: it opens the source, receives
+// messages, stores the orders in them and settles each message.
+type OrderSource interface {
+	// Transport names the source in logs and metrics
+	Transport() string
+	// Name is the queue or topic orders are read from
+	Name() string
+	// Open connects to the broker. Open is called again after Close when the
+	// consumer reconnects.
+	Open(ctx context.Context) error
+	// Close disconnects from the broker. Messages that were received but not
+	// settled are redelivered.
+	Close(ctx context.Context) error
+	// Receive waits for the next messages. It may return no messages and no
+	// error if none arrived for a while.
+	Receive(ctx context.Context) ([]*QueueMessage, error)
+	// Ack settles a message whose order was stored
+	Ack(ctx context.Context, msg *QueueMessage) error
+	// Nack returns a message to the source so it is delivered again. failed
+	// is set if processing the message failed, rather than it not being
+	// processed at all, so the delivery counts towards the maximum.
+	Nack(ctx context.Context, msg *QueueMessage, failed bool) error
+	// DeadLetter moves a message that can't be processed out of the way, with
+	// the reason and a description of the failure, keeping its payload
+	DeadLetter(ctx context.Context, msg *QueueMessage, reason string, description string) error
+	// Ping makes a round trip to the broker over the open connection
+	Ping(ctx context.Context) error
+}
+
+// QueueMessage is a message received from an OrderSource
+type QueueMessage struct {
+	// ID deduplicates the message, see the idempotency key functions of each
+	// source
+	ID string
+	// Body is the order JSON, or a CloudEvent carrying it
+	Body []byte
+	// ContentType is the content type of the body, if the producer set one
+	ContentType string
+	// Properties are the application properties or headers of the message,
+	// which may carry trace context
+	Properties map[string]any
+	// DeliveryCount is how many times the broker has delivered the message,
+	// including this time, or 1 if the broker doesn't count deliveries
+	DeliveryCount int
+	// OrderingKey groups messages that must be settled in order, such as
+	// the records of a Kafka partition. Messages with the same key are
+	// processed one after another; messages without one in any order.
+	OrderingKey string
+	// raw is the source's own message, for settling it
+	raw any
+}
+
+// ConsumerConfig tunes the consumer
+type ConsumerConfig struct {
+	// MaxDeliveries is how many times a message is delivered before it is
+	// dead-lettered
+	MaxDeliveries int
+	// Concurrency is how many batches are written at once
+	Concurrency int
+	// Prefetch is how many messages are received at once, as AMQP link
+	// credit, the Service Bus receive batch or the Kafka poll size
+	Prefetch int
+	// BatchSize is how many orders are written in one InsertOrders call
+	BatchSize int
+	// BatchWait is how long to wait for more messages once one has arrived,
+	// before writing the batches that aren't full
+	BatchWait time.Duration
+	// MaxLockRenewal is how long the locks on Service Bus messages are
+	// renewed while they are processed. 0 leaves them to expire on their own.
+	MaxLockRenewal time.Duration
+	// EventTypes are the CloudEvents types orders are read from. Events of
+	// other types are dead-lettered; any type is accepted if it's empty.
+	EventTypes []string
+}
+
+// consumerConfigFromEnv reads the consumer configuration from
+// ORDER_QUEUE_MAX_DELIVERIES, ORDER_QUEUE_CONCURRENCY, ORDER_QUEUE_PREFETCH,
+// ORDER_QUEUE_BATCH_SIZE, ORDER_QUEUE_BATCH_WAIT,
+// ORDER_QUEUE_MAX_LOCK_RENEWAL and ORDER_QUEUE_EVENT_TYPES
+func consumerConfigFromEnv() ConsumerConfig {
+	config := ConsumerConfig{
+		MaxDeliveries:  positiveEnvInt("ORDER_QUEUE_MAX_DELIVERIES", DEFAULT_MAX_DELIVERIES),
+		Concurrency:    positiveEnvInt("ORDER_QUEUE_CONCURRENCY", DEFAULT_CONSUMER_CONCURRENCY),
+		BatchSize:      positiveEnvInt("ORDER_QUEUE_BATCH_SIZE", DEFAULT_BATCH_SIZE),
+		BatchWait:      DEFAULT_BATCH_WAIT,
+		MaxLockRenewal: DEFAULT_MAX_LOCK_RENEWAL,
+	}
+	config.Prefetch = positiveEnvInt("ORDER_QUEUE_PREFETCH", config.Concurrency*config.BatchSize)
+	if raw := os.Getenv("ORDER_QUEUE_BATCH_WAIT"); raw != "" {
+		wait, err := time.ParseDuration(raw)
+		if err != nil || wait < 0 {
+			logFatal("ORDER_QUEUE_BATCH_WAIT must be a duration such as 50ms", "value", raw)
+		}
+		config.BatchWait = wait
+	}
+	if raw := os.Getenv("ORDER_QUEUE_MAX_LOCK_RENEWAL"); raw != "" {
+		renewal, err := time.ParseDuration(raw)
+		if err != nil || renewal < 0 {
+			logFatal("ORDER_QUEUE_MAX_LOCK_RENEWAL must be a duration such as 5m", "value", raw)
+		}
+		config.MaxLockRenewal = renewal
+	}
+	for _, eventType := range strings.Split(os.Getenv("ORDER_QUEUE_EVENT_TYPES"), ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			config.EventTypes = append(config.EventTypes, eventType)
+		}
+	}
+	if config.Prefetch < config.Concurrency*config.BatchSize {
+		slog.Warn("ORDER_QUEUE_PREFETCH is too small to fill a batch on every worker",
+			"prefetch", config.Prefetch,
+			"concurrency", config.Concurrency,
+			"batchSize", config.BatchSize,
+		)
+	}
+	return config
+}
+
+// positiveEnvInt reads a positive number from the environment variable name,
+// or returns def if it isn't set
+func positiveEnvInt(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		logFatal(name+" must be a positive number", "value", raw)
+	}
+	return n
+}
+
 // startConsumer runs a background loop that continuously reads messages from the
 // order queue and persists them to the database. Messages are only acknowledged
 // after a successful DB write, giving us at-least-once delivery guarantees.
-func startConsumer(ctx context.Context, repo OrderRepo) {
+// It returns once ctx is done and the messages in hand have been settled.
+func startConsumer(ctx context.Context, repo OrderRepo, events *EventBus, link *ConsumerLink, ids OrderIDGenerator) {
 	orderQueueName := os.Getenv("ORDER_QUEUE_NAME")
 	if orderQueueName == "" {
-		log.Fatalf("ORDER_QUEUE_NAME is not set")
+		logFatal("ORDER_QUEUE_NAME is not set")
 	}
 
-	useWorkloadIdentityAuth := os.Getenv("USE_WORKLOAD_IDENTITY_AUTH")
-	orderQueueHostName := os.Getenv("AZURE_SERVICEBUS_FULLYQUALIFIEDNAMESPACE")
-	if orderQueueHostName == "" {
-		orderQueueHostName = os.Getenv("ORDER_QUEUE_HOSTNAME")
+	config := consumerConfigFromEnv()
+	NewConsumer(newOrderSource(orderQueueName, config), repo, events, link, ids, config).Run(ctx)
+}
+
+// newOrderSource picks the source to consume orders from: Kafka if
+// ORDER_QUEUE_TRANSPORT is kafka, Service Bus if a connection string, SAS key
+// or Workload Identity is set up for it, and AMQP otherwise
+func newOrderSource(queueName string, config ConsumerConfig) OrderSource {
+	if os.Getenv("ORDER_QUEUE_TRANSPORT") == KAFKA_TRANSPORT {
+		return NewKafkaOrderSource(queueName, deadLetterQueueName(queueName), config.Prefetch)
 	}
+	if connection, ok := serviceBusConnectionFromEnv(); ok {
+		return NewServiceBusOrderSource(connection, queueName, config.Prefetch, config.MaxLockRenewal)
+	}
+	return NewAMQPOrderSource(queueName, deadLetterQueueName(queueName), config.Prefetch)
+}
 
-	if orderQueueHostName != "" && useWorkloadIdentityAuth == "true" {
-		runServiceBusConsumer(ctx, orderQueueHostName, orderQueueName, repo)
-	} else {
-		runAMQPConsumer(ctx, orderQueueName, repo)
+// Consumer stores the orders from an OrderSource on a pool of workers. A
+// message whose order can't be stored is handed back with a growing backoff,
+// and dead-lettered once it has been delivered MaxDeliveries times.
+type Consumer struct {
+	source OrderSource
+	repo   OrderRepo
+	events *EventBus
+	link   *ConsumerLink
+	ids    OrderIDGenerator
+	config ConsumerConfig
+	// failures counts failed deliveries by message ID, for brokers that
+	// don't count deliveries themselves
+	mu       sync.Mutex
+	failures map[string]int
+	// retries is the number of failed batches in a row, for the backoff
+	retries int
+}
+
+func NewConsumer(source OrderSource, repo OrderRepo, events *EventBus, link *ConsumerLink, ids OrderIDGenerator, config ConsumerConfig) *Consumer {
+	return &Consumer{
+		source:   source,
+		repo:     repo,
+		events:   events,
+		link:     link,
+		ids:      ids,
+		config:   config,
+		failures: make(map[string]int),
 	}
 }
 
-func runServiceBusConsumer(ctx context.Context, hostname string, queueName string, repo OrderRepo) {
+// Run consumes orders until ctx is done, reconnecting whenever the source fails
+func (c *Consumer) Run(ctx context.Context) {
+	ctx = withLogAttrs(ctx, slog.String(LOG_TRANSPORT, c.source.Transport()))
 	for {
-		if err := serviceBusConsumeLoop(ctx, hostname, queueName, repo); err != nil {
+		if err := c.consumeLoop(ctx); err != nil {
+			c.link.Disconnected(c.source.Transport(), err)
 			if ctx.Err() != nil {
 				return
 			}
-			log.Printf("Service Bus consumer error: %s. Reconnecting in 5s...", err)
-			time.Sleep(5 * time.Second)
+			slog.ErrorContext(ctx, "Consumer error, reconnecting in 5s", errAttr(err))
+			if !sleepContext(ctx, 5*time.Second) {
+				return
+			}
 		}
 	}
 }
 
-func serviceBusConsumeLoop(ctx context.Context, hostname string, queueName string, repo OrderRepo) error {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
-	if err != nil {
-		return fmt.Errorf("failed to get credential: %w", err)
+func (c *Consumer) consumeLoop(ctx context.Context) error {
+	if err := c.source.Open(ctx); err != nil {
+		return err
 	}
+	// ctx is cancelled by the time the consumer stops on shutdown, so the
+	// source is closed with a context of its own
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.source.Close(closeCtx); err != nil {
+			slog.WarnContext(ctx, "Failed to close consumer", errAttr(err))
+		}
+	}()
 
-	client, err := azservicebus.NewClient(hostname, cred, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create service bus client: %w", err)
-	}
-	defer client.Close(ctx)
-
-	receiver, err := client.NewReceiverForQueue(queueName, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create receiver: %w", err)
-	}
-	defer receiver.Close(ctx)
-
-	log.Printf("Service Bus consumer connected to queue: %s", queueName)
+	slog.InfoContext(ctx, "Consumer connected to queue",
+		"queue", c.source.Name(),
+		"concurrency", c.config.Concurrency,
+		"prefetch", c.config.Prefetch,
+		"batchSize", c.config.BatchSize,
+	)
+	c.link.Connected(c.source.Transport(), c.source.Ping)
 
+	// messages are held until there are enough for a batch on every worker,
+	// or until BatchWait after the first of them arrived
+	var pending []*QueueMessage
+	var flushAt time.Time
 	for {
 		if ctx.Err() != nil {
+			c.nackMessages(context.WithoutCancel(ctx), pending, false)
 			return ctx.Err()
 		}
 
-		messages, err := receiver.ReceiveMessages(ctx, 10, nil)
-		if err != nil {
+		recvCtx, cancel := ctx, context.CancelFunc(func() {})
+		if len(pending) > 0 {
+			recvCtx, cancel = context.WithDeadline(ctx, flushAt)
+		}
+		messages, err := c.source.Receive(recvCtx)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			c.nackMessages(context.WithoutCancel(ctx), pending, false)
+			return ctx.Err()
+		}
+		// running out of time to fill the batches isn't an error
+		if err != nil && recvCtx.Err() == nil {
+			c.nackMessages(context.WithoutCancel(ctx), pending, false)
 			return fmt.Errorf("failed to receive messages: %w", err)
 		}
 
-		for _, message := range messages {
-			// Unmarshal: Service Bus wraps the JSON as a quoted string
-			var jsonStr string
-			if err := json.Unmarshal(message.Body, &jsonStr); err != nil {
-				log.Printf("failed to deserialize message envelope: %s", err)
-				if deadLetterErr := receiver.DeadLetterMessage(ctx, message, nil); deadLetterErr != nil {
-					log.Printf("failed to dead-letter message: %s", deadLetterErr)
-				}
-				continue
-			}
+		if len(pending) == 0 {
+			flushAt = time.Now().Add(c.config.BatchWait)
+		}
+		pending = append(pending, messages...)
+		if len(pending) == 0 || (len(pending) < c.config.Concurrency*c.config.BatchSize && time.Now().Before(flushAt)) {
+			continue
+		}
 
-			order, err := unmarshalOrderFromQueue([]byte(jsonStr))
-			if err != nil {
-				log.Printf("failed to unmarshal order: %s", err)
-				if deadLetterErr := receiver.DeadLetterMessage(ctx, message, nil); deadLetterErr != nil {
-					log.Printf("failed to dead-letter message: %s", deadLetterErr)
+		err = c.processMessages(ctx, pending)
+		pending = nil
+		if err != nil {
+			// Back off to avoid hammering a failing DB
+			c.retries++
+			sleepContext(ctx, retryBackoff(c.retries))
+		} else {
+			c.retries = 0
+		}
+	}
+}
+
+// processMessages writes received messages in batches of up to BatchSize on
+// up to Concurrency workers, and returns once all of them are settled.
+// Messages with the same ordering key go to the same worker in the order
+// received. If a batch can't be stored, the batches after it with the same
+// key are handed back to the source, and the error is returned.
+func (c *Consumer) processMessages(ctx context.Context, messages []*QueueMessage) error {
+	lanes := batchLanes(messages, c.config.BatchSize)
+	work := make(chan [][]*QueueMessage)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for range min(c.config.Concurrency, len(lanes)) {
+		wg.Go(func() {
+			for lane := range work {
+				if err := c.processLane(ctx, lane); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
 				}
-				continue
 			}
+		})
+	}
+	for _, lane := range lanes {
+		work <- lane
+	}
+	close(work)
+	wg.Wait()
 
-			// Write to DB first, then ack
-			if err := repo.InsertOrders([]Order{order}); err != nil {
-				log.Printf("failed to persist order %s: %s", order.OrderID, err)
-				// Don't ack; message will be retried after lock expires
-				continue
-			}
+	return errors.Join(errs...)
+}
 
-			if err := receiver.CompleteMessage(ctx, message, nil); err != nil {
-				log.Printf("failed to complete message: %s", err)
-			}
+// processLane writes batches one after another
+func (c *Consumer) processLane(ctx context.Context, batches [][]*QueueMessage) error {
+	for i, batch := range batches {
+		if ctx.Err() != nil {
+			// Hand the rest back so they aren't held until they time out
+			c.nackMessages(context.WithoutCancel(ctx), slices.Concat(batches[i:]...), false)
+			return nil
+		}
+		// A batch that was started is finished even if the consumer is
+		// stopped meanwhile, so it is settled rather than left locked
+		if err := c.processBatch(context.WithoutCancel(ctx), batch); err != nil {
+			c.nackMessages(context.WithoutCancel(ctx), slices.Concat(batches[i+1:]...), false)
+			return err
 		}
 	}
+	return nil
 }
 
-func runAMQPConsumer(ctx context.Context, queueName string, repo OrderRepo) {
-	for {
-		if err := amqpConsumeLoop(ctx, queueName, repo); err != nil {
-			if ctx.Err() != nil {
-				return
-			}
-			log.Printf("AMQP consumer error: %s. Reconnecting in 5s...", err)
-			time.Sleep(5 * time.Second)
+// batchItem is a message in a batch with the order it holds
+type batchItem struct {
+	msg   *QueueMessage
+	order Order
+	ctx   context.Context
+	span  trace.Span
+	// reason and err are set for a message without an order that can be
+	// stored, which is dead-lettered
+	reason string
+	err    error
+	// insertErr is set if the order failed to be written
+	insertErr error
+}
+
+// processBatch persists the orders in a batch of messages with one
+// InsertOrders call, and settles the messages once the write is durable.
+// Processing each message is traced as part of its producer's trace, and
+// linked to the span of the write. If the batch fails to be written, its
+// orders are written one by one, so an order the database rejects doesn't
+// count as a failure against the others; orders after a failed one with the
+// same ordering key are not written, as settleItems hands them back. It
+// returns an error if some orders could not be persisted and their messages
+// were handed back.
+func (c *Consumer) processBatch(ctx context.Context, messages []*QueueMessage) error {
+	transport := c.source.Transport()
+	messagesReceived.WithLabelValues(transport).Add(float64(len(messages)))
+	messagesInFlight.WithLabelValues(transport).Add(float64(len(messages)))
+	defer messagesInFlight.WithLabelValues(transport).Sub(float64(len(messages)))
+
+	items := make([]*batchItem, 0, len(messages))
+	var valid []*batchItem
+	for _, msg := range messages {
+		item := c.readOrder(ctx, msg)
+		defer item.span.End()
+		items = append(items, item)
+		if item.err == nil {
+			valid = append(valid, item)
 		}
 	}
-}
 
-func amqpConsumeLoop(ctx context.Context, queueName string, repo OrderRepo) error {
-	orderQueueUri := os.Getenv("ORDER_QUEUE_URI")
-	if orderQueueUri == "" {
-		return errors.New("ORDER_QUEUE_URI is not set")
+	// Write to DB first, then ack
+	if len(valid) > 0 {
+		err := c.insertItems(ctx, valid)
+		if err != nil && len(valid) > 1 {
+			slog.WarnContext(ctx, "Failed to persist batch, retrying orders one by one", "orders", len(valid), errAttr(err))
+			failedKeys := make(map[string]bool)
+			for _, item := range valid {
+				key := item.msg.OrderingKey
+				if key != "" && failedKeys[key] {
+					item.insertErr = err
+					continue
+				}
+				item.insertErr = c.insertItems(ctx, []*batchItem{item})
+				if item.insertErr != nil && key != "" {
+					failedKeys[key] = true
+				}
+			}
+		} else {
+			for _, item := range valid {
+				item.insertErr = err
+			}
+		}
 	}
 
-	orderQueueUsername := os.Getenv("ORDER_QUEUE_USERNAME")
-	orderQueuePassword := os.Getenv("ORDER_QUEUE_PASSWORD")
+	return c.settleItems(items)
+}
 
-	conn, err := amqp.Dial(ctx, orderQueueUri, &amqp.ConnOptions{
-		SASLType: amqp.SASLTypePlain(orderQueueUsername, orderQueuePassword),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to connect to queue: %w", err)
+// readOrder reads the order in msg and starts the span that traces
+// processing it. A message without an order that can be stored is returned
+// with the reason to dead-letter it.
+func (c *Consumer) readOrder(ctx context.Context, msg *QueueMessage) *batchItem {
+	// the event decides the message ID, so it is read before the span
+	event, eventErr := unwrapCloudEvent(msg)
+	msgCtx, span := startMessageSpan(ctx, c.source.Transport(), c.source.Name(), msg.ID, msg.Properties)
+	msgCtx = withLogAttrs(msgCtx, slog.String(LOG_MESSAGE_ID, msg.ID))
+	item := &batchItem{msg: msg, ctx: msgCtx, span: span}
+
+	if event != nil {
+		span.SetAttributes(event.attributes()...)
+		item.ctx = withLogAttrs(item.ctx, slog.String(LOG_EVENT_TYPE, event.Type), slog.String(LOG_EVENT_SOURCE, event.Source))
+	}
+	reason := DEAD_LETTER_INVALID_ORDER
+	if eventErr == nil && event != nil && !c.config.acceptsEventType(event.Type) {
+		eventErr = fmt.Errorf("unsupported CloudEvents type %q", event.Type)
+		reason = DEAD_LETTER_UNSUPPORTED_EVENT
+	}
+	if eventErr != nil {
+		slog.WarnContext(item.ctx, "Failed to read CloudEvent, dead-lettering message", errAttr(eventErr))
+		failSpan(span, eventErr)
+		item.reason, item.err = reason, eventErr
+		return item
 	}
-	defer conn.Close()
 
-	session, err := conn.NewSession(ctx, nil)
+	_, unmarshalSpan := tracer.Start(item.ctx, "unmarshal order")
+	order, err := unmarshalOrderFromQueue(msg.Body, c.ids)
+	endSpan(unmarshalSpan, err)
 	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
+		slog.WarnContext(item.ctx, "Failed to unmarshal order, dead-lettering message", errAttr(err))
+		failSpan(span, err)
+		item.reason, item.err = DEAD_LETTER_INVALID_ORDER, err
+		return item
 	}
+	order.MessageID = msg.ID
+	span.SetAttributes(attribute.String(ORDER_ID_ATTRIBUTE, order.OrderID))
+	item.ctx = withLogAttrs(item.ctx, slog.String(LOG_ORDER_ID, order.OrderID), slog.String(LOG_CUSTOMER_ID, order.CustomerID))
+	item.order = order
+	return item
+}
 
-	// RabbitMQ 4.x requires AMQP 1.0 address v2 format: /queues/<name>
-	receiver, err := session.NewReceiver(ctx, "/queues/"+queueName, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create receiver: %w", err)
+// insertItems writes the orders of items with one InsertOrders call, traced
+// with links to the spans of their messages
+func (c *Consumer) insertItems(ctx context.Context, items []*batchItem) error {
+	orders := make([]Order, 0, len(items))
+	links := make([]trace.Link, 0, len(items))
+	for _, item := range items {
+		orders = append(orders, item.order)
+		links = append(links, trace.Link{SpanContext: item.span.SpanContext()})
 	}
-	defer func() {
-		closeCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-		defer cancel()
-		receiver.Close(closeCtx)
-	}()
+	insertCtx, insertSpan := tracer.Start(ctx, "InsertOrders",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("orders", len(orders))),
+	)
+	err := c.repo.InsertOrders(insertCtx, orders)
+	endSpan(insertSpan, err)
+	return err
+}
 
-	log.Printf("AMQP consumer connected to queue: %s", queueName)
+// settleItems settles the messages of a batch in the order received: stored
+// orders are acked, messages without an order are dead-lettered and orders
+// that failed are handed back. Once an order with an ordering key fails, the
+// messages after it with the same key are handed back too, without counting
+// a failure, so a Kafka offset is never committed past an order that wasn't
+// stored. It returns an error if any order failed.
+func (c *Consumer) settleItems(items []*batchItem) error {
+	transport := c.source.Transport()
+	var errs []error
+	blocked := make(map[string]bool)
+	for _, item := range items {
+		switch {
+		case item.msg.OrderingKey != "" && blocked[item.msg.OrderingKey]:
+			c.nackMessages(item.ctx, []*QueueMessage{item.msg}, false)
+		case item.err != nil:
+			if err := c.deadLetter(item.ctx, item.msg, item.reason, item.err); err != nil {
+				errs = append(errs, err)
+			}
+		case item.insertErr != nil:
+			if item.msg.OrderingKey != "" {
+				blocked[item.msg.OrderingKey] = true
+			}
+			if err := c.insertFailed(item, item.insertErr); err != nil {
+				errs = append(errs, err)
+			}
+			errs = append(errs, item.insertErr)
+		default:
+			c.forget(item.msg)
 
-	for {
-		if ctx.Err() != nil {
-			return ctx.Err()
+			ackCtx, ackSpan := tracer.Start(item.ctx, "ack message")
+			err := c.source.Ack(ackCtx, item.msg)
+			endSpan(ackSpan, err)
+			if err != nil {
+				// the order is stored, and will be skipped as a duplicate when
+				// the message is delivered again
+				slog.ErrorContext(item.ctx, "Failed to ack message", errAttr(err))
+				failSpan(item.span, err)
+			} else {
+				recordSettled(transport, OUTCOME_ACK)
+			}
+			publishOrderEvent(item.ctx, c.repo, c.events, ORDER_CREATED_EVENT, item.order.OrderID)
 		}
+	}
+	return errors.Join(errs...)
+}
 
-		// Block up to 5 seconds waiting for the next message
-		recvCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		msg, err := receiver.Receive(recvCtx, nil)
-		cancel()
+// insertFailed settles a message whose order failed to be written with err.
+// The message is handed back, or dead-lettered once it has been delivered
+// MaxDeliveries times. It returns an error if dead-lettering failed.
+func (c *Consumer) insertFailed(item *batchItem, err error) error {
+	failSpan(item.span, err)
+	deliveries := c.recordFailure(item.msg)
+	if deliveries >= c.config.MaxDeliveries {
+		slog.ErrorContext(item.ctx, "Failed to persist order, dead-lettering message", "deliveries", deliveries, errAttr(err))
+		return c.deadLetter(item.ctx, item.msg, DEAD_LETTER_MAX_DELIVERIES, err)
+	}
+	slog.ErrorContext(item.ctx, "Failed to persist order, releasing message", "deliveries", deliveries, errAttr(err))
+	c.nackMessages(item.ctx, []*QueueMessage{item.msg}, true)
+	return nil
+}
 
-		if err != nil {
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
-			// Timeout just means no messages available, keep polling
-			if recvCtx.Err() != nil {
-				continue
-			}
-			return fmt.Errorf("receive error: %w", err)
-		}
+// deadLetter dead-letters a message that failed with cause. If the message
+// can't be dead-lettered, it is handed back so it isn't lost, and an error is
+// returned.
+func (c *Consumer) deadLetter(ctx context.Context, msg *QueueMessage, reason string, cause error) error {
+	if err := c.source.DeadLetter(ctx, msg, reason, cause.Error()); err != nil {
+		slog.ErrorContext(ctx, "Failed to dead-letter message", errAttr(err))
+		c.nackMessages(ctx, []*QueueMessage{msg}, false)
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+	c.forget(msg)
+	recordSettled(c.source.Transport(), OUTCOME_DEAD_LETTER)
+	return nil
+}
 
-		order, err := unmarshalOrderFromQueue(msg.GetData())
-		if err != nil {
-			log.Printf("failed to unmarshal message, rejecting: %s", err)
-			_ = receiver.RejectMessage(ctx, msg, nil)
+// recordFailure counts a failed delivery of msg and returns how many times it
+// has been delivered, by the broker's count or the consumer's own, whichever
+// is higher
+func (c *Consumer) recordFailure(msg *QueueMessage) int {
+	if msg.ID == "" {
+		return msg.DeliveryCount
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.failures) >= maxTrackedDeliveries {
+		clear(c.failures)
+	}
+	c.failures[msg.ID]++
+	return max(c.failures[msg.ID], msg.DeliveryCount)
+}
+
+// forget stops counting the failed deliveries of a settled message
+func (c *Consumer) forget(msg *QueueMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.failures, msg.ID)
+}
+
+// batchLanes splits messages into batches of up to size, grouped in lanes
+// that can be processed at the same time. The messages of an ordering key
+// form one lane, with its batches in the order received. Messages without a
+// key are batched together, one lane per batch.
+func batchLanes(messages []*QueueMessage, size int) [][][]*QueueMessage {
+	var keys []string
+	byKey := make(map[string][]*QueueMessage)
+	var unordered []*QueueMessage
+	for _, msg := range messages {
+		if msg.OrderingKey == "" {
+			unordered = append(unordered, msg)
 			continue
 		}
+		if _, ok := byKey[msg.OrderingKey]; !ok {
+			keys = append(keys, msg.OrderingKey)
+		}
+		byKey[msg.OrderingKey] = append(byKey[msg.OrderingKey], msg)
+	}
 
-		// Write to DB first, then ack
-		if err := repo.InsertOrders([]Order{order}); err != nil {
-			log.Printf("failed to persist order %s: %s, releasing message", order.OrderID, err)
-			_ = receiver.ReleaseMessage(ctx, msg)
-			// Back off briefly to avoid hammering a failing DB
-			time.Sleep(1 * time.Second)
+	var lanes [][][]*QueueMessage
+	for _, key := range keys {
+		lanes = append(lanes, slices.Collect(slices.Chunk(byKey[key], size)))
+	}
+	for batch := range slices.Chunk(unordered, size) {
+		lanes = append(lanes, [][]*QueueMessage{batch})
+	}
+	return lanes
+}
+
+// nackMessages hands messages back to the source
+func (c *Consumer) nackMessages(ctx context.Context, messages []*QueueMessage, failed bool) {
+	for _, msg := range messages {
+		if err := c.source.Nack(ctx, msg, failed); err != nil {
+			slog.ErrorContext(ctx, "Failed to release message", LOG_MESSAGE_ID, msg.ID, errAttr(err))
 			continue
 		}
+		recordSettled(c.source.Transport(), OUTCOME_RELEASE)
+	}
+}
 
-		if err := receiver.AcceptMessage(ctx, msg); err != nil {
-			log.Printf("failed to accept message: %s", err)
-		}
+// retryBackoff is how long to wait after the given number of failures in a
+// row: RETRY_BACKOFF_MIN, doubling up to RETRY_BACKOFF_MAX
+func retryBackoff(retries int) time.Duration {
+	backoff := RETRY_BACKOFF_MIN
+	for i := 1; i < retries && backoff < RETRY_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+	return min(backoff, RETRY_BACKOFF_MAX)
+}
+
+// deadLetterQueueName is the queue poison messages are moved to when the
+// broker has no dead-letter queue of its own: ORDER_QUEUE_DEAD_LETTER_NAME, or
+// the order queue name with a .dlq suffix
+func deadLetterQueueName(queueName string) string {
+	if name := os.Getenv("ORDER_QUEUE_DEAD_LETTER_NAME"); name != "" {
+		return name
 	}
+	return queueName + ".dlq"
 }
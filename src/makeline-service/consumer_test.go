@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// settlement is how a message was settled with the source
+type settlement struct {
+	outcome string
+	// failed is set for a message handed back because processing it failed
+	failed bool
+	// reason is the dead-letter reason
+	reason string
+}
+
+// fakeSource is an OrderSource that records how each message is settled
+type fakeSource struct {
+	mu          sync.Mutex
+	settlements map[*QueueMessage]settlement
+	// deadLetterErr is returned by DeadLetter, if set
+	deadLetterErr error
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{settlements: make(map[*QueueMessage]settlement)}
+}
+
+func (s *fakeSource) Transport() string               { return "fake" }
+func (s *fakeSource) Name() string                    { return "orders" }
+func (s *fakeSource) Open(ctx context.Context) error  { return nil }
+func (s *fakeSource) Close(ctx context.Context) error { return nil }
+func (s *fakeSource) Ping(ctx context.Context) error  { return nil }
+
+func (s *fakeSource) Receive(ctx context.Context) ([]*QueueMessage, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *fakeSource) Ack(ctx context.Context, msg *QueueMessage) error {
+	return s.settle(msg, settlement{outcome: OUTCOME_ACK})
+}
+
+func (s *fakeSource) Nack(ctx context.Context, msg *QueueMessage, failed bool) error {
+	return s.settle(msg, settlement{outcome: OUTCOME_RELEASE, failed: failed})
+}
+
+func (s *fakeSource) DeadLetter(ctx context.Context, msg *QueueMessage, reason string, description string) error {
+	if s.deadLetterErr != nil {
+		return s.deadLetterErr
+	}
+	return s.settle(msg, settlement{outcome: OUTCOME_DEAD_LETTER, reason: reason})
+}
+
+// reset forgets how messages were settled, as if they were delivered again
+func (s *fakeSource) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.settlements)
+}
+
+func (s *fakeSource) settle(msg *QueueMessage, how settlement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous, ok := s.settlements[msg]; ok {
+		return errors.New("message was already settled as " + previous.outcome)
+	}
+	s.settlements[msg] = how
+	return nil
+}
+
+// rejectingRepo is an in-memory repo that fails to insert any batch holding
+// an order of the customer "reject"
+type rejectingRepo struct {
+	*InMemoryOrderRepo
+}
+
+func (r *rejectingRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	if slices.ContainsFunc(orders, func(o Order) bool { return o.CustomerID == "reject" }) {
+		return errors.New("order rejected by the database")
+	}
+	return r.InMemoryOrderRepo.InsertOrders(ctx, orders)
+}
+
+// testOrderJSON is an order as a producer sends it
+func testOrderJSON(customer string) []byte {
+	return fmt.Appendf(nil, `{"customerId":"%s","items":[{"productId":1,"quantity":1,"price":10}]}`, customer)
+}
+
+// testConsumerConfig processes messages on a couple of workers, in small
+// batches
+func testConsumerConfig() ConsumerConfig {
+	return ConsumerConfig{MaxDeliveries: DEFAULT_MAX_DELIVERIES, Concurrency: 2, Prefetch: 10, BatchSize: 5, BatchWait: 10 * time.Millisecond}
+}
+
+func countOrders(t *testing.T, repo OrderRepo) int {
+	t.Helper()
+	orders, err := repo.GetPendingOrders(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(orders)
+}
+
+func TestConsumerSettlesMessages(t *testing.T) {
+	order := func(id string, customer string) QueueMessage {
+		return QueueMessage{ID: id, Body: testOrderJSON(customer), DeliveryCount: 1}
+	}
+	keyed := func(msg QueueMessage, key string) QueueMessage {
+		msg.OrderingKey = key
+		return msg
+	}
+	redelivered := func(msg QueueMessage, deliveries int) QueueMessage {
+		msg.DeliveryCount = deliveries
+		return msg
+	}
+	poison := QueueMessage{ID: "poison", Body: []byte("not an order"), DeliveryCount: 1}
+	event := func(id string, eventType string) QueueMessage {
+		return QueueMessage{
+			ID:            id,
+			Body:          fmt.Appendf(nil, `{"specversion":"1.0","id":"e1","source":"/test","type":"%s","data":%s}`, eventType, testOrderJSON("1")),
+			DeliveryCount: 1,
+		}
+	}
+
+	ack := settlement{outcome: OUTCOME_ACK}
+	release := settlement{outcome: OUTCOME_RELEASE, failed: true}
+	handBack := settlement{outcome: OUTCOME_RELEASE}
+	deadLetter := settlement{outcome: OUTCOME_DEAD_LETTER, reason: DEAD_LETTER_INVALID_ORDER}
+
+	tests := []struct {
+		name       string
+		messages   []QueueMessage
+		eventTypes []string
+		want       []settlement
+		wantOrders int
+		wantErr    bool
+	}{
+		{
+			name:       "stored orders are acked",
+			messages:   []QueueMessage{order("m1", "1"), order("m2", "2")},
+			want:       []settlement{ack, ack},
+			wantOrders: 2,
+		},
+		{
+			name:       "order delivered twice is stored once",
+			messages:   []QueueMessage{order("m1", "1"), order("m1", "1")},
+			want:       []settlement{ack, ack},
+			wantOrders: 1,
+		},
+		{
+			name:     "invalid order is dead-lettered",
+			messages: []QueueMessage{poison},
+			want:     []settlement{deadLetter},
+		},
+		{
+			name:       "poison message doesn't stop the orders after it",
+			messages:   []QueueMessage{order("m1", "1"), poison, order("m3", "3")},
+			want:       []settlement{ack, deadLetter, ack},
+			wantOrders: 2,
+		},
+		{
+			name:       "order in a CloudEvent is stored",
+			messages:   []QueueMessage{event("m1", "com.test.order")},
+			eventTypes: []string{"com.test.order"},
+			want:       []settlement{ack},
+			wantOrders: 1,
+		},
+		{
+			name:       "event sent in two messages is stored once",
+			messages:   []QueueMessage{event("m1", "com.test.order"), event("m2", "com.test.order")},
+			want:       []settlement{ack, ack},
+			wantOrders: 1,
+		},
+		{
+			name:       "event of another type is dead-lettered",
+			messages:   []QueueMessage{event("m1", "com.test.refund")},
+			eventTypes: []string{"com.test.order"},
+			want:       []settlement{{outcome: OUTCOME_DEAD_LETTER, reason: DEAD_LETTER_UNSUPPORTED_EVENT}},
+		},
+		{
+			name:     "invalid CloudEvent is dead-lettered",
+			messages: []QueueMessage{{ID: "m1", Body: []byte(`{"specversion":"1.0","type":"com.test.order","data":{}}`), DeliveryCount: 1}},
+			want:     []settlement{deadLetter},
+		},
+		{
+			name:     "order that fails to be stored is released",
+			messages: []QueueMessage{order("m1", "reject")},
+			want:     []settlement{release},
+			wantErr:  true,
+		},
+		{
+			name:     "order that keeps failing is dead-lettered",
+			messages: []QueueMessage{redelivered(order("m1", "reject"), DEFAULT_MAX_DELIVERIES)},
+			want:     []settlement{{outcome: OUTCOME_DEAD_LETTER, reason: DEAD_LETTER_MAX_DELIVERIES}},
+			wantErr:  true,
+		},
+		{
+			name:       "rejected order doesn't fail the rest of its batch",
+			messages:   []QueueMessage{order("m1", "1"), order("m2", "reject"), order("m3", "3")},
+			want:       []settlement{ack, release, ack},
+			wantOrders: 2,
+			wantErr:    true,
+		},
+		{
+			name: "orders without a key don't wait for a failed batch",
+			messages: []QueueMessage{
+				order("m1", "reject"), order("m2", "reject"), order("m3", "reject"), order("m4", "reject"), order("m5", "reject"),
+				order("m6", "6"), order("m7", "7"),
+			},
+			want:       []settlement{release, release, release, release, release, ack, ack},
+			wantOrders: 2,
+			wantErr:    true,
+		},
+		{
+			name: "batches after a failed one with the same key are handed back",
+			messages: []QueueMessage{
+				keyed(order("m1", "reject"), "p0"), keyed(order("m2", "2"), "p0"), keyed(order("m3", "3"), "p0"), keyed(order("m4", "4"), "p0"), keyed(order("m5", "5"), "p0"),
+				keyed(order("m6", "6"), "p0"), keyed(order("m7", "7"), "p1"),
+			},
+			want:       []settlement{release, handBack, handBack, handBack, handBack, handBack, ack},
+			wantOrders: 1,
+			wantErr:    true,
+		},
+		{
+			name:     "poison message after a failed order with the same key is handed back",
+			messages: []QueueMessage{keyed(order("m1", "reject"), "p0"), keyed(poison, "p0")},
+			want:     []settlement{release, handBack},
+			wantErr:  true,
+		},
+		{
+			name:       "poison message is dead-lettered after the orders before it",
+			messages:   []QueueMessage{keyed(order("m1", "1"), "p0"), keyed(poison, "p0"), keyed(order("m3", "3"), "p0")},
+			want:       []settlement{ack, deadLetter, ack},
+			wantOrders: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := newFakeSource()
+			repo := &rejectingRepo{NewInMemoryOrderRepo()}
+
+			messages := make([]*QueueMessage, len(tt.messages))
+			for i := range tt.messages {
+				messages[i] = &tt.messages[i]
+			}
+			config := testConsumerConfig()
+			config.EventTypes = tt.eventTypes
+			consumer := NewConsumer(source, repo, NewEventBus(), NewConsumerLink(), NewULIDGenerator(), config)
+			err := consumer.processMessages(context.Background(), messages)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want one: %t", err, tt.wantErr)
+			}
+
+			for i, msg := range messages {
+				got, ok := source.settlements[msg]
+				if !ok {
+					t.Errorf("message %d was not settled, want %+v", i, tt.want[i])
+					continue
+				}
+				if got != tt.want[i] {
+					t.Errorf("message %d was settled as %+v, want %+v", i, got, tt.want[i])
+				}
+			}
+			if got := countOrders(t, repo); got != tt.wantOrders {
+				t.Errorf("stored %d orders, want %d", got, tt.wantOrders)
+			}
+		})
+	}
+}
+
+func TestConsumerPublishesCreatedOrders(t *testing.T) {
+	source := newFakeSource()
+	repo := NewInMemoryOrderRepo()
+	events := NewEventBus()
+	received, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	messages := []*QueueMessage{{ID: "m1", Body: testOrderJSON("1")}, {ID: "m1", Body: testOrderJSON("1")}}
+	consumer := NewConsumer(source, repo, events, NewConsumerLink(), NewULIDGenerator(), testConsumerConfig())
+	if err := consumer.processMessages(context.Background(), messages); err != nil {
+		t.Fatal(err)
+	}
+
+	// the redelivered message isn't announced again
+	if got := len(received); got != 1 {
+		t.Fatalf("got %d events, want 1", got)
+	}
+	event := <-received
+	if event.Type != ORDER_CREATED_EVENT || event.Order.CustomerID != "1" || event.Order.Status != Pending {
+		t.Errorf("got %s event for an order of customer %s in status %s, want %s for a Pending order of customer 1", event.Type, event.Order.CustomerID, event.Order.Status, ORDER_CREATED_EVENT)
+	}
+}
+
+func TestProcessMessagesAfterStop(t *testing.T) {
+	source := newFakeSource()
+	repo := NewInMemoryOrderRepo()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	messages := []*QueueMessage{{ID: "m1", Body: testOrderJSON("1")}, {ID: "m2", Body: testOrderJSON("2")}}
+	consumer := NewConsumer(source, repo, NewEventBus(), NewConsumerLink(), NewULIDGenerator(), testConsumerConfig())
+	if err := consumer.processMessages(ctx, messages); err != nil {
+		t.Fatal(err)
+	}
+
+	// messages received as the consumer stops are handed back unprocessed
+	for i, msg := range messages {
+		if got, want := source.settlements[msg], (settlement{outcome: OUTCOME_RELEASE}); got != want {
+			t.Errorf("message %d was settled as %+v, want %+v", i, got, want)
+		}
+	}
+	if got := countOrders(t, repo); got != 0 {
+		t.Errorf("stored %d orders, want none", got)
+	}
+}
+
+func TestConsumerCountsDeliveries(t *testing.T) {
+	// the broker doesn't count deliveries, so the consumer counts them itself
+	source := newFakeSource()
+	repo := &rejectingRepo{NewInMemoryOrderRepo()}
+	config := testConsumerConfig()
+	config.MaxDeliveries = 3
+	consumer := NewConsumer(source, repo, NewEventBus(), NewConsumerLink(), NewULIDGenerator(), config)
+	msg := &QueueMessage{ID: "m1", Body: testOrderJSON("reject"), DeliveryCount: 1}
+
+	want := []settlement{
+		{outcome: OUTCOME_RELEASE, failed: true},
+		{outcome: OUTCOME_RELEASE, failed: true},
+		{outcome: OUTCOME_DEAD_LETTER, reason: DEAD_LETTER_MAX_DELIVERIES},
+	}
+	for i, want := range want {
+		source.reset()
+		if err := consumer.processMessages(context.Background(), []*QueueMessage{msg}); err == nil {
+			t.Fatalf("delivery %d: got no error, want the insert to fail", i+1)
+		}
+		if got := source.settlements[msg]; got != want {
+			t.Errorf("delivery %d: message was settled as %+v, want %+v", i+1, got, want)
+		}
+	}
+}
+
+func TestConsumerDeadLetterFails(t *testing.T) {
+	source := newFakeSource()
+	source.deadLetterErr = errors.New("dead-letter queue unavailable")
+	consumer := NewConsumer(source, NewInMemoryOrderRepo(), NewEventBus(), NewConsumerLink(), NewULIDGenerator(), testConsumerConfig())
+	msg := &QueueMessage{ID: "poison", Body: []byte("not an order"), DeliveryCount: 1}
+
+	if err := consumer.processMessages(context.Background(), []*QueueMessage{msg}); err == nil {
+		t.Error("got no error, want the dead-letter failure")
+	}
+	// the message is handed back rather than lost
+	if got, want := source.settlements[msg], (settlement{outcome: OUTCOME_RELEASE}); got != want {
+		t.Errorf("message was settled as %+v, want %+v", got, want)
+	}
+}
+
+func TestBatchLanes(t *testing.T) {
+	messages := []*QueueMessage{
+		{ID: "m1", OrderingKey: "p0"},
+		{ID: "m2"},
+		{ID: "m3", OrderingKey: "p1"},
+		{ID: "m4", OrderingKey: "p0"},
+		{ID: "m5"},
+		{ID: "m6", OrderingKey: "p0"},
+		{ID: "m7"},
+	}
+
+	var got [][][]string
+	for _, lane := range batchLanes(messages, 2) {
+		var batches [][]string
+		for _, batch := range lane {
+			var ids []string
+			for _, msg := range batch {
+				ids = append(ids, msg.ID)
+			}
+			batches = append(batches, ids)
+		}
+		got = append(got, batches)
+	}
+	want := [][][]string{
+		{{"m1", "m4"}, {"m6"}},
+		{{"m3"}},
+		{{"m2", "m5"}},
+		{{"m7"}},
+	}
+	if !slices.EqualFunc(got, want, func(a, b [][]string) bool { return slices.EqualFunc(a, b, slices.Equal) }) {
+		t.Errorf("got lanes %v, want %v", got, want)
+	}
+}
+
+func TestConsumerWritesBatches(t *testing.T) {
+	source := newFakeSource()
+	repo := &batchRecordingRepo{InMemoryOrderRepo: NewInMemoryOrderRepo()}
+	config := testConsumerConfig()
+	config.Concurrency = 1
+	consumer := NewConsumer(source, repo, NewEventBus(), NewConsumerLink(), NewULIDGenerator(), config)
+
+	var messages []*QueueMessage
+	for i := range 12 {
+		messages = append(messages, &QueueMessage{ID: fmt.Sprint(i), Body: testOrderJSON(fmt.Sprint(i)), DeliveryCount: 1})
+	}
+	if err := consumer.processMessages(context.Background(), messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{5, 5, 2}; !slices.Equal(repo.batches, want) {
+		t.Errorf("wrote batches of %v orders, want %v", repo.batches, want)
+	}
+	for i, msg := range messages {
+		if got := source.settlements[msg]; got.outcome != OUTCOME_ACK {
+			t.Errorf("message %d was settled as %+v, want an ack", i, got)
+		}
+	}
+}
+
+// batchRecordingRepo is an in-memory repo that records how many orders each
+// InsertOrders call writes
+type batchRecordingRepo struct {
+	*InMemoryOrderRepo
+	mu      sync.Mutex
+	batches []int
+}
+
+func (r *batchRecordingRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	r.mu.Lock()
+	r.batches = append(r.batches, len(orders))
+	r.mu.Unlock()
+	return r.InMemoryOrderRepo.InsertOrders(ctx, orders)
+}
+
+func TestProcessMessagesConcurrently(t *testing.T) {
+	// every insert waits for the others, so the batch only finishes if the
+	// lanes are processed at the same time
+	source := newFakeSource()
+	config := testConsumerConfig()
+	config.Concurrency = 3
+	config.BatchSize = 1
+	repo := &barrierRepo{InMemoryOrderRepo: NewInMemoryOrderRepo(), waiting: config.Concurrency, release: make(chan struct{})}
+	consumer := NewConsumer(source, repo, NewEventBus(), NewConsumerLink(), NewULIDGenerator(), config)
+
+	var messages []*QueueMessage
+	for i := range config.Concurrency {
+		messages = append(messages, &QueueMessage{ID: fmt.Sprint(i), Body: testOrderJSON(fmt.Sprint(i)), DeliveryCount: 1})
+	}
+	done := make(chan error)
+	go func() { done <- consumer.processMessages(context.Background(), messages) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages were not processed concurrently")
+	}
+	if got := countOrders(t, repo); got != config.Concurrency {
+		t.Errorf("stored %d orders, want %d", got, config.Concurrency)
+	}
+}
+
+// barrierRepo is an in-memory repo whose inserts wait until waiting inserts
+// have started
+type barrierRepo struct {
+	*InMemoryOrderRepo
+	mu      sync.Mutex
+	waiting int
+	release chan struct{}
+}
+
+func (r *barrierRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	r.mu.Lock()
+	r.waiting--
+	if r.waiting == 0 {
+		close(r.release)
+	}
+	r.mu.Unlock()
+	<-r.release
+	return r.InMemoryOrderRepo.InsertOrders(ctx, orders)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		retries int
+		want    time.Duration
+	}{
+		{retries: 1, want: RETRY_BACKOFF_MIN},
+		{retries: 2, want: 2 * RETRY_BACKOFF_MIN},
+		{retries: 3, want: 4 * RETRY_BACKOFF_MIN},
+		{retries: 5, want: 16 * RETRY_BACKOFF_MIN},
+		{retries: 6, want: RETRY_BACKOFF_MAX},
+		{retries: 1000, want: RETRY_BACKOFF_MAX},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.retries), func(t *testing.T) {
+			if got := retryBackoff(tt.retries); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,46 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 	"github.com/gofrs/uuid"
 )
 
+// orderMessageNamespace is the UUID namespace for item ids derived from queue
+// message IDs
+var orderMessageNamespace = uuid.Must(uuid.FromString("6f1f7a3e-2b9c-4d4e-9a51-0c3f6b2d8e17"))
+
+// MAX_COSMOS_BATCH_OPERATIONS is the most operations Cosmos DB accepts in a
+// transactional batch
+const MAX_COSMOS_BATCH_OPERATIONS = 100
+
+// cosmosTimestampLayout is RFC 3339 in UTC with all nine fractional digits.
+// createdAt is stored in it so timestamps have a fixed width and compare as
+// strings in time order, which RFC 3339 with trailing zeros trimmed doesn't.
+const cosmosTimestampLayout = "2006-01-02T15:04:05.000000000Z"
+
+// cosmosTimestamp formats t the way createdAt is stored and queried
+func cosmosTimestamp(t time.Time) string {
+	return t.UTC().Format(cosmosTimestampLayout)
+}
+
+// COSMOS_CLAIM_OVERFETCH is how many more pending orders ClaimOrders reads
+// than it asks to claim, to make up for orders other workers claim first
+const COSMOS_CLAIM_OVERFETCH = 5
+
 type PartitionKey struct {
 	Key   string
 	Value string
@@ -19,60 +49,67 @@ type PartitionKey struct {
 type CosmosDBOrderRepo struct {
 	db           *azcosmos.ContainerClient
 	partitionKey PartitionKey
+	// outbox is set when lifecycle events are stored as outbox items in
+	// their order's partition
+	outbox bool
 }
 
 func NewCosmosDBOrderRepoWithManagedIdentity(cosmosDbEndpoint string, dbName string, containerName string, partitionKey PartitionKey) (*CosmosDBOrderRepo, error) {
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
-		log.Printf("failed to create cosmosdb workload identity credential: %v\n", err)
+		slog.Error("Failed to create Cosmos DB workload identity credential", errAttr(err))
 		return nil, err
 	}
 
 	opts := azcosmos.ClientOptions{
+		ClientOptions:                policy.ClientOptions{TracingProvider: azureTracingProvider()},
 		EnableContentResponseOnWrite: true,
 	}
 
 	client, err := azcosmos.NewClient(cosmosDbEndpoint, cred, &opts)
 	if err != nil {
-		log.Printf("failed to create cosmosdb client: %v\n", err)
+		slog.Error("Failed to create Cosmos DB client", errAttr(err))
 		return nil, err
 	}
 
 	// create a cosmos container
 	container, err := client.NewContainer(dbName, containerName)
 	if err != nil {
-		log.Printf("failed to create cosmosdb container: %v\n", err)
+		slog.Error("Failed to create Cosmos DB container", errAttr(err))
 		return nil, err
 	}
 
-	return &CosmosDBOrderRepo{container, partitionKey}, nil
+	return &CosmosDBOrderRepo{db: container, partitionKey: partitionKey}, nil
 }
 
 func NewCosmosDBOrderRepo(cosmosDbEndpoint string, dbName string, containerName string, cosmosDbKey string, partitionKey PartitionKey) (*CosmosDBOrderRepo, error) {
 	cred, err := azcosmos.NewKeyCredential(cosmosDbKey)
 	if err != nil {
-		log.Printf("failed to create cosmosdb key credential: %v\n", err)
+		slog.Error("Failed to create Cosmos DB key credential", errAttr(err))
 		return nil, err
 	}
 
 	// create a cosmos client
-	client, err := azcosmos.NewClientWithKey(cosmosDbEndpoint, cred, nil)
+	opts := azcosmos.ClientOptions{
+		ClientOptions: policy.ClientOptions{TracingProvider: azureTracingProvider()},
+	}
+	client, err := azcosmos.NewClientWithKey(cosmosDbEndpoint, cred, &opts)
 	if err != nil {
-		log.Printf("failed to create cosmosdb client: %v\n", err)
+		slog.Error("Failed to create Cosmos DB client", errAttr(err))
 		return nil, err
 	}
 
 	// create a cosmos container
 	container, err := client.NewContainer(dbName, containerName)
 	if err != nil {
-		log.Printf("failed to create cosmosdb container: %v\n", err)
+		slog.Error("Failed to create Cosmos DB container", errAttr(err))
 		return nil, err
 	}
 
-	return &CosmosDBOrderRepo{container, partitionKey}, nil
+	return &CosmosDBOrderRepo{db: container, partitionKey: partitionKey}, nil
 }
 
-func (r *CosmosDBOrderRepo) GetPendingOrders() ([]Order, error) {
+func (r *CosmosDBOrderRepo) GetPendingOrders(ctx context.Context) ([]Order, error) {
 	var orders []Order
 
 	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
@@ -84,9 +121,9 @@ func (r *CosmosDBOrderRepo) GetPendingOrders() ([]Order, error) {
 	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.status = @status", pk, opt)
 
 	for queryPager.More() {
-		queryResponse, err := queryPager.NextPage(context.Background())
+		queryResponse, err := queryPager.NextPage(ctx)
 		if err != nil {
-			log.Printf("failed to get next page: %v\n", err)
+			slog.ErrorContext(ctx, "Failed to get next page", errAttr(err))
 			return nil, err
 		}
 
@@ -94,7 +131,7 @@ func (r *CosmosDBOrderRepo) GetPendingOrders() ([]Order, error) {
 			var order Order
 			err := json.Unmarshal(item, &order)
 			if err != nil {
-				log.Printf("failed to deserialize order: %v\n", err)
+				slog.ErrorContext(ctx, "Failed to deserialize order", errAttr(err))
 				return nil, err
 			}
 			orders = append(orders, order)
@@ -103,7 +140,38 @@ func (r *CosmosDBOrderRepo) GetPendingOrders() ([]Order, error) {
 	return orders, nil
 }
 
-func (r *CosmosDBOrderRepo) GetOrder(id string) (Order, error) {
+func (r *CosmosDBOrderRepo) CountPendingOrders(ctx context.Context) (int, error) {
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	opt := &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@status", Value: Pending},
+		},
+	}
+	queryPager := r.db.NewQueryItemsPager("SELECT VALUE COUNT(1) FROM o WHERE o.status = @status", pk, opt)
+
+	// a count within one partition comes back as a single value, but may be
+	// split over pages that each hold a partial count
+	var count int
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get next page", errAttr(err))
+			return 0, err
+		}
+
+		for _, item := range queryResponse.Items {
+			var partial int
+			if err := json.Unmarshal(item, &partial); err != nil {
+				slog.ErrorContext(ctx, "Failed to deserialize count", errAttr(err))
+				return 0, err
+			}
+			count += partial
+		}
+	}
+	return count, nil
+}
+
+func (r *CosmosDBOrderRepo) GetOrder(ctx context.Context, id string) (Order, error) {
 	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
 	opt := &azcosmos.QueryOptions{
 		QueryParameters: []azcosmos.QueryParameter{
@@ -113,9 +181,9 @@ func (r *CosmosDBOrderRepo) GetOrder(id string) (Order, error) {
 	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.orderId = @orderId", pk, opt)
 
 	for queryPager.More() {
-		queryResponse, err := queryPager.NextPage(context.Background())
+		queryResponse, err := queryPager.NextPage(ctx)
 		if err != nil {
-			log.Printf("failed to get next page: %v\n", err)
+			slog.ErrorContext(ctx, "Failed to get next page", errAttr(err))
 			return Order{}, err
 		}
 
@@ -123,102 +191,643 @@ func (r *CosmosDBOrderRepo) GetOrder(id string) (Order, error) {
 			var order Order
 			err := json.Unmarshal(item, &order)
 			if err != nil {
-				log.Printf("failed to deserialize order: %v\n", err)
+				slog.ErrorContext(ctx, "Failed to deserialize order", errAttr(err))
 				return Order{}, err
 			}
 			return order, nil
 		}
 	}
-	return Order{}, nil
+	return Order{}, ErrOrderNotFound
 }
 
-func (r *CosmosDBOrderRepo) InsertOrders(orders []Order) error {
-	var counter = 0
+func (r *CosmosDBOrderRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	var items []cosmosNewItem
 
 	for _, o := range orders {
-		pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
-
 		marshalledOrder, err := json.Marshal(o)
 		if err != nil {
-			log.Printf("failed to marshal order: %v\n", err)
+			slog.ErrorContext(ctx, "Failed to marshal order", errAttr(err))
 			return err
 		}
 
 		var order map[string]interface{}
 		err = json.Unmarshal(marshalledOrder, &order)
 		if err != nil {
-			log.Printf("failed to unmarshal order: %v\n", err)
+			slog.ErrorContext(ctx, "Failed to unmarshal order", errAttr(err))
 			return err
 		}
 
-		// add id with value of uuid.NewV4() to marhsalled order
-		uuidWithHyphen, err := uuid.NewV4()
-		if err != nil {
-			log.Printf("failed to generate uuid: %v\n", err)
-			return err
+		// add an id to the marshalled order. Orders read from a queue message get
+		// an id derived from the message, so a redelivery conflicts with the
+		// item that was already created instead of adding a second one.
+		var uuidWithHyphen uuid.UUID
+		if o.MessageID != "" {
+			uuidWithHyphen = uuid.NewV5(orderMessageNamespace, o.MessageID)
+		} else {
+			uuidWithHyphen, err = uuid.NewV4()
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to generate uuid", errAttr(err))
+				return err
+			}
 		}
-		uuid := strings.Replace(uuidWithHyphen.String(), "-", "", -1)
-		order["id"] = uuid
+		order["id"] = strings.Replace(uuidWithHyphen.String(), "-", "", -1)
 
 		order[r.partitionKey.Key] = r.partitionKey.Value
+		if !o.CreatedAt.IsZero() {
+			order["createdAt"] = cosmosTimestamp(o.CreatedAt)
+		}
+
+		// the received event is created in the same transactional batch as
+		// the order, so it is only recorded for an order that is actually
+		// inserted
+		var outbox [][]byte
+		if r.outbox {
+			order["outboxSequence"] = 1
+			event, err := r.marshalOutboxItem(newOrderReceivedEvent(o), 1)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to marshal outbox event", errAttr(err))
+				return err
+			}
+			outbox = append(outbox, event)
+		}
 
 		marshalledOrder, err = json.Marshal(order)
 		if err != nil {
-			log.Printf("failed to marshal order: %v\n", err)
+			slog.ErrorContext(ctx, "Failed to marshal order", errAttr(err))
 			return err
 		}
+		items = append(items, cosmosNewItem{messageID: o.MessageID, body: marshalledOrder, outbox: outbox})
+	}
+
+	if len(items) == 0 {
+		slog.DebugContext(ctx, "No orders to insert into database")
+		return nil
+	}
 
-		_, err = r.db.CreateItem(context.Background(), pk, marshalledOrder, nil)
+	// every order is in the same partition, so each chunk is written in one
+	// transactional batch
+	var counter = 0
+	for _, chunk := range chunkNewItems(items) {
+		inserted, err := r.createItems(ctx, chunk)
 		if err != nil {
-			log.Printf("failed to create item: %v\n", err)
+			slog.ErrorContext(ctx, "Failed to create items", errAttr(err))
 			return err
 		}
-
-		// increment counter for each order inserted
-		counter++
+		counter += inserted
 	}
 
-	log.Printf("Inserted %v documents into database\n", counter)
+	slog.InfoContext(ctx, "Inserted orders into database", "count", counter)
+	if skipped := len(items) - counter; skipped > 0 {
+		slog.InfoContext(ctx, "Skipped orders that were already ingested", "count", skipped)
+	}
 
 	return nil
 }
 
-func (r *CosmosDBOrderRepo) UpdateOrder(order Order) error {
-	var existingOrderId string
+// cosmosNewItem is an order item to create, with the queue message it came
+// from and the outbox items created with it
+type cosmosNewItem struct {
+	messageID string
+	body      []byte
+	outbox    [][]byte
+}
+
+// chunkNewItems splits items into chunks that each fit in a transactional
+// batch, keeping every order in the same chunk as its outbox items
+func chunkNewItems(items []cosmosNewItem) [][]cosmosNewItem {
+	var chunks [][]cosmosNewItem
+	var operations int
+	for _, item := range items {
+		n := 1 + len(item.outbox)
+		if len(chunks) == 0 || operations+n > MAX_COSMOS_BATCH_OPERATIONS {
+			chunks = append(chunks, nil)
+			operations = 0
+		}
+		chunks[len(chunks)-1] = append(chunks[len(chunks)-1], item)
+		operations += n
+	}
+	return chunks
+}
+
+// createItems creates items and their outbox items in one transactional
+// batch, so either all of them are stored or none are. A batch fails as a
+// whole if one of its items conflicts with an order that was already
+// ingested, so those items are taken out with their outbox items and the rest
+// of the batch is retried. It returns how many items were created.
+func (r *CosmosDBOrderRepo) createItems(ctx context.Context, items []cosmosNewItem) (int, error) {
 	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
-	opt := &azcosmos.QueryOptions{
-		QueryParameters: []azcosmos.QueryParameter{
+
+	for len(items) > 0 {
+		batch := r.db.NewTransactionalBatch(pk)
+		// owners maps each operation to the item it belongs to
+		var owners []int
+		for i, item := range items {
+			batch.CreateItem(item.body, nil)
+			owners = append(owners, i)
+			for _, event := range item.outbox {
+				batch.CreateItem(event, nil)
+				owners = append(owners, i)
+			}
+		}
+
+		response, err := r.db.ExecuteTransactionalBatch(ctx, batch, nil)
+		if err != nil {
+			return 0, err
+		}
+		if response.Success {
+			return len(items), nil
+		}
+
+		// operations that didn't fail themselves report a failed dependency.
+		// Only the order item of an order that was already ingested
+		// conflicts, as its outbox items are new.
+		conflicted := make(map[int]bool)
+		for op, result := range response.OperationResults {
+			i := owners[op]
+			isOrder := op == 0 || owners[op-1] != i
+			switch {
+			case result.StatusCode == http.StatusFailedDependency:
+			case result.StatusCode == http.StatusConflict && isOrder && items[i].messageID != "":
+				slog.InfoContext(ctx, "Skipped order that was already ingested", LOG_MESSAGE_ID, items[i].messageID)
+				conflicted[i] = true
+			default:
+				return 0, fmt.Errorf("transactional batch failed with status %d", result.StatusCode)
+			}
+		}
+		if len(conflicted) == 0 {
+			return 0, errors.New("transactional batch failed without a failing operation")
+		}
+
+		remaining := items[:0:0]
+		for i, item := range items {
+			if !conflicted[i] {
+				remaining = append(remaining, item)
+			}
+		}
+		items = remaining
+	}
+	return 0, nil
+}
+
+func (r *CosmosDBOrderRepo) UpdateOrder(ctx context.Context, order Order, actor string) error {
+	var existing cosmosOrderItem
+	change := newStatusChange(order.Status, actor)
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+
+	current := func() (Order, error) {
+		items, err := r.queryOrderItems(ctx, "SELECT * FROM o WHERE o.orderId = @orderId", []azcosmos.QueryParameter{
 			{Name: "@orderId", Value: order.OrderID},
-		},
+		})
+		if err != nil {
+			return Order{}, err
+		}
+		if len(items) == 0 {
+			return Order{}, ErrOrderNotFound
+		}
+		existing = items[0]
+		return existing.Order, nil
 	}
-	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.orderId = @orderId", pk, opt)
 
-	for queryPager.More() {
-		queryResponse, err := queryPager.NextPage(context.Background())
+	// The etag makes the patch fail if the item changed since it was read,
+	// including if it was claimed by another worker
+	swap := func(from Order) (bool, error) {
+		// Orders stored before history was tracked have no statusHistory array
+		// to append to, so the whole array is set
+		patch := azcosmos.PatchOperations{}
+		patch.AppendReplace("/status", order.Status)
+		patch.AppendSet("/updatedAt", change.Timestamp)
+		patch.AppendSet("/statusHistory", append(existing.StatusHistory, change))
+		patch.AppendSet("/claimedBy", nil)
+		patch.AppendSet("/leaseExpiresAt", nil)
+
+		patched, err := r.patchIfUnchanged(ctx, pk, existing, patch, newStatusChangeEvents(order.OrderID, from.Status, change))
 		if err != nil {
-			break
+			slog.ErrorContext(ctx, "Failed to replace item", errAttr(err))
 		}
+		return patched, err
+	}
 
-		for _, item := range queryResponse.Items {
-			var order map[string]interface{}
-			err = json.Unmarshal(item, &order)
+	return applyStatusTransition(order.OrderID, order.Status, order.ClaimedBy, current, swap)
+}
+
+func (r *CosmosDBOrderRepo) ClaimOrders(ctx context.Context, workerID string, count int, ttl time.Duration) ([]Order, error) {
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	change := newStatusChange(Processing, workerID)
+	leaseExpiresAt := change.Timestamp.Add(ttl)
+
+	// Each patch is conditioned on the etag read by the query, so if another
+	// worker claims an order first the patch fails and the order is skipped.
+	// The oldest pending orders are read with a few to spare for that, and
+	// read again while orders lost to other workers leave the claim short.
+	var claimed []Order
+	for attempt := 0; attempt < maxTransitionAttempts && len(claimed) < count; attempt++ {
+		limit := count - len(claimed) + COSMOS_CLAIM_OVERFETCH
+		candidates, err := r.queryOrderItems(ctx, "SELECT TOP @count * FROM o WHERE o.status = @status ORDER BY o.createdAt", []azcosmos.QueryParameter{
+			{Name: "@count", Value: limit},
+			{Name: "@status", Value: Pending},
+		})
+		if err != nil {
+			return claimed, err
+		}
+
+		lost := false
+		for _, item := range candidates {
+			if len(claimed) == count {
+				break
+			}
+
+			history := append(item.StatusHistory, change)
+			patch := azcosmos.PatchOperations{}
+			patch.AppendReplace("/status", Processing)
+			patch.AppendSet("/updatedAt", change.Timestamp)
+			patch.AppendSet("/statusHistory", history)
+			patch.AppendSet("/claimedBy", workerID)
+			patch.AppendSet("/leaseExpiresAt", leaseExpiresAt)
+
+			patched, err := r.patchIfUnchanged(ctx, pk, item, patch, newStatusChangeEvents(item.OrderID, Pending, change))
 			if err != nil {
-				log.Printf("failed to deserialize order: %v\n", err)
-				return err
+				slog.ErrorContext(ctx, "Failed to claim order", errAttr(err))
+				return claimed, err
+			}
+			if !patched {
+				lost = true
+				continue
 			}
-			existingOrderId = order["id"].(string)
+
+			order := item.Order
+			order.Status = Processing
+			order.UpdatedAt = change.Timestamp
+			order.StatusHistory = history
+			order.ClaimedBy = workerID
+			order.LeaseExpiresAt = leaseExpiresAt
+			claimed = append(claimed, order)
+		}
+
+		// fewer candidates than asked for means nothing else is pending
+		if !lost || len(candidates) < limit {
 			break
 		}
 	}
 
-	patch := azcosmos.PatchOperations{}
-	patch.AppendReplace("/status", order.Status)
+	slog.InfoContext(ctx, "Claimed orders", "count", len(claimed), "workerId", workerID)
+	return claimed, nil
+}
+
+func (r *CosmosDBOrderRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	change := newStatusChange(Pending, LEASE_EXPIRED_ACTOR)
+
+	// Lease expiry is compared here rather than in the query, since timestamps
+	// are stored as strings that don't sort reliably
+	candidates, err := r.queryOrderItems(ctx, "SELECT * FROM o WHERE o.status = @status AND IS_DEFINED(o.leaseExpiresAt)", []azcosmos.QueryParameter{
+		{Name: "@status", Value: Processing},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var released int
+	for _, item := range candidates {
+		if !leaseExpired(item.Order, change.Timestamp) {
+			continue
+		}
+
+		patch := azcosmos.PatchOperations{}
+		patch.AppendReplace("/status", Pending)
+		patch.AppendSet("/updatedAt", change.Timestamp)
+		patch.AppendSet("/statusHistory", append(item.StatusHistory, change))
+		patch.AppendSet("/claimedBy", nil)
+		patch.AppendSet("/leaseExpiresAt", nil)
+
+		// a failed precondition means the worker finished the order after all
+		patched, err := r.patchIfUnchanged(ctx, pk, item, patch, newStatusChangeEvents(item.OrderID, Processing, change))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to release order", errAttr(err))
+			return released, err
+		}
+		if patched {
+			released++
+		}
+	}
+
+	return released, nil
+}
+
+func (r *CosmosDBOrderRepo) ListOrders(ctx context.Context, query OrderQuery) (OrderPage, error) {
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+
+	// outbox items share the partition with the orders
+	conditions := []string{"IS_DEFINED(o.orderId)"}
+	var params []azcosmos.QueryParameter
+	if len(query.Statuses) > 0 {
+		conditions = append(conditions, "ARRAY_CONTAINS(@statuses, o.status)")
+		params = append(params, azcosmos.QueryParameter{Name: "@statuses", Value: query.Statuses})
+	}
+	if query.CustomerID != "" {
+		conditions = append(conditions, "o.customerId = @customerId")
+		params = append(params, azcosmos.QueryParameter{Name: "@customerId", Value: query.CustomerID})
+	}
+	if query.ProductID != 0 {
+		conditions = append(conditions, "EXISTS(SELECT VALUE i FROM i IN o.items WHERE i.productId = @productId)")
+		params = append(params, azcosmos.QueryParameter{Name: "@productId", Value: query.ProductID})
+	}
+	// createdAt is stored with cosmosTimestampLayout, so it compares in time
+	// order as a string. Orders stored before createdAt was tracked have none,
+	// so a range leaves them out and ORDER BY puts them first.
+	if !query.CreatedFrom.IsZero() {
+		conditions = append(conditions, "o.createdAt >= @createdFrom")
+		params = append(params, azcosmos.QueryParameter{Name: "@createdFrom", Value: cosmosTimestamp(query.CreatedFrom)})
+	}
+	if !query.CreatedTo.IsZero() {
+		conditions = append(conditions, "o.createdAt < @createdTo")
+		params = append(params, azcosmos.QueryParameter{Name: "@createdTo", Value: cosmosTimestamp(query.CreatedTo)})
+	}
+
+	sql := "SELECT * FROM o WHERE " + strings.Join(conditions, " AND ")
+	if query.Descending {
+		sql += " ORDER BY o.createdAt DESC"
+	} else {
+		sql += " ORDER BY o.createdAt ASC"
+	}
+
+	// Cosmos DB pages the query itself; its continuation token is the cursor
+	opt := &azcosmos.QueryOptions{
+		QueryParameters: params,
+		PageSizeHint:    int32(query.PageSize()),
+	}
+	if query.Cursor != "" {
+		token, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return OrderPage{}, err
+		}
+		opt.ContinuationToken = &token
+	}
+
+	queryResponse, err := r.db.NewQueryItemsPager(sql, pk, opt).NextPage(ctx)
+	var responseErr *azcore.ResponseError
+	if query.Cursor != "" && errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusBadRequest {
+		return OrderPage{}, ErrInvalidCursor
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get next page", errAttr(err))
+		return OrderPage{}, err
+	}
+
+	page := OrderPage{Orders: []Order{}}
+	for _, item := range queryResponse.Items {
+		var order Order
+		if err := json.Unmarshal(item, &order); err != nil {
+			slog.ErrorContext(ctx, "Failed to deserialize order", errAttr(err))
+			return OrderPage{}, err
+		}
+		page.Orders = append(page.Orders, order)
+	}
+	if queryResponse.ContinuationToken != nil {
+		page.NextCursor = encodeCursor(*queryResponse.ContinuationToken)
+	}
+
+	return page, nil
+}
 
-	_, err := r.db.PatchItem(context.Background(), pk, existingOrderId, patch, nil)
+func (r *CosmosDBOrderRepo) EnableOutbox() {
+	r.outbox = true
+}
+
+// ClaimOutboxEvents claims the outbox items of the orders with the oldest
+// events first. The events of an order are claimed in sequence, stopping at
+// the first one another relay holds, so they are published in order by one
+// relay at a time. Events the relay already claimed are claimed again, which
+// renews the claim. Claims are patched onto the outbox items only, so the
+// relay never rewrites an order.
+func (r *CosmosDBOrderRepo) ClaimOutboxEvents(ctx context.Context, relayID string, limit int) ([]OutboxEvent, error) {
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	now := time.Now().UTC()
+
+	// The claim expiry is stored in Unix seconds, like _ts, so it compares
+	// correctly in the query
+	heads, err := queryCosmosItems[cosmosOutboxItem](ctx, r, `SELECT TOP @limit o.outboxOrder FROM o
+		WHERE IS_DEFINED(o.outboxEvent)
+		AND (NOT IS_OBJECT(o.outboxClaim) OR o.outboxClaim.relayId = @relayId OR o.outboxClaim.expiresAt < @now)
+		ORDER BY o._ts ASC`, []azcosmos.QueryParameter{
+		{Name: "@limit", Value: limit},
+		{Name: "@relayId", Value: relayID},
+		{Name: "@now", Value: now.Unix()},
+	})
 	if err != nil {
-		log.Printf("failed to replace item: %v\n", err)
-		return err
+		return nil, err
+	}
+	var orderIDs []string
+	for _, head := range heads {
+		if !slices.Contains(orderIDs, head.OrderID) {
+			orderIDs = append(orderIDs, head.OrderID)
+		}
+	}
+	if len(orderIDs) == 0 {
+		return nil, nil
 	}
 
+	// every event of those orders is read, claimed or not, to find where the
+	// events the relay may publish start
+	items, err := queryCosmosItems[cosmosOutboxItem](ctx, r, "SELECT * FROM o WHERE IS_DEFINED(o.outboxEvent) AND ARRAY_CONTAINS(@orderIds, o.outboxOrder)", []azcosmos.QueryParameter{
+		{Name: "@orderIds", Value: orderIDs},
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(items, func(a, b cosmosOutboxItem) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(orderIDs, a.OrderID), slices.Index(orderIDs, b.OrderID)),
+			cmp.Compare(a.Sequence, b.Sequence),
+		)
+	})
+
+	claim := cosmosOutboxClaim{RelayID: relayID, ExpiresAt: now.Add(OUTBOX_CLAIM_TTL).Unix()}
+	held := make(map[string]bool)
+	var events []OutboxEvent
+	for _, item := range items {
+		if len(events) == limit {
+			break
+		}
+		if held[item.OrderID] {
+			continue
+		}
+		if item.Claim != nil && item.Claim.RelayID != relayID && item.Claim.ExpiresAt >= now.Unix() {
+			held[item.OrderID] = true
+			continue
+		}
+
+		patch := azcosmos.PatchOperations{}
+		patch.AppendSet("/outboxClaim", claim)
+		// a failed precondition means another relay claimed the event first
+		claimed, err := r.patchItemIfMatch(ctx, pk, item.ID, item.Etag, patch)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to claim outbox events", errAttr(err))
+			return nil, err
+		}
+		if !claimed {
+			held[item.OrderID] = true
+			continue
+		}
+		events = append(events, item.Event)
+	}
+	return events, nil
+}
+
+// DeleteOutboxEvents deletes the outbox items of the events. An item that is
+// already gone was deleted by an earlier pass that failed part way.
+func (r *CosmosDBOrderRepo) DeleteOutboxEvents(ctx context.Context, ids []string) error {
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+
+	for _, id := range ids {
+		_, err := r.db.DeleteItem(ctx, pk, id, nil)
+		var responseErr *azcore.ResponseError
+		if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to delete outbox events", errAttr(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalOutboxItem makes the outbox item of an event in the repo's
+// partition. sequence numbers the events of an order in the order they
+// happened.
+func (r *CosmosDBOrderRepo) marshalOutboxItem(event OutboxEvent, sequence int) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"id":               event.ID,
+		r.partitionKey.Key: r.partitionKey.Value,
+		"outboxEvent":      event,
+		"outboxOrder":      event.OrderID,
+		"outboxSequence":   sequence,
+	})
+}
+
+// Ping reads the container's properties, as Cosmos DB has no ping operation
+func (r *CosmosDBOrderRepo) Ping(ctx context.Context) error {
+	_, err := r.db.Read(ctx, nil)
+	return err
+}
+
+// Close does nothing, as the Cosmos DB client holds no connections that need
+// to be closed
+func (r *CosmosDBOrderRepo) Close(ctx context.Context) error {
 	return nil
 }
+
+// cosmosOrderItem is an order as stored in Cosmos DB, together with the item
+// metadata needed for conditional patches
+type cosmosOrderItem struct {
+	Order
+	ID   string      `json:"id"`
+	Etag azcore.ETag `json:"_etag"`
+	// OutboxSequence counts the lifecycle events written for the order, so
+	// its outbox items are numbered in the order they happened
+	OutboxSequence int `json:"outboxSequence,omitempty"`
+}
+
+// cosmosOutboxItem is a lifecycle event waiting to be published. It is an
+// item of its own next to its order, so claiming and deleting it never
+// touches the order.
+type cosmosOutboxItem struct {
+	ID       string             `json:"id"`
+	Etag     azcore.ETag        `json:"_etag"`
+	Event    OutboxEvent        `json:"outboxEvent"`
+	OrderID  string             `json:"outboxOrder"`
+	Sequence int                `json:"outboxSequence"`
+	Claim    *cosmosOutboxClaim `json:"outboxClaim,omitempty"`
+}
+
+// cosmosOutboxClaim records which relay publishes an outbox item, until
+// ExpiresAt in Unix seconds
+type cosmosOutboxClaim struct {
+	RelayID   string `json:"relayId"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// queryOrderItems runs a query over the repo's partition and decodes every result
+func (r *CosmosDBOrderRepo) queryOrderItems(ctx context.Context, query string, params []azcosmos.QueryParameter) ([]cosmosOrderItem, error) {
+	return queryCosmosItems[cosmosOrderItem](ctx, r, query, params)
+}
+
+// queryCosmosItems runs a query over the repo's partition and decodes every
+// result as a T
+func queryCosmosItems[T any](ctx context.Context, r *CosmosDBOrderRepo, query string, params []azcosmos.QueryParameter) ([]T, error) {
+	var items []T
+
+	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	queryPager := r.db.NewQueryItemsPager(query, pk, &azcosmos.QueryOptions{QueryParameters: params})
+
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get next page", errAttr(err))
+			return nil, err
+		}
+
+		for _, raw := range queryResponse.Items {
+			var item T
+			if err := json.Unmarshal(raw, &item); err != nil {
+				slog.ErrorContext(ctx, "Failed to deserialize item", errAttr(err))
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// patchIfUnchanged applies patch only if the item still has the etag it was
+// read with. If the outbox is enabled, the events are created as outbox items
+// in the same transactional batch. It reports false without an error if the
+// item changed since.
+func (r *CosmosDBOrderRepo) patchIfUnchanged(ctx context.Context, pk azcosmos.PartitionKey, item cosmosOrderItem, patch azcosmos.PatchOperations, events []OutboxEvent) (bool, error) {
+	if !r.outbox || len(events) == 0 {
+		return r.patchItemIfMatch(ctx, pk, item.ID, item.Etag, patch)
+	}
+
+	batch := r.db.NewTransactionalBatch(pk)
+	patch.AppendSet("/outboxSequence", item.OutboxSequence+len(events))
+	batch.PatchItem(item.ID, patch, &azcosmos.TransactionalBatchItemOptions{IfMatchETag: &item.Etag})
+	for i, event := range events {
+		body, err := r.marshalOutboxItem(event, item.OutboxSequence+i+1)
+		if err != nil {
+			return false, err
+		}
+		batch.CreateItem(body, nil)
+	}
+
+	response, err := r.db.ExecuteTransactionalBatch(ctx, batch, nil)
+	if err != nil {
+		return false, err
+	}
+	if response.Success {
+		return true, nil
+	}
+	for _, result := range response.OperationResults {
+		switch result.StatusCode {
+		case http.StatusFailedDependency:
+		case http.StatusPreconditionFailed:
+			return false, nil
+		default:
+			return false, fmt.Errorf("transactional batch failed with status %d", result.StatusCode)
+		}
+	}
+	return false, errors.New("transactional batch failed without a failing operation")
+}
+
+// patchItemIfMatch applies patch to the item with the given id only if it
+// still has etag. It reports false without an error if the item changed since.
+func (r *CosmosDBOrderRepo) patchItemIfMatch(ctx context.Context, pk azcosmos.PartitionKey, id string, etag azcore.ETag, patch azcosmos.PatchOperations) (bool, error) {
+	_, err := r.db.PatchItem(ctx, pk, id, patch, &azcosmos.ItemOptions{IfMatchEtag: &etag})
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusPreconditionFailed {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
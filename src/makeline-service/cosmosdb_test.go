@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestChunkNewItems(t *testing.T) {
+	// newItems makes n orders, each with the given number of outbox items
+	newItems := func(n, outbox int) []cosmosNewItem {
+		items := make([]cosmosNewItem, n)
+		for i := range items {
+			items[i] = cosmosNewItem{messageID: fmt.Sprint(i), outbox: make([][]byte, outbox)}
+		}
+		return items
+	}
+
+	tests := []struct {
+		name  string
+		items []cosmosNewItem
+		want  []int
+	}{
+		{name: "none", items: nil, want: nil},
+		{name: "one batch", items: newItems(MAX_COSMOS_BATCH_OPERATIONS, 0), want: []int{MAX_COSMOS_BATCH_OPERATIONS}},
+		{name: "more than a batch", items: newItems(MAX_COSMOS_BATCH_OPERATIONS+1, 0), want: []int{MAX_COSMOS_BATCH_OPERATIONS, 1}},
+		{name: "orders with their outbox items", items: newItems(MAX_COSMOS_BATCH_OPERATIONS/2, 1), want: []int{MAX_COSMOS_BATCH_OPERATIONS / 2}},
+		{name: "order and outbox items that would be split", items: newItems(MAX_COSMOS_BATCH_OPERATIONS/3+1, 2), want: []int{MAX_COSMOS_BATCH_OPERATIONS / 3, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			var items []cosmosNewItem
+			for _, chunk := range chunkNewItems(tt.items) {
+				operations := 0
+				for _, item := range chunk {
+					operations += 1 + len(item.outbox)
+				}
+				if operations > MAX_COSMOS_BATCH_OPERATIONS {
+					t.Errorf("got a chunk of %d operations, want at most %d", operations, MAX_COSMOS_BATCH_OPERATIONS)
+				}
+				got = append(got, len(chunk))
+				items = append(items, chunk...)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got chunks of %v orders, want %v", got, tt.want)
+			}
+			if len(items) != len(tt.items) {
+				t.Errorf("got %d orders in the chunks, want %d", len(items), len(tt.items))
+			}
+		})
+	}
+}
+
+func TestCosmosTimestamp(t *testing.T) {
+	// in time order, with fractions that RFC 3339 would trim to different widths
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		base,
+		base.Add(100 * time.Millisecond),
+		base.Add(120 * time.Millisecond),
+		base.Add(123456789),
+		base.Add(time.Second),
+		base.Add(time.Second + time.Nanosecond),
+		// a zone other than UTC is stored in UTC
+		time.Date(2024, 5, 1, 14, 0, 2, 0, time.FixedZone("CEST", 2*60*60)),
+	}
+
+	stored := make([]string, len(times))
+	for i, ts := range times {
+		stored[i] = cosmosTimestamp(ts)
+		if len(stored[i]) != len(cosmosTimestampLayout) {
+			t.Errorf("got %q for %v, want %d characters", stored[i], ts, len(cosmosTimestampLayout))
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, stored[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Equal(ts) {
+			t.Errorf("got %v back from %q, want %v", parsed, stored[i], ts)
+		}
+	}
+	if !slices.IsSorted(stored) {
+		t.Errorf("got %v, want the timestamps to sort in time order", stored)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DEFAULT_DEAD_LETTER_LIST_LIMIT is how many dead-lettered messages are
+	// listed unless limit is set
+	DEFAULT_DEAD_LETTER_LIST_LIMIT = 20
+	// MAX_DEAD_LETTER_SCAN is how many dead-lettered messages are listed or
+	// searched for the ones to replay or purge at most
+	MAX_DEAD_LETTER_SCAN = 100
+	// DEAD_LETTER_RECEIVE_TIMEOUT is how long to wait for more dead-lettered
+	// messages before deciding the queue has no more
+	DEAD_LETTER_RECEIVE_TIMEOUT = 2 * time.Second
+)
+
+// Outcomes of replaying or purging a dead-lettered message
+const (
+	DEAD_LETTER_REPLAYED  = "replayed"
+	DEAD_LETTER_PURGED    = "purged"
+	DEAD_LETTER_FAILED    = "failed"
+	DEAD_LETTER_NOT_FOUND = "notFound"
+)
+
+// errDeadLettersUnsupported is returned for transports whose dead letters
+// can't be managed by the service
+var errDeadLettersUnsupported = errors.New("dead letters of the order queue transport can't be managed by the service")
+
+// DeadLetterQueue is the dead-letter queue of the order queue
+type DeadLetterQueue interface {
+	// Name is the dead-letter queue's name
+	Name() string
+	Open(ctx context.Context) error
+	Close(ctx context.Context) error
+	// Peek returns up to max messages, leaving them in the queue
+	Peek(ctx context.Context, max int) ([]*DeadLetteredMessage, error)
+	// Receive locks up to max messages until they are removed or released.
+	// It returns fewer if no more arrive within DEAD_LETTER_RECEIVE_TIMEOUT.
+	Receive(ctx context.Context, max int) ([]*DeadLetteredMessage, error)
+	// Remove deletes a received message from the queue
+	Remove(ctx context.Context, msg *DeadLetteredMessage) error
+	// Release unlocks a received message, leaving it in the queue
+	Release(ctx context.Context, msg *DeadLetteredMessage) error
+}
+
+// DeadLetteredMessage is a message in the dead-letter queue
+type DeadLetteredMessage struct {
+	// ID identifies the message in the dead-letter queue, for replaying or
+	// purging it
+	ID            string    `json:"id"`
+	Reason        string    `json:"reason,omitempty"`
+	Description   string    `json:"description,omitempty"`
+	DeliveryCount int       `json:"deliveryCount"`
+	EnqueuedAt    time.Time `json:"enqueuedAt,omitzero"`
+	// Body is the payload as text, as it may not be valid JSON
+	Body string `json:"body"`
+	// key deduplicates the order when it is replayed, like the idempotency
+	// key of the original message
+	key string
+	// contentType and properties are those of the original message, for
+	// reading a CloudEvent when it is replayed
+	contentType string
+	properties  map[string]any
+	raw         any
+}
+
+// ReplayRequest selects the dead-lettered messages to replay. A message can
+// be given a new body to replay instead of its own.
+type ReplayRequest struct {
+	Messages []struct {
+		ID   string          `json:"id"`
+		Body json.RawMessage `json:"body,omitempty"`
+	} `json:"messages"`
+}
+
+// PurgeRequest selects the dead-lettered messages to purge
+type PurgeRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// DeadLetterResult is the outcome of replaying or purging one message
+type DeadLetterResult struct {
+	ID      string `json:"id"`
+	Outcome string `json:"outcome"`
+	OrderID string `json:"orderId,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// newDeadLetterQueue returns the dead-letter queue of the order queue, picked
+// the same way as the order source, or nil if it can't be managed. The Kafka
+// dead-letter topic isn't, as records can't be removed from a topic one by
+// one.
+func newDeadLetterQueue(queueName string) DeadLetterQueue {
+	if os.Getenv("ORDER_QUEUE_TRANSPORT") == KAFKA_TRANSPORT {
+		return nil
+	}
+	if connection, ok := serviceBusConnectionFromEnv(); ok {
+		return NewServiceBusDeadLetterQueue(connection, queueName)
+	}
+	return NewAMQPDeadLetterQueue(deadLetterQueueName(queueName))
+}
+
+// DeadLetterAdmin serves the admin endpoints for the dead-letter queue. Each
+// request connects to the queue for its own duration. Every action is
+// recorded in the audit log.
+type DeadLetterAdmin struct {
+	queue DeadLetterQueue
+	ids   OrderIDGenerator
+}
+
+func NewDeadLetterAdmin(queue DeadLetterQueue, ids OrderIDGenerator) *DeadLetterAdmin {
+	return &DeadLetterAdmin{queue: queue, ids: ids}
+}
+
+// Lists dead-lettered messages, with the reason they were dead-lettered
+func (a *DeadLetterAdmin) listDeadLetters(c *gin.Context) {
+	limit := DEFAULT_DEAD_LETTER_LIST_LIMIT
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > MAX_DEAD_LETTER_SCAN {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MAX_DEAD_LETTER_SCAN)})
+			return
+		}
+		limit = n
+	}
+
+	ctx, ok := a.open(c)
+	if !ok {
+		return
+	}
+	defer a.close(ctx)
+
+	messages, err := a.queue.Peek(ctx, limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list dead-lettered messages", errAttr(err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	audit(ctx, "list", adminActor(c), "count", len(messages))
+	if messages == nil {
+		messages = []*DeadLetteredMessage{}
+	}
+	c.IndentedJSON(http.StatusOK, messages)
+}
+
+// Replays dead-lettered messages through the same pipeline as the consumer.
+// A message is removed from the dead-letter queue once its order is stored,
+// and left there if it fails again.
+func (a *DeadLetterAdmin) replayDeadLetters(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		slog.ErrorContext(c.Request.Context(), "Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var req ReplayRequest
+	if err := c.BindJSON(&req); err != nil {
+		slog.WarnContext(c.Request.Context(), "Failed to unmarshal replay request", errAttr(err))
+		return
+	}
+	bodies := make(map[string][]byte, len(req.Messages))
+	for _, msg := range req.Messages {
+		bodies[msg.ID] = msg.Body
+	}
+	_, missingID := bodies[""]
+	if !validSelection(c, len(bodies), missingID) {
+		return
+	}
+
+	ctx, ok := a.open(c)
+	if !ok {
+		return
+	}
+	defer a.close(ctx)
+
+	actor := adminActor(c)
+	selected := func(id string) bool {
+		_, ok := bodies[id]
+		return ok
+	}
+	results := a.settle(ctx, selected, func(ctx context.Context, msg *DeadLetteredMessage) DeadLetterResult {
+		body, edited := []byte(msg.Body), len(bodies[msg.ID]) > 0
+		if edited {
+			body = bodies[msg.ID]
+		}
+		result := a.replay(ctx, client, msg, body)
+		audit(ctx, "replay", actor,
+			LOG_MESSAGE_ID, msg.ID,
+			"reason", msg.Reason,
+			"edited", edited,
+			"outcome", result.Outcome,
+			LOG_ORDER_ID, result.OrderID,
+		)
+		return result
+	})
+	for id := range bodies {
+		if _, found := results[id]; !found {
+			audit(ctx, "replay", actor, LOG_MESSAGE_ID, id, "outcome", DEAD_LETTER_NOT_FOUND)
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"results": orderedResults(req.messageIDs(), results)})
+}
+
+// replay stores the order in body and removes msg from the dead-letter queue
+func (a *DeadLetterAdmin) replay(ctx context.Context, client *OrderService, msg *DeadLetteredMessage, body []byte) DeadLetterResult {
+	result := DeadLetterResult{ID: msg.ID, Outcome: DEAD_LETTER_FAILED}
+
+	// an edited body may be an order or a CloudEvent, and is told apart by
+	// its JSON rather than the content type of the original message
+	message := &QueueMessage{ID: msg.key, Body: body, Properties: msg.properties}
+	if string(body) == msg.Body {
+		message.ContentType = msg.contentType
+	}
+	var order Order
+	_, err := unwrapCloudEvent(message)
+	if err == nil {
+		order, err = unmarshalOrderFromQueue(message.Body, a.ids)
+	}
+	if err != nil {
+		result.Error = err.Error()
+		a.release(ctx, msg)
+		return result
+	}
+	order.MessageID = message.ID
+	result.OrderID = order.OrderID
+
+	if err := client.repo.InsertOrders(ctx, []Order{order}); err != nil {
+		slog.ErrorContext(ctx, "Failed to persist replayed order", LOG_ORDER_ID, order.OrderID, errAttr(err))
+		result.Error = err.Error()
+		a.release(ctx, msg)
+		return result
+	}
+
+	if err := a.queue.Remove(ctx, msg); err != nil {
+		// the order is stored, and is skipped as a duplicate if replayed again
+		slog.ErrorContext(ctx, "Failed to remove replayed message", LOG_MESSAGE_ID, msg.ID, errAttr(err))
+		result.Error = err.Error()
+		return result
+	}
+	publishOrderEvent(ctx, client.repo, client.events, ORDER_CREATED_EVENT, order.OrderID)
+
+	result.Outcome = DEAD_LETTER_REPLAYED
+	return result
+}
+
+// Purges dead-lettered messages, dropping their orders
+func (a *DeadLetterAdmin) purgeDeadLetters(c *gin.Context) {
+	var req PurgeRequest
+	if err := c.BindJSON(&req); err != nil {
+		slog.WarnContext(c.Request.Context(), "Failed to unmarshal purge request", errAttr(err))
+		return
+	}
+	selected := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		selected[id] = true
+	}
+	if !validSelection(c, len(selected), selected[""]) {
+		return
+	}
+
+	ctx, ok := a.open(c)
+	if !ok {
+		return
+	}
+	defer a.close(ctx)
+
+	actor := adminActor(c)
+	results := a.settle(ctx, func(id string) bool { return selected[id] }, func(ctx context.Context, msg *DeadLetteredMessage) DeadLetterResult {
+		result := DeadLetterResult{ID: msg.ID, Outcome: DEAD_LETTER_PURGED}
+		if err := a.queue.Remove(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "Failed to purge dead-lettered message", LOG_MESSAGE_ID, msg.ID, errAttr(err))
+			result = DeadLetterResult{ID: msg.ID, Outcome: DEAD_LETTER_FAILED, Error: err.Error()}
+		}
+		audit(ctx, "purge", actor,
+			LOG_MESSAGE_ID, msg.ID,
+			"reason", msg.Reason,
+			"outcome", result.Outcome,
+		)
+		return result
+	})
+	for id := range selected {
+		if _, found := results[id]; !found {
+			audit(ctx, "purge", actor, LOG_MESSAGE_ID, id, "outcome", DEAD_LETTER_NOT_FOUND)
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"results": orderedResults(req.IDs, results)})
+}
+
+// open connects to the dead-letter queue for the request. It responds and
+// returns false if it can't.
+func (a *DeadLetterAdmin) open(c *gin.Context) (context.Context, bool) {
+	if a.queue == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{"error": errDeadLettersUnsupported.Error()})
+		return nil, false
+	}
+
+	ctx := withLogAttrs(c.Request.Context(), slog.String("queue", a.queue.Name()))
+	if err := a.queue.Open(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to connect to dead-letter queue", errAttr(err))
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "failed to connect to the dead-letter queue"})
+		return nil, false
+	}
+	return ctx, true
+}
+
+func (a *DeadLetterAdmin) close(ctx context.Context) {
+	if err := a.queue.Close(context.WithoutCancel(ctx)); err != nil {
+		slog.WarnContext(ctx, "Failed to close dead-letter queue", errAttr(err))
+	}
+}
+
+// settle receives up to MAX_DEAD_LETTER_SCAN messages, handles the selected
+// ones and releases the rest. Messages are held until the end, so a released
+// message isn't received again in the same scan.
+func (a *DeadLetterAdmin) settle(ctx context.Context, selected func(id string) bool, handle func(ctx context.Context, msg *DeadLetteredMessage) DeadLetterResult) map[string]DeadLetterResult {
+	results := make(map[string]DeadLetterResult)
+	var held []*DeadLetteredMessage
+	defer func() {
+		for _, msg := range held {
+			a.release(ctx, msg)
+		}
+	}()
+
+	for received := 0; received < MAX_DEAD_LETTER_SCAN; {
+		messages, err := a.queue.Receive(ctx, MAX_DEAD_LETTER_SCAN-received)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to receive dead-lettered messages", errAttr(err))
+			return results
+		}
+		if len(messages) == 0 {
+			return results
+		}
+		received += len(messages)
+
+		for _, msg := range messages {
+			if _, done := results[msg.ID]; done || !selected(msg.ID) {
+				held = append(held, msg)
+				continue
+			}
+			results[msg.ID] = handle(context.WithoutCancel(ctx), msg)
+		}
+	}
+	return results
+}
+
+func (a *DeadLetterAdmin) release(ctx context.Context, msg *DeadLetteredMessage) {
+	if err := a.queue.Release(context.WithoutCancel(ctx), msg); err != nil {
+		slog.WarnContext(ctx, "Failed to release dead-lettered message", LOG_MESSAGE_ID, msg.ID, errAttr(err))
+	}
+}
+
+// validSelection checks that a replay or purge request selects between one
+// and MAX_DEAD_LETTER_SCAN messages by ID. It responds and returns false if
+// not.
+func validSelection(c *gin.Context, count int, missingID bool) bool {
+	if missingID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "every message needs an id"})
+		return false
+	}
+	if count == 0 || count > MAX_DEAD_LETTER_SCAN {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("select between 1 and %d messages", MAX_DEAD_LETTER_SCAN)})
+		return false
+	}
+	return true
+}
+
+func (r ReplayRequest) messageIDs() []string {
+	ids := make([]string, 0, len(r.Messages))
+	for _, msg := range r.Messages {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+// orderedResults lists the results in the order the messages were selected,
+// with messages that weren't found in the first MAX_DEAD_LETTER_SCAN
+func orderedResults(ids []string, results map[string]DeadLetterResult) []DeadLetterResult {
+	ordered := make([]DeadLetterResult, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		result, found := results[id]
+		if !found {
+			result = DeadLetterResult{ID: id, Outcome: DEAD_LETTER_NOT_FOUND}
+		}
+		ordered = append(ordered, result)
+	}
+	return ordered
+}
+
+// audit records an admin action in the audit log, which is the service log
+// filtered on the audit attribute. Audit records are written whatever
+// LOG_LEVEL is.
+func audit(ctx context.Context, action string, actor string, args ...any) {
+	args = append([]any{LOG_AUDIT, true, "action", action, "actor", actor}, args...)
+	auditLogger.InfoContext(ctx, "Dead-letter queue "+action, args...)
+}
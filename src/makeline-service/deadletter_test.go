@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeDeadLetterQueue is a DeadLetterQueue held in memory
+type fakeDeadLetterQueue struct {
+	mu       sync.Mutex
+	messages []*DeadLetteredMessage
+	locked   map[string]bool
+	// openErr is returned by Open, if set
+	openErr error
+	// removeErr is returned by Remove, if set
+	removeErr error
+}
+
+func newFakeDeadLetterQueue(messages ...*DeadLetteredMessage) *fakeDeadLetterQueue {
+	return &fakeDeadLetterQueue{messages: messages, locked: make(map[string]bool)}
+}
+
+func (q *fakeDeadLetterQueue) Name() string                    { return "orders.dlq" }
+func (q *fakeDeadLetterQueue) Open(ctx context.Context) error  { return q.openErr }
+func (q *fakeDeadLetterQueue) Close(ctx context.Context) error { return nil }
+
+func (q *fakeDeadLetterQueue) Peek(ctx context.Context, max int) ([]*DeadLetteredMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Clone(q.messages[:min(max, len(q.messages))]), nil
+}
+
+func (q *fakeDeadLetterQueue) Receive(ctx context.Context, max int) ([]*DeadLetteredMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var received []*DeadLetteredMessage
+	for _, msg := range q.messages {
+		if len(received) == max {
+			break
+		}
+		if !q.locked[msg.ID] {
+			q.locked[msg.ID] = true
+			received = append(received, msg)
+		}
+	}
+	return received, nil
+}
+
+func (q *fakeDeadLetterQueue) Remove(ctx context.Context, msg *DeadLetteredMessage) error {
+	if q.removeErr != nil {
+		return q.removeErr
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.locked[msg.ID] {
+		return errors.New("message isn't locked")
+	}
+	delete(q.locked, msg.ID)
+	q.messages = slices.DeleteFunc(q.messages, func(m *DeadLetteredMessage) bool { return m.ID == msg.ID })
+	return nil
+}
+
+func (q *fakeDeadLetterQueue) Release(ctx context.Context, msg *DeadLetteredMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.locked[msg.ID] {
+		return errors.New("message isn't locked")
+	}
+	delete(q.locked, msg.ID)
+	return nil
+}
+
+// ids returns the IDs of the messages left in the queue
+func (q *fakeDeadLetterQueue) ids() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ids []string
+	for _, msg := range q.messages {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+// testDeadLetters are a valid order that failed to be stored, and a message
+// that isn't an order
+func testDeadLetters() []*DeadLetteredMessage {
+	return []*DeadLetteredMessage{
+		{ID: "d1", Reason: DEAD_LETTER_MAX_DELIVERIES, DeliveryCount: DEFAULT_MAX_DELIVERIES, Body: string(testOrderJSON("1")), key: "m1"},
+		{ID: "d2", Reason: DEAD_LETTER_INVALID_ORDER, DeliveryCount: 1, Body: "not an order", key: "m2"},
+	}
+}
+
+// newDeadLetterRouter serves the dead-letter admin endpoints for queue, with
+// orders stored in repo
+func newDeadLetterRouter(repo OrderRepo, queue DeadLetterQueue) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	admin := NewDeadLetterAdmin(queue, NewULIDGenerator())
+	router := gin.New()
+	router.Use(OrderMiddleware(NewOrderService(repo)))
+	router.GET("/admin/deadletters", admin.listDeadLetters)
+	router.POST("/admin/deadletters/replay", admin.replayDeadLetters)
+	router.POST("/admin/deadletters/purge", admin.purgeDeadLetters)
+	return router
+}
+
+func TestListDeadLetters(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		want       []string
+	}{
+		{name: "all", path: "/admin/deadletters", wantStatus: http.StatusOK, want: []string{"d1", "d2"}},
+		{name: "limit", path: "/admin/deadletters?limit=1", wantStatus: http.StatusOK, want: []string{"d1"}},
+		{name: "limit zero", path: "/admin/deadletters?limit=0", wantStatus: http.StatusBadRequest},
+		{name: "limit too large", path: fmt.Sprintf("/admin/deadletters?limit=%d", MAX_DEAD_LETTER_SCAN+1), wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := newFakeDeadLetterQueue(testDeadLetters()...)
+
+			w := serve(newDeadLetterRouter(NewInMemoryOrderRepo(), queue), http.MethodGet, tt.path, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var messages []DeadLetteredMessage
+			decodeResponse(t, w, &messages)
+			var got []string
+			for _, msg := range messages {
+				got = append(got, msg.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got messages %v, want %v", got, tt.want)
+			}
+			if messages[0].Reason != DEAD_LETTER_MAX_DELIVERIES || messages[0].Body != string(testOrderJSON("1")) {
+				t.Errorf("got message %+v, want its reason and body", messages[0])
+			}
+			// listing leaves the messages in the queue
+			if got := queue.ids(); len(got) != 2 {
+				t.Errorf("queue holds %v after listing, want both messages", got)
+			}
+		})
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		want        []DeadLetterResult
+		wantOrders  int
+		wantInQueue []string
+	}{
+		{
+			name:        "order",
+			body:        `{"messages":[{"id":"d1"}]}`,
+			wantStatus:  http.StatusOK,
+			want:        []DeadLetterResult{{ID: "d1", Outcome: DEAD_LETTER_REPLAYED}},
+			wantOrders:  1,
+			wantInQueue: []string{"d2"},
+		},
+		{
+			name:        "message that isn't an order",
+			body:        `{"messages":[{"id":"d2"}]}`,
+			wantStatus:  http.StatusOK,
+			want:        []DeadLetterResult{{ID: "d2", Outcome: DEAD_LETTER_FAILED}},
+			wantInQueue: []string{"d1", "d2"},
+		},
+		{
+			name:        "message with a fixed body",
+			body:        `{"messages":[{"id":"d2","body":{"customerId":"2","items":[]}}]}`,
+			wantStatus:  http.StatusOK,
+			want:        []DeadLetterResult{{ID: "d2", Outcome: DEAD_LETTER_REPLAYED}},
+			wantOrders:  1,
+			wantInQueue: []string{"d1"},
+		},
+		{
+			name:        "several messages, in the order they were asked for",
+			body:        `{"messages":[{"id":"missing"},{"id":"d2"},{"id":"d1"}]}`,
+			wantStatus:  http.StatusOK,
+			want:        []DeadLetterResult{{ID: "missing", Outcome: DEAD_LETTER_NOT_FOUND}, {ID: "d2", Outcome: DEAD_LETTER_FAILED}, {ID: "d1", Outcome: DEAD_LETTER_REPLAYED}},
+			wantOrders:  1,
+			wantInQueue: []string{"d2"},
+		},
+		{name: "no messages", body: `{"messages":[]}`, wantStatus: http.StatusBadRequest, wantInQueue: []string{"d1", "d2"}},
+		{name: "message without an id", body: `{"messages":[{"body":{}}]}`, wantStatus: http.StatusBadRequest, wantInQueue: []string{"d1", "d2"}},
+		{name: "malformed body", body: `{"messages":`, wantStatus: http.StatusBadRequest, wantInQueue: []string{"d1", "d2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			queue := newFakeDeadLetterQueue(testDeadLetters()...)
+
+			w := serve(newDeadLetterRouter(repo, queue), http.MethodPost, "/admin/deadletters/replay", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var body struct {
+					Results []DeadLetterResult `json:"results"`
+				}
+				decodeResponse(t, w, &body)
+				if len(body.Results) != len(tt.want) {
+					t.Fatalf("got results %+v, want %+v", body.Results, tt.want)
+				}
+				for i, got := range body.Results {
+					if got.ID != tt.want[i].ID || got.Outcome != tt.want[i].Outcome {
+						t.Errorf("got result %+v, want %s %s", got, tt.want[i].ID, tt.want[i].Outcome)
+					}
+					if got.Outcome == DEAD_LETTER_REPLAYED && got.OrderID == "" {
+						t.Errorf("got no order id for replayed message %s", got.ID)
+					}
+					if got.Outcome == DEAD_LETTER_FAILED && got.Error == "" {
+						t.Errorf("got no error for failed message %s", got.ID)
+					}
+				}
+			}
+
+			if got := countOrders(t, repo); got != tt.wantOrders {
+				t.Errorf("stored %d orders, want %d", got, tt.wantOrders)
+			}
+			if got := queue.ids(); !slices.Equal(got, tt.wantInQueue) {
+				t.Errorf("queue holds %v, want %v", got, tt.wantInQueue)
+			}
+			// every message that wasn't removed was released
+			if len(queue.locked) > 0 {
+				t.Errorf("messages %v are still locked", queue.locked)
+			}
+		})
+	}
+}
+
+func TestReplayDeadLetterTwice(t *testing.T) {
+	// the order was stored but the message couldn't be removed, so it is
+	// replayed again
+	repo := NewInMemoryOrderRepo()
+	queue := newFakeDeadLetterQueue(testDeadLetters()...)
+	queue.removeErr = errors.New("lock lost")
+	router := newDeadLetterRouter(repo, queue)
+
+	for range 2 {
+		w := serve(router, http.MethodPost, "/admin/deadletters/replay", `{"messages":[{"id":"d1"}]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		clear(queue.locked)
+	}
+
+	// the message's key makes the second replay a duplicate
+	if got := countOrders(t, repo); got != 1 {
+		t.Errorf("stored %d orders, want 1", got)
+	}
+}
+
+func TestPurgeDeadLetters(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		want        []DeadLetterResult
+		wantInQueue []string
+	}{
+		{
+			name:        "one message",
+			body:        `{"ids":["d2"]}`,
+			wantStatus:  http.StatusOK,
+			want:        []DeadLetterResult{{ID: "d2", Outcome: DEAD_LETTER_PURGED}},
+			wantInQueue: []string{"d1"},
+		},
+		{
+			name:       "every message",
+			body:       `{"ids":["d1","d2","missing"]}`,
+			wantStatus: http.StatusOK,
+			want:       []DeadLetterResult{{ID: "d1", Outcome: DEAD_LETTER_PURGED}, {ID: "d2", Outcome: DEAD_LETTER_PURGED}, {ID: "missing", Outcome: DEAD_LETTER_NOT_FOUND}},
+		},
+		{name: "no ids", body: `{"ids":[]}`, wantStatus: http.StatusBadRequest, wantInQueue: []string{"d1", "d2"}},
+		{name: "empty id", body: `{"ids":[""]}`, wantStatus: http.StatusBadRequest, wantInQueue: []string{"d1", "d2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			queue := newFakeDeadLetterQueue(testDeadLetters()...)
+
+			w := serve(newDeadLetterRouter(repo, queue), http.MethodPost, "/admin/deadletters/purge", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var body struct {
+					Results []DeadLetterResult `json:"results"`
+				}
+				decodeResponse(t, w, &body)
+				if !slices.Equal(body.Results, tt.want) {
+					t.Errorf("got results %+v, want %+v", body.Results, tt.want)
+				}
+			}
+
+			if got := queue.ids(); !slices.Equal(got, tt.wantInQueue) {
+				t.Errorf("queue holds %v, want %v", got, tt.wantInQueue)
+			}
+			if len(queue.locked) > 0 {
+				t.Errorf("messages %v are still locked", queue.locked)
+			}
+			// purged orders are dropped, not stored
+			if got := countOrders(t, repo); got != 0 {
+				t.Errorf("stored %d orders, want none", got)
+			}
+		})
+	}
+}
+
+func TestDeadLetterQueueUnavailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		queue      DeadLetterQueue
+		wantStatus int
+	}{
+		{name: "transport without a dead-letter queue", wantStatus: http.StatusNotImplemented},
+		{name: "queue that can't be reached", queue: &fakeDeadLetterQueue{openErr: errors.New("connection refused")}, wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newDeadLetterRouter(NewInMemoryOrderRepo(), tt.queue)
+			requests := []struct{ method, path, body string }{
+				{http.MethodGet, "/admin/deadletters", ""},
+				{http.MethodPost, "/admin/deadletters/replay", `{"messages":[{"id":"d1"}]}`},
+				{http.MethodPost, "/admin/deadletters/purge", `{"ids":["d1"]}`},
+			}
+			for _, req := range requests {
+				if w := serve(router, req.method, req.path, req.body); w.Code != tt.wantStatus {
+					t.Errorf("%s %s: got status %d, want %d", req.method, req.path, w.Code, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Order event types
+const (
+	ORDER_CREATED_EVENT        = "orderCreated"
+	ORDER_STATUS_CHANGED_EVENT = "orderStatusChanged"
+)
+
+// Valid sources for order events
+const (
+	LOCAL_EVENTS_SOURCE         = "local"
+	CHANGE_STREAM_EVENTS_SOURCE = "changestream"
+)
+
+// SSE_KEEPALIVE_INTERVAL is how often an idle event stream sends a comment so
+// proxies don't time it out
+const SSE_KEEPALIVE_INTERVAL = 15 * time.Second
+
+// eventSubscriberBuffer is how many events a subscriber can fall behind
+// before it starts missing events
+const eventSubscriberBuffer = 64
+
+// OrderEvent tells subscribers that an order was created or changed status.
+// Order is the order as stored after the change.
+type OrderEvent struct {
+	Type      string    `json:"type"`
+	Order     Order     `json:"order"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// OrderWatcher is implemented by repos that can report changes made by any
+// replica, not just this one
+type OrderWatcher interface {
+	// WatchOrders publishes every order change to events until ctx is done
+	WatchOrders(ctx context.Context, events *EventBus) error
+}
+
+// EventBus fans order events out to subscribers, such as open SSE streams.
+// Publishing never blocks: a subscriber that can't keep up misses events.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan OrderEvent]struct{}
+	// external is set when events come from the database rather than from
+	// this replica's consumer and handlers
+	external bool
+	// closed is set once the bus is closed for shutdown
+	closed bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan OrderEvent]struct{})}
+}
+
+// Subscribe returns a channel of events and a function that ends the
+// subscription and closes the channel. The channel is also closed when the
+// bus is.
+func (b *EventBus) Subscribe() (<-chan OrderEvent, func()) {
+	ch := make(chan OrderEvent, eventSubscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends every subscription, so open SSE streams finish and don't hold up
+// shutdown
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// HasSubscribers reports whether anyone is listening, so publishers can skip
+// the work of building an event nobody will see
+func (b *EventBus) HasSubscribers() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers) > 0
+}
+
+// Publish sends an event to every subscriber
+func (b *EventBus) Publish(event OrderEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("Dropped order event, subscriber is too slow", "event", event.Type, LOG_ORDER_ID, event.Order.OrderID)
+		}
+	}
+}
+
+// UseExternalSource makes the bus ignore events published with
+// publishOrderEvent, because an OrderWatcher reports them instead
+func (b *EventBus) UseExternalSource() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.external = true
+}
+
+// publishOrderEvent publishes an event for a change this replica just made.
+// The order is read back from the repo so subscribers see it as stored; an
+// order that isn't there, such as a duplicate that was skipped on insert,
+// produces no event.
+func publishOrderEvent(ctx context.Context, repo OrderRepo, events *EventBus, eventType string, orderID string) {
+	events.mu.Lock()
+	external := events.external
+	events.mu.Unlock()
+
+	if external || !events.HasSubscribers() {
+		return
+	}
+
+	order, err := repo.GetOrder(ctx, orderID)
+	if errors.Is(err, ErrOrderNotFound) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load order for event", "event", eventType, LOG_ORDER_ID, orderID, errAttr(err))
+		return
+	}
+
+	events.Publish(OrderEvent{Type: eventType, Order: order, Timestamp: time.Now().UTC()})
+}
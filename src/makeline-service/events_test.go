@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	if bus.HasSubscribers() {
+		t.Fatal("new bus has subscribers")
+	}
+
+	first, unsubscribeFirst := bus.Subscribe()
+	second, unsubscribeSecond := bus.Subscribe()
+	defer unsubscribeSecond()
+	if !bus.HasSubscribers() {
+		t.Fatal("bus has no subscribers after Subscribe")
+	}
+
+	event := OrderEvent{Type: ORDER_CREATED_EVENT, Order: testOrder("1", Pending), Timestamp: time.Now()}
+	bus.Publish(event)
+	for name, ch := range map[string]<-chan OrderEvent{"first": first, "second": second} {
+		select {
+		case got := <-ch:
+			if got.Type != event.Type || got.Order.OrderID != event.Order.OrderID {
+				t.Errorf("%s subscriber got %s for order %s, want %s for order %s", name, got.Type, got.Order.OrderID, event.Type, event.Order.OrderID)
+			}
+		default:
+			t.Errorf("%s subscriber got no event", name)
+		}
+	}
+
+	// unsubscribing closes the channel, and is safe to do twice
+	unsubscribeFirst()
+	unsubscribeFirst()
+	if _, ok := <-first; ok {
+		t.Error("channel is still open after unsubscribing")
+	}
+	bus.Publish(event)
+	if got := len(second); got != 1 {
+		t.Errorf("remaining subscriber has %d events, want 1", got)
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+
+	// publishing never blocks, so a subscriber that doesn't read misses what
+	// doesn't fit in its buffer
+	for i := range eventSubscriberBuffer + 10 {
+		bus.Publish(OrderEvent{Type: ORDER_CREATED_EVENT, Order: testOrder(fmt.Sprint(i), Pending)})
+	}
+	if got := len(events); got != eventSubscriberBuffer {
+		t.Errorf("subscriber has %d events, want a full buffer of %d", got, eventSubscriberBuffer)
+	}
+}
+
+func TestPublishOrderEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		orderID  string
+		external bool
+		want     bool
+	}{
+		{name: "stored order", orderID: "1", want: true},
+		{name: "order that isn't stored", orderID: "2"},
+		{name: "events from the database", orderID: "1", external: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			insertTestOrders(t, repo, testOrder("1", Processing))
+			bus := NewEventBus()
+			if tt.external {
+				bus.UseExternalSource()
+			}
+			events, unsubscribe := bus.Subscribe()
+			defer unsubscribe()
+
+			publishOrderEvent(t.Context(), repo, bus, ORDER_STATUS_CHANGED_EVENT, tt.orderID)
+
+			select {
+			case event := <-events:
+				if !tt.want {
+					t.Fatalf("got %s event for order %s, want none", event.Type, event.Order.OrderID)
+				}
+				// the order is read back as stored
+				if event.Type != ORDER_STATUS_CHANGED_EVENT || event.Order.OrderID != "1" || event.Order.Status != Processing {
+					t.Errorf("got %s event for order %s in status %s, want %s for order 1 in status Processing", event.Type, event.Order.OrderID, event.Order.Status, ORDER_STATUS_CHANGED_EVENT)
+				}
+			default:
+				if tt.want {
+					t.Error("got no event")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// InMemoryOrderRepo keeps orders in process memory. It is meant for local runs
+// and tests where no MongoDB or CosmosDB instance is available, and all data is
+// lost when the process exits.
+type InMemoryOrderRepo struct {
+	mu         sync.RWMutex
+	orders     []Order
+	messageIDs map[string]bool
+	// outbox holds lifecycle events until they are published, if enabled
+	outbox        []OutboxEvent
+	outboxEnabled bool
+}
+
+func NewInMemoryOrderRepo() *InMemoryOrderRepo {
+	return &InMemoryOrderRepo{messageIDs: make(map[string]bool)}
+}
+
+func (r *InMemoryOrderRepo) GetPendingOrders(ctx context.Context) ([]Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var orders []Order
+	for _, o := range r.orders {
+		if o.Status == Pending {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+
+	return orders, nil
+}
+
+func (r *InMemoryOrderRepo) CountPendingOrders(ctx context.Context) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var count int
+	for _, order := range r.orders {
+		if order.Status == Pending {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *InMemoryOrderRepo) GetOrder(ctx context.Context, id string) (Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, o := range r.orders {
+		if o.OrderID == id {
+			return copyOrder(o), nil
+		}
+	}
+
+	slog.DebugContext(ctx, "Order not found")
+	return Order{}, ErrOrderNotFound
+}
+
+func (r *InMemoryOrderRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	if len(orders) == 0 {
+		slog.DebugContext(ctx, "No orders to insert into database")
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var inserted int
+	for _, o := range orders {
+		if o.MessageID != "" {
+			if r.messageIDs[o.MessageID] {
+				continue
+			}
+			r.messageIDs[o.MessageID] = true
+		}
+		r.orders = append(r.orders, copyOrder(o))
+		r.recordEvents(newOrderReceivedEvent(o))
+		inserted++
+	}
+
+	slog.InfoContext(ctx, "Inserted orders into database", "count", inserted)
+	if skipped := len(orders) - inserted; skipped > 0 {
+		slog.InfoContext(ctx, "Skipped orders that were already ingested", "count", skipped)
+	}
+	return nil
+}
+
+func (r *InMemoryOrderRepo) UpdateOrder(ctx context.Context, order Order, actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := -1
+	current := func() (Order, error) {
+		for i := range r.orders {
+			if r.orders[i].OrderID == order.OrderID {
+				index = i
+				return r.orders[i], nil
+			}
+		}
+		return Order{}, ErrOrderNotFound
+	}
+
+	// The lock is held throughout, so the order cannot change in between
+	swap := func(from Order) (bool, error) {
+		change := newStatusChange(order.Status, actor)
+		r.orders[index].Status = order.Status
+		r.orders[index].UpdatedAt = change.Timestamp
+		r.orders[index].StatusHistory = append(r.orders[index].StatusHistory, change)
+		r.orders[index].ClaimedBy = ""
+		r.orders[index].LeaseExpiresAt = time.Time{}
+		r.recordEvents(newStatusChangeEvents(order.OrderID, from.Status, change)...)
+		return true, nil
+	}
+
+	// Update the order
+	slog.DebugContext(ctx, "Updating order", "status", order.Status.String())
+	if err := applyStatusTransition(order.OrderID, order.Status, order.ClaimedBy, current, swap); err != nil {
+		slog.WarnContext(ctx, "Failed to update order", errAttr(err))
+		return err
+	}
+
+	return nil
+}
+
+func (r *InMemoryOrderRepo) ClaimOrders(ctx context.Context, workerID string, count int, ttl time.Duration) ([]Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	change := newStatusChange(Processing, workerID)
+	var claimed []Order
+	for i := range r.orders {
+		if len(claimed) == count {
+			break
+		}
+		if r.orders[i].Status != Pending {
+			continue
+		}
+		r.orders[i].Status = Processing
+		r.orders[i].UpdatedAt = change.Timestamp
+		r.orders[i].StatusHistory = append(r.orders[i].StatusHistory, change)
+		r.orders[i].ClaimedBy = workerID
+		r.orders[i].LeaseExpiresAt = change.Timestamp.Add(ttl)
+		r.recordEvents(newStatusChangeEvents(r.orders[i].OrderID, Pending, change)...)
+		claimed = append(claimed, copyOrder(r.orders[i]))
+	}
+
+	slog.InfoContext(ctx, "Claimed orders", "count", len(claimed), "workerId", workerID)
+	return claimed, nil
+}
+
+func (r *InMemoryOrderRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	change := newStatusChange(Pending, LEASE_EXPIRED_ACTOR)
+	var released int
+	for i := range r.orders {
+		if !leaseExpired(r.orders[i], change.Timestamp) {
+			continue
+		}
+		r.orders[i].Status = Pending
+		r.orders[i].UpdatedAt = change.Timestamp
+		r.orders[i].StatusHistory = append(r.orders[i].StatusHistory, change)
+		r.orders[i].ClaimedBy = ""
+		r.orders[i].LeaseExpiresAt = time.Time{}
+		r.recordEvents(newStatusChangeEvents(r.orders[i].OrderID, Processing, change)...)
+		released++
+	}
+
+	return released, nil
+}
+
+func (r *InMemoryOrderRepo) ListOrders(ctx context.Context, query OrderQuery) (OrderPage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Orders are only ever appended, so the slice index is the creation order
+	// and the cursor is the index of the next order to look at
+	next, step := 0, 1
+	if query.Descending {
+		next, step = len(r.orders)-1, -1
+	}
+	if query.Cursor != "" {
+		position, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return OrderPage{}, err
+		}
+		next, err = strconv.Atoi(position)
+		if err != nil || next < -1 || next > len(r.orders) {
+			return OrderPage{}, ErrInvalidCursor
+		}
+	}
+
+	page := OrderPage{Orders: []Order{}}
+	for ; next >= 0 && next < len(r.orders); next += step {
+		if len(page.Orders) == query.PageSize() {
+			page.NextCursor = encodeCursor(strconv.Itoa(next))
+			break
+		}
+		if query.Matches(r.orders[next]) {
+			page.Orders = append(page.Orders, copyOrder(r.orders[next]))
+		}
+	}
+
+	return page, nil
+}
+
+func (r *InMemoryOrderRepo) EnableOutbox() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outboxEnabled = true
+}
+
+// ClaimOutboxEvents returns the oldest events. Orders in memory are only seen
+// by the replica that holds them, so there is no other relay to claim from.
+func (r *InMemoryOrderRepo) ClaimOutboxEvents(ctx context.Context, relayID string, limit int) ([]OutboxEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]OutboxEvent(nil), r.outbox[:min(limit, len(r.outbox))]...), nil
+}
+
+func (r *InMemoryOrderRepo) DeleteOutboxEvents(ctx context.Context, ids []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.outbox = slices.DeleteFunc(r.outbox, func(event OutboxEvent) bool {
+		return slices.Contains(ids, event.ID)
+	})
+	return nil
+}
+
+// recordEvents adds events to the outbox, if enabled. The caller must hold
+// the write lock, so the events are stored with the change they describe.
+func (r *InMemoryOrderRepo) recordEvents(events ...OutboxEvent) {
+	if r.outboxEnabled {
+		r.outbox = append(r.outbox, events...)
+	}
+}
+
+func (r *InMemoryOrderRepo) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (r *InMemoryOrderRepo) Close(ctx context.Context) error {
+	return nil
+}
+
+// copyOrder returns a copy of the order that does not share its slices,
+// so callers cannot mutate stored orders through the values they get back
+func copyOrder(o Order) Order {
+	if o.Items != nil {
+		o.Items = append([]Item(nil), o.Items...)
+	}
+	if o.StatusHistory != nil {
+		o.StatusHistory = append([]StatusChange(nil), o.StatusHistory...)
+	}
+	return o
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+)
+
+// DEFAULT_KAFKA_CONSUMER_GROUP is the consumer group used when
+// ORDER_QUEUE_CONSUMER_GROUP is not set. Replicas share the group, so each
+// order is consumed by one replica only.
+const DEFAULT_KAFKA_CONSUMER_GROUP = "makeline-service"
+
+// KAFKA_CONTENT_TYPE_HEADER carries the content type of a record, as the
+// CloudEvents Kafka binding sets it
+const KAFKA_CONTENT_TYPE_HEADER = "content-type"
+
+// kafkaClientOptions builds the Kafka client configuration from the
+// environment. The topic is the order queue name. SASL PLAIN and TLS are
+// enabled for brokers that need them, such as the Kafka endpoint of Azure
+// Event Hubs.
+func kafkaClientOptions(topic string) ([]kgo.Opt, error) {
+	brokers := os.Getenv("ORDER_QUEUE_BROKERS")
+	if brokers == "" {
+		return nil, errors.New("ORDER_QUEUE_BROKERS is not set")
+	}
+
+	group := os.Getenv("ORDER_QUEUE_CONSUMER_GROUP")
+	if group == "" {
+		group = DEFAULT_KAFKA_CONSUMER_GROUP
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(strings.Split(brokers, ",")...),
+		kgo.ConsumerGroup(group),
+		kgo.ConsumeTopics(topic),
+		// start from the oldest order a new group hasn't seen, so orders sent
+		// before the first replica started aren't skipped
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		// offsets are committed by the consumer only once orders are stored
+		kgo.DisableAutoCommit(),
+		// partitions can't move to another replica while a batch is being
+		// stored, so the offsets committed afterwards are still ours
+		kgo.BlockRebalanceOnPoll(),
+		// the dead-letter topic is created on first use by brokers that
+		// allow it
+		kgo.AllowAutoTopicCreation(),
+	}
+
+	if username := os.Getenv("ORDER_QUEUE_USERNAME"); username != "" {
+		opts = append(opts, kgo.SASL(plain.Auth{
+			User: username,
+			Pass: os.Getenv("ORDER_QUEUE_PASSWORD"),
+		}.AsMechanism()))
+	}
+	if os.Getenv("ORDER_QUEUE_TLS") == "true" {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+
+	return opts, nil
+}
+
+// KafkaOrderSource consumes orders from a Kafka topic as part of a consumer
+// group. Offsets are committed as orders are acked, so orders that were never
+// stored are read again by whichever replica gets the partition next.
+type KafkaOrderSource struct {
+	topic string
+	// deadLetterTopic is where poison records are produced to
+	deadLetterTopic string
+	// prefetch is how many records are polled at once
+	prefetch int
+	client   *kgo.Client
+	// rewinds are the offsets to read partitions again from, by topic and
+	// partition, once records were handed back with Nack. Kafka can't
+	// redeliver a single record, so the partition is set back to the first
+	// record handed back, which follows its last committed offset.
+	mu      sync.Mutex
+	rewinds map[string]map[int32]kgo.EpochOffset
+	// unsettled counts the records received but not yet settled. The
+	// partitions they came from aren't given up until it's back to zero, as
+	// the consumer may wait for more records before storing them.
+	unsettled atomic.Int64
+}
+
+func NewKafkaOrderSource(topic string, deadLetterTopic string, prefetch int) *KafkaOrderSource {
+	return &KafkaOrderSource{topic: topic, deadLetterTopic: deadLetterTopic, prefetch: prefetch}
+}
+
+func (s *KafkaOrderSource) Transport() string {
+	return KAFKA_TRANSPORT
+}
+
+func (s *KafkaOrderSource) Name() string {
+	return s.topic
+}
+
+func (s *KafkaOrderSource) Open(ctx context.Context) error {
+	opts, err := kafkaClientOptions(s.topic)
+	if err != nil {
+		return err
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create kafka client: %w", err)
+	}
+
+	if err := client.Ping(ctx); err != nil {
+		client.Close()
+		return fmt.Errorf("failed to connect to brokers: %w", err)
+	}
+
+	s.client = client
+	s.rewinds = nil
+	s.unsettled.Store(0)
+	return nil
+}
+
+// Close leaves the group, which hands the partitions to the other replicas
+// straight away. Offsets of orders not yet stored were never committed.
+func (s *KafkaOrderSource) Close(ctx context.Context) error {
+	s.client.CloseAllowingRebalance()
+	return nil
+}
+
+// Receive polls up to prefetch records. Records are ordered by partition, so
+// a partition's offsets are committed in order. Partitions can't move to another
+// replica while records are unsettled, so the offsets committed for them are
+// still ours.
+func (s *KafkaOrderSource) Receive(ctx context.Context) ([]*QueueMessage, error) {
+	// the partitions are still ours while rebalancing is blocked, so they
+	// are set back before it is allowed
+	s.rewindPartitions()
+	if s.unsettled.Load() == 0 {
+		s.client.AllowRebalance()
+	}
+
+	fetches := s.client.PollRecords(ctx, s.prefetch)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if fetches.IsClientClosed() {
+		return nil, errors.New("kafka client closed")
+	}
+	fetches.EachError(func(topic string, partition int32, err error) {
+		slog.ErrorContext(ctx, "Failed to fetch from partition", "topic", topic, "partition", partition, errAttr(err))
+	})
+
+	records := fetches.Records()
+	s.unsettled.Add(int64(len(records)))
+	messages := make([]*QueueMessage, 0, len(records))
+	for _, record := range records {
+		headers := kafkaHeaders(record)
+		contentType, _ := headers[KAFKA_CONTENT_TYPE_HEADER].(string)
+		messages = append(messages, &QueueMessage{
+			ID:            kafkaIdempotencyKey(record),
+			Body:          record.Value,
+			ContentType:   contentType,
+			Properties:    headers,
+			DeliveryCount: 1,
+			OrderingKey:   record.Topic + "/" + strconv.Itoa(int(record.Partition)),
+			raw:           record,
+		})
+	}
+	return messages, nil
+}
+
+func (s *KafkaOrderSource) Ack(ctx context.Context, msg *QueueMessage) error {
+	defer s.unsettled.Add(-1)
+	return s.client.CommitRecords(ctx, msg.raw.(*kgo.Record))
+}
+
+// Nack leaves the record's offset uncommitted and sets its partition back to
+// it on the next Receive, so the record is read again. Kafka doesn't count
+// deliveries, so the consumer counts failures itself.
+func (s *KafkaOrderSource) Nack(ctx context.Context, msg *QueueMessage, failed bool) error {
+	defer s.unsettled.Add(-1)
+	record := msg.raw.(*kgo.Record)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rewinds == nil {
+		s.rewinds = make(map[string]map[int32]kgo.EpochOffset)
+	}
+	partitions := s.rewinds[record.Topic]
+	if partitions == nil {
+		partitions = make(map[int32]kgo.EpochOffset)
+		s.rewinds[record.Topic] = partitions
+	}
+	if rewind, ok := partitions[record.Partition]; !ok || record.Offset < rewind.Offset {
+		partitions[record.Partition] = kgo.EpochOffset{Epoch: record.LeaderEpoch, Offset: record.Offset}
+	}
+	return nil
+}
+
+// rewindPartitions sets the partitions with records handed back to the first
+// of them, dropping the records fetched after it
+func (s *KafkaOrderSource) rewindPartitions() {
+	s.mu.Lock()
+	rewinds := s.rewinds
+	s.rewinds = nil
+	s.mu.Unlock()
+
+	if len(rewinds) > 0 {
+		s.client.SetOffsets(rewinds)
+	}
+}
+
+// DeadLetter produces the record to the dead-letter topic, with the reason
+// and description as headers, and commits it once the broker has the copy.
+// If the copy can't be produced, the record is left uncommitted.
+func (s *KafkaOrderSource) DeadLetter(ctx context.Context, msg *QueueMessage, reason string, description string) error {
+	defer s.unsettled.Add(-1)
+	original := msg.raw.(*kgo.Record)
+
+	headers := slices.Clone(original.Headers)
+	headers = append(headers,
+		kgo.RecordHeader{Key: DEAD_LETTER_REASON_PROPERTY, Value: []byte(reason)},
+		kgo.RecordHeader{Key: DEAD_LETTER_DESCRIPTION_PROPERTY, Value: []byte(description)},
+	)
+	deadLetter := &kgo.Record{
+		Topic:   s.deadLetterTopic,
+		Key:     original.Key,
+		Value:   original.Value,
+		Headers: headers,
+	}
+	if err := s.client.ProduceSync(ctx, deadLetter).FirstErr(); err != nil {
+		return fmt.Errorf("failed to produce to dead-letter topic: %w", err)
+	}
+	return s.client.CommitRecords(ctx, original)
+}
+
+func (s *KafkaOrderSource) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx)
+}
+
+// kafkaIdempotencyKey returns the key used to deduplicate a Kafka record: the
+// producer's idempotency key header if set, otherwise the record's position
+// in the topic, which stays the same however often it is read
+func kafkaIdempotencyKey(record *kgo.Record) string {
+	for _, header := range record.Headers {
+		if header.Key == IDEMPOTENCY_KEY_PROPERTY && len(header.Value) > 0 {
+			return string(header.Value)
+		}
+	}
+	return record.Topic + "/" + strconv.Itoa(int(record.Partition)) + "/" + strconv.FormatInt(record.Offset, 10)
+}
+
+// kafkaHeaders returns the record headers as message properties, so trace
+// context can be read from them like from AMQP application properties
+func kafkaHeaders(record *kgo.Record) map[string]any {
+	headers := make(map[string]any, len(record.Headers))
+	for _, header := range record.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	return headers
+}
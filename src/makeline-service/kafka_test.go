@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	testKafkaTopic           = "orders"
+	testKafkaDeadLetterTopic = "orders.dlq"
+)
+
+// flakyRepo is an in-memory repo whose InsertOrders fails while failing is
+// set
+type flakyRepo struct {
+	*InMemoryOrderRepo
+	failing atomic.Bool
+	inserts atomic.Int32
+}
+
+func newFlakyRepo() *flakyRepo {
+	return &flakyRepo{InMemoryOrderRepo: NewInMemoryOrderRepo()}
+}
+
+func (r *flakyRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	r.inserts.Add(1)
+	if r.failing.Load() {
+		return errors.New("database unavailable")
+	}
+	return r.InMemoryOrderRepo.InsertOrders(ctx, orders)
+}
+
+// countingSource counts how often the consumer connects
+type countingSource struct {
+	OrderSource
+	opens atomic.Int32
+}
+
+func (s *countingSource) Open(ctx context.Context) error {
+	s.opens.Add(1)
+	return s.OrderSource.Open(ctx)
+}
+
+// startKafkaCluster runs an in-process stand-in broker with the order topic,
+// and points the Kafka source at it
+func startKafkaCluster(t *testing.T, partitions int32) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(partitions, testKafkaTopic, testKafkaDeadLetterTopic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cluster.Close)
+	t.Setenv("ORDER_QUEUE_BROKERS", cluster.ListenAddrs()[0])
+	t.Setenv("ORDER_QUEUE_CONSUMER_GROUP", "makeline-test")
+	return cluster
+}
+
+// produceOrders sends count orders to the order topic, spread over its
+// partitions by key
+func produceOrders(t *testing.T, cluster *kfake.Cluster, count int) {
+	t.Helper()
+	values := make([][]byte, 0, count)
+	for i := range count {
+		values = append(values, testOrderJSON(strconv.Itoa(i)))
+	}
+	produceRecords(t, cluster, values...)
+}
+
+// produceRecords sends a record with each of values to the order topic
+func produceRecords(t *testing.T, cluster *kfake.Cluster, values ...[]byte) {
+	t.Helper()
+	producer, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+
+	for i, value := range values {
+		record := &kgo.Record{Topic: testKafkaTopic, Key: fmt.Appendf(nil, "customer-%d", i), Value: value}
+		if err := producer.ProduceSync(context.Background(), record).FirstErr(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// runConsumer consumes from source into repo until the returned stop
+// function is called
+func runConsumer(source OrderSource, repo OrderRepo, link *ConsumerLink) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewConsumer(source, repo, NewEventBus(), link, NewULIDGenerator(), testConsumerConfig()).Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitFor polls until condition holds, failing the test after a while
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// receiveAll reads what a fresh replica of the group would be given, which is
+// nothing once every offset is committed
+func receiveAll(t *testing.T, wait time.Duration) int {
+	t.Helper()
+	source := NewKafkaOrderSource(testKafkaTopic, testKafkaDeadLetterTopic, 100)
+	if err := source.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	var received int
+	for ctx.Err() == nil {
+		messages, _ := source.Receive(ctx)
+		received += len(messages)
+	}
+	return received
+}
+
+func TestKafkaGroupConsumption(t *testing.T) {
+	cluster := startKafkaCluster(t, 4)
+	produceOrders(t, cluster, 40)
+
+	// two replicas share the partitions of the topic
+	repo := newFlakyRepo()
+	var stops []func()
+	for range 2 {
+		stops = append(stops, runConsumer(NewKafkaOrderSource(testKafkaTopic, testKafkaDeadLetterTopic, 10), repo, NewConsumerLink()))
+	}
+	waitFor(t, "all orders to be stored", func() bool { return countOrders(t, repo) == 40 })
+
+	var wg sync.WaitGroup
+	for _, stop := range stops {
+		wg.Go(stop)
+	}
+	wg.Wait()
+
+	if got := countOrders(t, repo); got != 40 {
+		t.Errorf("stored %d orders, want each of the 40 once", got)
+	}
+	if got := receiveAll(t, 2*time.Second); got != 0 {
+		t.Errorf("a new replica received %d records, want none once all offsets are committed", got)
+	}
+}
+
+func TestKafkaOffsetsCommittedOnlyAfterInsert(t *testing.T) {
+	cluster := startKafkaCluster(t, 1)
+	produceOrders(t, cluster, 3)
+
+	repo := newFlakyRepo()
+	repo.failing.Store(true)
+	stop := runConsumer(NewKafkaOrderSource(testKafkaTopic, testKafkaDeadLetterTopic, 10), repo, NewConsumerLink())
+	waitFor(t, "an insert to fail", func() bool { return repo.inserts.Load() > 0 })
+	stop()
+
+	if got := receiveAll(t, 2*time.Second); got != 3 {
+		t.Fatalf("a new replica received %d records, want all 3 as none were stored", got)
+	}
+
+	repo.failing.Store(false)
+	stop = runConsumer(NewKafkaOrderSource(testKafkaTopic, testKafkaDeadLetterTopic, 10), repo, NewConsumerLink())
+	waitFor(t, "the orders to be stored", func() bool { return countOrders(t, repo) == 3 })
+	stop()
+
+	if got := receiveAll(t, 2*time.Second); got != 0 {
+		t.Errorf("a new replica received %d records, want none once the orders are stored", got)
+	}
+}
+
+func TestKafkaRedeliveryAfterFailedInsert(t *testing.T) {
+	cluster := startKafkaCluster(t, 2)
+	produceOrders(t, cluster, 10)
+
+	repo := newFlakyRepo()
+	repo.failing.Store(true)
+	source := &countingSource{OrderSource: NewKafkaOrderSource(testKafkaTopic, testKafkaDeadLetterTopic, 10)}
+	link := NewConsumerLink()
+	stop := runConsumer(source, repo, link)
+	defer stop()
+
+	waitFor(t, "an insert to fail", func() bool { return repo.inserts.Load() > 0 })
+	repo.failing.Store(false)
+	waitFor(t, "the orders to be read again and stored", func() bool { return countOrders(t, repo) == 10 })
+
+	if opens := source.opens.Load(); opens != 1 {
+		t.Errorf("consumer connected %d times, want the records read again without reconnecting", opens)
+	}
+	if status := link.Check(context.Background()).Status; status != DEPENDENCY_UP {
+		t.Errorf("queue is %s, want it to stay up while records are read again", status)
+	}
+}
+
+func TestKafkaDeadLetterTopic(t *testing.T) {
+	cluster := startKafkaCluster(t, 1)
+	produceRecords(t, cluster, testOrderJSON("0"), []byte("not an order"), testOrderJSON("2"))
+
+	repo := newFlakyRepo()
+	stop := runConsumer(NewKafkaOrderSource(testKafkaTopic, testKafkaDeadLetterTopic, 10), repo, NewConsumerLink())
+	waitFor(t, "the valid orders to be stored", func() bool { return countOrders(t, repo) == 2 })
+	stop()
+
+	reader, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(testKafkaDeadLetterTopic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	records := reader.PollFetches(ctx).Records()
+
+	if len(records) != 1 {
+		t.Fatalf("dead-letter topic has %d records, want the poison record", len(records))
+	}
+	if got := string(records[0].Value); got != "not an order" {
+		t.Errorf("dead-lettered payload is %q, want the original", got)
+	}
+	headers := kafkaHeaders(records[0])
+	if got := headers[DEAD_LETTER_REASON_PROPERTY]; got != DEAD_LETTER_INVALID_ORDER {
+		t.Errorf("dead-letter reason is %v, want %s", got, DEAD_LETTER_INVALID_ORDER)
+	}
+	if headers[DEAD_LETTER_DESCRIPTION_PROPERTY] == "" {
+		t.Error("dead-letter description is empty, want the error")
+	}
+	if got := receiveAll(t, 2*time.Second); got != 0 {
+		t.Errorf("a new replica received %d records, want none once the poison record is dead-lettered", got)
+	}
+}
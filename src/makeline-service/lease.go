@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// DEFAULT_LEASE_TTL is how long a claim lasts when the worker doesn't ask
+	// for a specific lease
+	DEFAULT_LEASE_TTL = 5 * time.Minute
+	// MAX_LEASE_TTL caps the lease a worker can ask for
+	MAX_LEASE_TTL = 1 * time.Hour
+	// MAX_CLAIM_COUNT caps how many orders a worker can claim at once
+	MAX_CLAIM_COUNT = 100
+	// LEASE_CHECK_INTERVAL is how often expired leases are released
+	LEASE_CHECK_INTERVAL = 15 * time.Second
+	// LEASE_EXPIRED_ACTOR is recorded in the status history when an expired
+	// lease sends an order back to Pending
+	LEASE_EXPIRED_ACTOR = SYSTEM_ACTOR + "/lease-expired"
+)
+
+// ClaimRequest is the body of POST /order/claim
+type ClaimRequest struct {
+	WorkerID     string `json:"workerId"`
+	Count        int    `json:"count"`
+	LeaseSeconds int    `json:"leaseSeconds"`
+}
+
+// OrderUpdate is the body of PUT /order. WorkerID must be the worker that
+// claimed the order, if it is claimed.
+type OrderUpdate struct {
+	Order
+	WorkerID string `json:"workerId"`
+}
+
+// LeaseError is returned when a claimed order is updated by another worker
+// than the one holding it, or after its lease has expired
+type LeaseError struct {
+	OrderID        string
+	ClaimedBy      string
+	LeaseExpiresAt time.Time
+	// WorkerID is the worker the update was made for, if any
+	WorkerID string
+}
+
+func (e *LeaseError) Error() string {
+	if e.WorkerID == e.ClaimedBy {
+		return fmt.Sprintf("lease of worker %s on order %s expired at %s", e.ClaimedBy, e.OrderID, e.LeaseExpiresAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("order %s is claimed by worker %s", e.OrderID, e.ClaimedBy)
+}
+
+// checkLease returns a LeaseError unless o is unclaimed, or claimed by
+// workerID under a lease that hasn't expired by now
+func checkLease(orderID string, o Order, workerID string, now time.Time) error {
+	if o.ClaimedBy == "" || (o.ClaimedBy == workerID && !leaseExpired(o, now)) {
+		return nil
+	}
+	return &LeaseError{OrderID: orderID, ClaimedBy: o.ClaimedBy, LeaseExpiresAt: o.LeaseExpiresAt, WorkerID: workerID}
+}
+
+// leaseExpired reports whether o is held under a lease that ran out before now
+func leaseExpired(o Order, now time.Time) bool {
+	return o.Status == Processing && !o.LeaseExpiresAt.IsZero() && o.LeaseExpiresAt.Before(now)
+}
+
+// runLeaseReaper periodically moves orders with expired leases back to
+// Pending, so orders claimed by a worker that died are picked up again
+func runLeaseReaper(ctx context.Context, repo OrderRepo) {
+	ticker := time.NewTicker(LEASE_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			released, err := repo.ReleaseExpiredLeases(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to release expired leases", errAttr(err))
+				continue
+			}
+			if released > 0 {
+				slog.InfoContext(ctx, "Released orders with expired leases", "count", released)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClaimOrders(t *testing.T) {
+	tests := []struct {
+		name        string
+		pending     int
+		count       int
+		wantClaimed int
+	}{
+		{name: "claims the requested count", pending: 5, count: 3, wantClaimed: 3},
+		{name: "claims what is pending", pending: 2, count: 5, wantClaimed: 2},
+		{name: "nothing pending", pending: 0, count: 5, wantClaimed: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				// orders that aren't pending are never claimed
+				orders := []Order{testOrder("complete", Complete), testOrder("on-hold", OnHold)}
+				for i := range tt.pending {
+					orders = append(orders, testOrder(fmt.Sprint(i), Pending))
+				}
+				insertTestOrders(t, repo, orders...)
+
+				claimed, err := repo.ClaimOrders(t.Context(), "worker-1", tt.count, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(claimed) != tt.wantClaimed {
+					t.Fatalf("claimed %d orders, want %d", len(claimed), tt.wantClaimed)
+				}
+				for _, order := range claimed {
+					if order.Status != Processing || order.ClaimedBy != "worker-1" || order.LeaseExpiresAt.IsZero() {
+						t.Errorf("claimed order is %s, claimed by %q until %v, want Processing under a lease to worker-1", order.Status, order.ClaimedBy, order.LeaseExpiresAt)
+					}
+					stored, err := repo.GetOrder(t.Context(), order.OrderID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if stored.Status != Processing || stored.ClaimedBy != "worker-1" {
+						t.Errorf("stored order %s is %s, claimed by %q, want Processing, claimed by worker-1", stored.OrderID, stored.Status, stored.ClaimedBy)
+					}
+					if last := stored.StatusHistory[len(stored.StatusHistory)-1]; last.Status != Processing || last.Actor != "worker-1" {
+						t.Errorf("claim is recorded as %s by %s, want Processing by worker-1", last.Status, last.Actor)
+					}
+				}
+
+				// a second worker only gets what is left
+				rest, err := repo.ClaimOrders(t.Context(), "worker-2", MAX_CLAIM_COUNT, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(rest) != tt.pending-tt.wantClaimed {
+					t.Errorf("second worker claimed %d orders, want the %d left", len(rest), tt.pending-tt.wantClaimed)
+				}
+				for _, order := range rest {
+					for _, first := range claimed {
+						if order.OrderID == first.OrderID {
+							t.Errorf("order %s was claimed by both workers", order.OrderID)
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestReleaseExpiredLeases(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// moveTo is the status the worker moves the order to after claiming
+		// it, if any
+		moveTo       *Status
+		wantReleased int
+		wantStatus   Status
+	}{
+		{name: "expired lease goes back to pending", ttl: time.Millisecond, wantReleased: 1, wantStatus: Pending},
+		{name: "live lease is kept", ttl: time.Hour, wantReleased: 0, wantStatus: Processing},
+		{name: "order moved on before the lease expired", ttl: time.Millisecond, moveTo: new(Complete), wantReleased: 0, wantStatus: Complete},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				outbox := enableTestOutbox(t, repo)
+				insertTestOrders(t, repo, testOrder("1", Pending))
+				if _, err := repo.ClaimOrders(t.Context(), "worker-1", 1, tt.ttl); err != nil {
+					t.Fatal(err)
+				}
+				if tt.moveTo != nil {
+					if err := repo.UpdateOrder(t.Context(), Order{OrderID: "1", Status: *tt.moveTo, ClaimedBy: "worker-1"}, "worker-1"); err != nil {
+						t.Fatal(err)
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+
+				released, err := repo.ReleaseExpiredLeases(t.Context())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if released != tt.wantReleased {
+					t.Errorf("released %d orders, want %d", released, tt.wantReleased)
+				}
+
+				order, err := repo.GetOrder(t.Context(), "1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if order.Status != tt.wantStatus {
+					t.Errorf("order is %s, want %s", order.Status, tt.wantStatus)
+				}
+				if tt.wantStatus != Processing && (order.ClaimedBy != "" || !order.LeaseExpiresAt.IsZero()) {
+					t.Errorf("order is still claimed by %q until %v, want the lease ended", order.ClaimedBy, order.LeaseExpiresAt)
+				}
+
+				// the release is announced like any other status change
+				events := claimAllOutboxEvents(t, outbox, "relay-1")
+				last := events[len(events)-1]
+				wasReleased := last.Type == ORDER_STATUS_CHANGED_LIFECYCLE_EVENT && last.Status == Pending && last.Actor == LEASE_EXPIRED_ACTOR &&
+					last.PreviousStatus != nil && *last.PreviousStatus == Processing
+				if wasReleased != (tt.wantReleased == 1) {
+					t.Errorf("got last event %s to %s by %s, want a release event: %t", last.Type, last.Status, last.Actor, tt.wantReleased == 1)
+				}
+				if tt.wantReleased == 0 {
+					return
+				}
+				if last := order.StatusHistory[len(order.StatusHistory)-1]; last.Status != Pending || last.Actor != LEASE_EXPIRED_ACTOR {
+					t.Errorf("release is recorded as %s by %s, want Pending by %s", last.Status, last.Actor, LEASE_EXPIRED_ACTOR)
+				}
+
+				// the order can be claimed again
+				claimed, err := repo.ClaimOrders(t.Context(), "worker-2", 1, time.Minute)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(claimed) != 1 {
+					t.Errorf("claimed %d orders after the release, want the released one", len(claimed))
+				}
+			})
+		})
+	}
+}
+
+func TestUpdateClaimedOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// workerID is the worker the update is made for
+		workerID string
+		wantErr  bool
+	}{
+		{name: "worker holding the lease", ttl: time.Minute, workerID: "worker-1"},
+		{name: "another worker", ttl: time.Minute, workerID: "worker-2", wantErr: true},
+		{name: "no worker", ttl: time.Minute, wantErr: true},
+		{name: "worker whose lease expired", ttl: time.Millisecond, workerID: "worker-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				insertTestOrders(t, repo, testOrder("1", Pending), testOrder("unclaimed", Pending))
+				if _, err := repo.ClaimOrders(t.Context(), "worker-1", 1, tt.ttl); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+
+				err := repo.UpdateOrder(t.Context(), Order{OrderID: "1", Status: Complete, ClaimedBy: tt.workerID}, "api")
+				var leaseErr *LeaseError
+				if tt.wantErr {
+					if !errors.As(err, &leaseErr) {
+						t.Fatalf("got error %v, want a LeaseError", err)
+					}
+					if leaseErr.ClaimedBy != "worker-1" || leaseErr.WorkerID != tt.workerID {
+						t.Errorf("got order claimed by %q updated for %q, want claimed by worker-1 updated for %q", leaseErr.ClaimedBy, leaseErr.WorkerID, tt.workerID)
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				order, err := repo.GetOrder(t.Context(), "1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := Complete
+				if tt.wantErr {
+					want = Processing
+				}
+				if order.Status != want {
+					t.Errorf("order is %s, want %s", order.Status, want)
+				}
+
+				// an order that isn't claimed is updated for anyone
+				if err := repo.UpdateOrder(t.Context(), Order{OrderID: "unclaimed", Status: Processing}, "api"); err != nil {
+					t.Errorf("got error %v updating an unclaimed order", err)
+				}
+			})
+		})
+	}
+}
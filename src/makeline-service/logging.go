@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log attribute keys. Use these rather than ad hoc keys so log lines can be
+// queried the same way whichever part of the service wrote them.
+const (
+	LOG_ORDER_ID     = "orderId"
+	LOG_CUSTOMER_ID  = "customerId"
+	LOG_TRANSPORT    = "transport"
+	LOG_MESSAGE_ID   = "messageId"
+	LOG_EVENT_TYPE   = "eventType"
+	LOG_EVENT_SOURCE = "eventSource"
+	LOG_BACKEND      = "backend"
+	LOG_REQUEST_ID   = "requestId"
+	LOG_TRACE_ID     = "traceId"
+	LOG_ERROR        = "error"
+	LOG_AUDIT        = "audit"
+)
+
+// REQUEST_ID_HEADER carries the request ID, either from the caller or
+// generated by the service
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a caller
+const maxRequestIDLength = 128
+
+// REDACTED replaces the value of sensitive log attributes
+const REDACTED = "[REDACTED]"
+
+// sensitiveKeys are parts of attribute keys whose values are never logged
+var sensitiveKeys = []string{"password", "secret", "token", "apikey", "accesskey", "accountkey", "dbkey", "authorization", "connectionstring", "credential"}
+
+// auditLogger writes the audit records of admin actions. It has its own
+// level, so raising LOG_LEVEL doesn't drop them.
+var auditLogger = slog.Default()
+
+// logAttrsKey is the context key for attributes added with withLogAttrs
+type logAttrsKey struct{}
+
+// initLogging sets the default slog logger from LOG_LEVEL (debug, info, warn
+// or error, default info) and LOG_FORMAT (json or text, default json), and
+// the audit logger, which logs at info whatever LOG_LEVEL is. Lines
+// written with the standard log package, such as those from dependencies, go
+// through the same logger.
+func initLogging() error {
+	var level slog.Level
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q: %w", raw, err)
+		}
+	}
+
+	format := os.Getenv("LOG_FORMAT")
+	if format != "" && format != "json" && format != "text" {
+		return fmt.Errorf("invalid LOG_FORMAT %q, expected json or text", format)
+	}
+	newHandler := func(level slog.Leveler) slog.Handler {
+		options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+		if format == "text" {
+			return slog.NewTextHandler(os.Stderr, options)
+		}
+		return slog.NewJSONHandler(os.Stderr, options)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{newHandler(level)}))
+	auditLogger = slog.New(contextHandler{newHandler(slog.LevelInfo)})
+	return nil
+}
+
+// withLogAttrs returns a context whose log lines carry attrs in addition to
+// any attributes already on ctx
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(combined, existing...)
+	combined = append(combined, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, combined)
+}
+
+// logFatal logs an error and exits, like log.Fatal
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// errAttr is the attribute for an error on a log line
+func errAttr(err error) slog.Attr {
+	return slog.Any(LOG_ERROR, err)
+}
+
+// contextHandler adds the attributes stored on the context with withLogAttrs,
+// and the trace ID of the current span, to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String(LOG_TRACE_ID, spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// redactAttr hides the values of sensitive attributes and the passwords in
+// URLs, such as database connection strings
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, REDACTED)
+		}
+	}
+
+	if a.Value.Kind() == slog.KindString {
+		if u, err := url.Parse(a.Value.String()); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				return slog.String(a.Key, u.Redacted())
+			}
+		}
+	}
+
+	return a
+}
+
+// LogValue logs an order by its identifying fields only, leaving out line
+// items and history
+func (o Order) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String(LOG_ORDER_ID, o.OrderID),
+		slog.String(LOG_CUSTOMER_ID, o.CustomerID),
+		slog.String("status", o.Status.String()),
+		slog.Int("items", len(o.Items)),
+	)
+}
+
+// requestLogging gives every request an ID, taken from the X-Request-ID header
+// or generated, adds it to the log lines written while handling the request,
+// and logs the request once it is handled
+func requestLogging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// a caller supplied ID ends up in every log line, so keep it short
+		requestID := c.GetHeader(REQUEST_ID_HEADER)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = uuid.Must(uuid.NewV4()).String()
+		}
+		c.Header(REQUEST_ID_HEADER, requestID)
+
+		ctx := withLogAttrs(c.Request.Context(), slog.String(LOG_REQUEST_ID, requestID))
+		c.Request = c.Request.WithContext(ctx)
+
+		start := time.Now()
+		c.Next()
+
+		// probes and scrapes run every few seconds, so keep them out of the
+		// default log level
+		level := slog.LevelInfo
+		if !tracedRoute(c.Request) {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "Handled request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+		)
+	}
+}
@@ -2,60 +2,139 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 // Valid database API types
 const (
 	AZURE_COSMOS_DB_SQL_API = "cosmosdbsql"
+	IN_MEMORY_DB_API        = "memory"
+	POSTGRES_DB_API         = "postgres"
+	SQLITE_DB_API           = "sqlite"
 )
 
 func main() {
 
+	// Set up logging before anything logs
+	if err := initLogging(); err != nil {
+		log.Fatalf("Failed to initialize logging: %s", err)
+	}
+
 	// Get the database API type
 	apiType := os.Getenv("ORDER_DB_API")
 	switch apiType {
 	case "cosmosdbsql":
-		log.Printf("Using Azure CosmosDB SQL API")
+		slog.Info("Using Azure CosmosDB SQL API")
+	case "memory":
+		slog.Info("Using in-memory order store")
+	case "postgres":
+		slog.Info("Using PostgreSQL")
+	case "sqlite":
+		slog.Info("Using embedded SQLite")
 	default:
-		log.Printf("Using MongoDB API")
+		slog.Info("Using MongoDB API")
+	}
+
+	// Stop on SIGTERM, which Kubernetes sends before killing the pod, or on Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Set up tracing before any clients that create spans
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		logFatal("Failed to initialize tracing", errAttr(err))
+	}
+
+	// Set up order ID generation before any orders are consumed
+	ids, err := NewOrderIDGenerator()
+	if err != nil {
+		logFatal("Failed to create order id generator", errAttr(err))
 	}
 
-	// Initialize the database with retry logic in the background
+	// Initialize the database with retry logic in the background. The
+	// background work is tracked so shutdown can wait for it before the
+	// database is closed.
 	var orderService *OrderService
 	var dbReady atomic.Bool
-	go func() {
+	var workers sync.WaitGroup
+	workers.Go(func() {
 		var err error
 		maxRetries := 10
 		for i := 0; i < maxRetries; i++ {
 			orderService, err = initDatabase(apiType)
 			if err == nil {
+				// The event source and the outbox depend on the backend's own
+				// type, so they are picked before the repo is wrapped for metrics
+				startOrderEvents(ctx, orderService)
+				relay := newOutboxRelay(orderService.repo)
+				orderService.repo = NewInstrumentedOrderRepo(orderService.repo, databaseBackend(apiType))
 				dbReady.Store(true)
-				log.Printf("Database initialized successfully")
+				slog.Info("Database initialized successfully", LOG_BACKEND, databaseBackend(apiType))
 
 				// Start the background queue consumer once DB is ready
-				go startConsumer(context.Background(), orderService.repo)
+				workers.Go(func() { startConsumer(ctx, orderService.repo, orderService.events, orderService.consumer, ids) })
+				workers.Go(func() { runLeaseReaper(ctx, orderService.repo) })
+				workers.Go(func() { runPendingOrdersGauge(ctx, orderService.repo) })
+				if relay != nil {
+					workers.Go(func() { relay.Run(ctx) })
+				}
 				return
 			}
 			backoff := time.Duration(min(2<<i, 30)) * time.Second
-			log.Printf("Failed to initialize database (attempt %d/%d): %s. Retrying in %s...", i+1, maxRetries, err, backoff)
-			time.Sleep(backoff)
+			slog.Warn("Failed to initialize database, retrying",
+				LOG_BACKEND, databaseBackend(apiType),
+				"attempt", i+1,
+				"maxAttempts", maxRetries,
+				"backoff", backoff,
+				errAttr(err),
+			)
+			if !sleepContext(ctx, backoff) {
+				return
+			}
 		}
-		log.Fatalf("Failed to initialize database after %d attempts: %s", maxRetries, err)
-	}()
+		logFatal("Failed to initialize database", LOG_BACKEND, databaseBackend(apiType), "attempts", maxRetries, errAttr(err))
+	})
+
+	registerDBReadyGauge(dbReady.Load)
+
+	// readyOrderService returns the order service once the database is ready,
+	// and nil before
+	readyOrderService := func() *OrderService {
+		if !dbReady.Load() {
+			return nil
+		}
+		return orderService
+	}
+
+	adminKeys, err := adminKeysFromEnv()
+	if err != nil {
+		logFatal("Failed to read admin API keys", errAttr(err))
+	}
 
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(requestLogging())
+	router.Use(otelgin.Middleware(SERVICE_NAME, otelgin.WithFilter(tracedRoute)))
+	router.Use(httpMetrics())
 	router.Use(cors.Default())
 	router.Use(func(c *gin.Context) {
-		if c.FullPath() == "/health" || c.FullPath() == "/liveness" {
+		if c.FullPath() == "/health" || c.FullPath() == "/liveness" || c.FullPath() == "/ready" || c.FullPath() == "/metrics" {
 			c.Next()
 			return
 		}
@@ -67,11 +146,26 @@ func main() {
 		OrderMiddleware(orderService)(c)
 	})
 	router.GET("/order/fetch", fetchOrders)
+	router.GET("/orders", listOrders)
+	router.GET("/orders/stream", streamOrders)
 	router.GET("/order/:id", getOrder)
+	router.POST("/order/claim", claimOrders)
 	router.PUT("/order", updateOrder)
+	if adminKeys != nil {
+		// Dead-letter admin connects to the queue's dead-letter queue per request
+		deadLetters := NewDeadLetterAdmin(newDeadLetterQueue(os.Getenv("ORDER_QUEUE_NAME")), ids)
+		admin := router.Group("/admin", adminAuth(adminKeys))
+		admin.GET("/deadletters", deadLetters.listDeadLetters)
+		admin.POST("/deadletters/replay", deadLetters.replayDeadLetters)
+		admin.POST("/deadletters/purge", deadLetters.purgeDeadLetters)
+	} else {
+		slog.Warn("ADMIN_API_KEYS is not set, the dead-letter admin endpoints are disabled")
+	}
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	router.GET("/liveness", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "alive"})
 	})
+	router.GET("/ready", readiness(readyOrderService))
 	router.GET("/health", func(c *gin.Context) {
 		if !dbReady.Load() {
 			c.JSON(http.StatusServiceUnavailable, gin.H{
@@ -85,7 +179,53 @@ func main() {
 			"version": os.Getenv("APP_VERSION"),
 		})
 	})
-	router.Run(":3001")
+
+	server := &http.Server{Addr: ":3001", Handler: router}
+	go func() {
+		slog.Info("Listening for HTTP requests", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logFatal("Failed to start HTTP server", errAttr(err))
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+	shutdown(server, &workers, readyOrderService(), shutdownTracing)
+}
+
+// shutdown stops the service in dependency order: it stops taking HTTP
+// requests and drains the ones in flight, waits for the consumer to settle
+// its current message, closes the database and flushes pending spans. It
+// gives up waiting after SHUTDOWN_TIMEOUT. orderService is nil if the
+// database never became ready.
+func shutdown(server *http.Server, workers *sync.WaitGroup, orderService *OrderService, shutdownTracing func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	// open event streams never finish on their own, so end them first
+	if orderService != nil {
+		server.RegisterOnShutdown(orderService.events.Close)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Failed to drain HTTP requests", errAttr(err))
+	}
+
+	if err := waitContext(ctx, workers); err != nil {
+		slog.Error("Timed out waiting for the consumer to stop", errAttr(err))
+	}
+
+	if orderService != nil {
+		if err := orderService.repo.Close(ctx); err != nil {
+			slog.Error("Failed to close database", errAttr(err))
+		}
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", errAttr(err))
+	}
+
+	slog.Info("Shutdown complete")
 }
 
 // OrderMiddleware is a middleware function that injects the order service into the request context
@@ -101,18 +241,143 @@ func OrderMiddleware(orderService *OrderService) gin.HandlerFunc {
 func fetchOrders(c *gin.Context) {
 	client, ok := c.MustGet("orderService").(*OrderService)
 	if !ok {
-		log.Printf("Failed to get order service")
+		slog.ErrorContext(c.Request.Context(), "Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orders, err := client.repo.GetPendingOrders(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get pending orders from database", errAttr(err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, orders)
+}
+
+// Lists orders of any status, filtered by the query string and paged with an
+// opaque cursor. Pass the nextCursor of a page as cursor to get the next one.
+func listOrders(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		slog.ErrorContext(c.Request.Context(), "Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	query, err := parseOrderQuery(c.Request.URL.Query())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := client.repo.ListOrders(c.Request.Context(), query)
+	if errors.Is(err, ErrInvalidCursor) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list orders from database", errAttr(err))
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, page)
+}
+
+// Streams order events to the client as Server-Sent Events until it disconnects
+func streamOrders(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		slog.ErrorContext(c.Request.Context(), "Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := client.events.Subscribe()
+	defer unsubscribe()
+
+	// send the headers right away so the client knows the stream is open
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(SSE_KEEPALIVE_INTERVAL)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event)
+			return true
+		case <-keepAlive.C:
+			// a comment line keeps proxies from closing an idle stream
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		}
+	})
+}
+
+// Claims pending orders for a worker. The orders move to Processing under a
+// lease, and go back to Pending if the worker doesn't update them before the
+// lease expires.
+func claimOrders(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		slog.ErrorContext(c.Request.Context(), "Failed to get order service")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	orders, err := client.repo.GetPendingOrders()
+	var req ClaimRequest
+	if err := c.BindJSON(&req); err != nil {
+		slog.WarnContext(c.Request.Context(), "Failed to unmarshal claim request", errAttr(err))
+		return
+	}
+
+	if req.WorkerID == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "workerId is required"})
+		return
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+	if req.Count < 0 || req.Count > MAX_CLAIM_COUNT {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", MAX_CLAIM_COUNT)})
+		return
+	}
+	ttl := DEFAULT_LEASE_TTL
+	if req.LeaseSeconds != 0 {
+		ttl = time.Duration(req.LeaseSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > MAX_LEASE_TTL {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("leaseSeconds must be between 1 and %d", int(MAX_LEASE_TTL.Seconds()))})
+		return
+	}
+
+	ctx := withLogAttrs(c.Request.Context(), slog.String("workerId", req.WorkerID))
+	orders, err := client.repo.ClaimOrders(ctx, req.WorkerID, req.Count, ttl)
 	if err != nil {
-		log.Printf("Failed to get pending orders from database: %s", err)
+		slog.ErrorContext(ctx, "Failed to claim orders", errAttr(err))
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	for _, order := range orders {
+		publishOrderEvent(ctx, client.repo, client.events, ORDER_STATUS_CHANGED_EVENT, order.OrderID)
+	}
+
+	if orders == nil {
+		orders = []Order{}
+	}
 	c.IndentedJSON(http.StatusOK, orders)
 }
 
@@ -120,23 +385,26 @@ func fetchOrders(c *gin.Context) {
 func getOrder(c *gin.Context) {
 	client, ok := c.MustGet("orderService").(*OrderService)
 	if !ok {
-		log.Printf("Failed to get order service")
+		slog.ErrorContext(c.Request.Context(), "Failed to get order service")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	id, err := strconv.Atoi(c.Param("id"))
+	sanitizedOrderId, err := parseOrderID(c.Param("id"))
 	if err != nil {
-		log.Printf("Failed to convert order id to int: %s", err)
+		slog.WarnContext(c.Request.Context(), "Failed to parse order id", errAttr(err))
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	ctx := withLogAttrs(c.Request.Context(), slog.String(LOG_ORDER_ID, sanitizedOrderId))
 
-	sanitizedOrderId := strconv.FormatInt(int64(id), 10)
-
-	order, err := client.repo.GetOrder(sanitizedOrderId)
+	order, err := client.repo.GetOrder(ctx, sanitizedOrderId)
+	if errors.Is(err, ErrOrderNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to get order from database: %s", err)
+		slog.ErrorContext(ctx, "Failed to get order from database", errAttr(err))
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -148,45 +416,128 @@ func getOrder(c *gin.Context) {
 func updateOrder(c *gin.Context) {
 	client, ok := c.MustGet("orderService").(*OrderService)
 	if !ok {
-		log.Printf("Failed to get order service")
+		slog.ErrorContext(c.Request.Context(), "Failed to get order service")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	// unmarsal the order from the request body
-	var order Order
-	if err := c.BindJSON(&order); err != nil {
-		log.Printf("Failed to unmarshal order: %s", err)
+	var update OrderUpdate
+	if err := c.BindJSON(&update); err != nil {
+		slog.WarnContext(c.Request.Context(), "Failed to unmarshal order", errAttr(err))
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	order := update.Order
 
-	id, err := strconv.Atoi(order.OrderID)
+	sanitizedOrderId, err := parseOrderID(order.OrderID)
 	if err != nil {
-		log.Printf("Failed to convert order id to int: %s", err)
+		slog.WarnContext(c.Request.Context(), "Failed to parse order id", errAttr(err))
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	ctx := withLogAttrs(c.Request.Context(),
+		slog.String(LOG_ORDER_ID, sanitizedOrderId),
+		slog.String(LOG_CUSTOMER_ID, order.CustomerID),
+		slog.String("workerId", update.WorkerID),
+	)
 
-	sanitizedOrderId := strconv.FormatInt(int64(id), 10)
+	if !order.Status.Valid() {
+		slog.WarnContext(ctx, "Invalid order status", "status", int(order.Status))
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown status %d", order.Status)})
+		return
+	}
 
 	sanitizedOrder := Order{
 		OrderID:    sanitizedOrderId,
 		CustomerID: order.CustomerID,
 		Items:      order.Items,
 		Status:     order.Status,
+		ClaimedBy:  update.WorkerID,
 	}
 
-	err = client.repo.UpdateOrder(sanitizedOrder)
-	if err != nil {
-		log.Printf("Failed to update order status: %s", err)
+	err = client.repo.UpdateOrder(ctx, sanitizedOrder, requestActor(c))
+	var transitionErr *TransitionError
+	var leaseErr *LeaseError
+	switch {
+	case errors.As(err, &transitionErr):
+		slog.WarnContext(ctx, "Rejected order status update", errAttr(err))
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error":           transitionErr.Error(),
+			"orderId":         transitionErr.OrderID,
+			"currentStatus":   transitionErr.From,
+			"requestedStatus": transitionErr.To,
+		})
+		return
+	case errors.As(err, &leaseErr):
+		slog.WarnContext(ctx, "Rejected order status update", errAttr(err))
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error":          leaseErr.Error(),
+			"orderId":        leaseErr.OrderID,
+			"claimedBy":      leaseErr.ClaimedBy,
+			"leaseExpiresAt": leaseErr.LeaseExpiresAt,
+		})
+		return
+	case errors.Is(err, ErrConcurrentUpdate):
+		slog.WarnContext(ctx, "Rejected order status update", errAttr(err))
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error(), "orderId": sanitizedOrderId})
+		return
+	case errors.Is(err, ErrOrderNotFound):
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	case err != nil:
+		slog.ErrorContext(ctx, "Failed to update order status", errAttr(err))
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	publishOrderEvent(ctx, client.repo, client.events, ORDER_STATUS_CHANGED_EVENT, sanitizedOrderId)
 	c.SetAccepted("202")
 }
 
+// startOrderEvents picks where order events come from, as set by
+// ORDER_EVENTS_SOURCE. By default each replica publishes the changes it makes
+// itself; with change streams every replica sees every change.
+func startOrderEvents(ctx context.Context, orderService *OrderService) {
+	switch source := os.Getenv("ORDER_EVENTS_SOURCE"); source {
+	case "", LOCAL_EVENTS_SOURCE:
+	case CHANGE_STREAM_EVENTS_SOURCE:
+		watcher, ok := orderService.repo.(OrderWatcher)
+		if !ok {
+			slog.Warn("Change streams are not supported by this database, publishing local order events instead")
+			return
+		}
+		orderService.events.UseExternalSource()
+		go func() {
+			if err := watcher.WatchOrders(ctx, orderService.events); err != nil && ctx.Err() == nil {
+				slog.Error("Stopped watching order changes", errAttr(err))
+			}
+		}()
+		slog.Info("Publishing order events from database change streams")
+	default:
+		slog.Warn("Unknown ORDER_EVENTS_SOURCE, publishing local order events instead", "source", source)
+	}
+}
+
+// requestActor returns who is making a request, for the order status history.
+// Clients identify themselves with the X-Actor header.
+func requestActor(c *gin.Context) string {
+	if actor := c.GetHeader("X-Actor"); actor != "" {
+		return actor
+	}
+	return "api"
+}
+
+// databaseBackend names the database for the repo metrics
+func databaseBackend(apiType string) string {
+	switch apiType {
+	case AZURE_COSMOS_DB_SQL_API, IN_MEMORY_DB_API, POSTGRES_DB_API, SQLITE_DB_API:
+		return apiType
+	default:
+		return "mongodb"
+	}
+}
+
 // Gets an environment variable or exits if it is not set
 func getEnvVar(varName string, fallbackVarNames ...string) string {
 	value := os.Getenv(varName)
@@ -198,11 +549,7 @@ func getEnvVar(varName string, fallbackVarNames ...string) string {
 			}
 		}
 		if value == "" {
-			log.Printf("%s is not set", varName)
-			if len(fallbackVarNames) > 0 {
-				log.Printf("Tried fallback variables: %v", fallbackVarNames)
-			}
-			os.Exit(1)
+			logFatal("Required environment variable is not set", "variable", varName, "fallbacks", fallbackVarNames)
 		}
 	}
 	return value
@@ -210,10 +557,28 @@ func getEnvVar(varName string, fallbackVarNames ...string) string {
 
 // Initializes the database based on the API type
 func initDatabase(apiType string) (*OrderService, error) {
-	dbName := getEnvVar("ORDER_DB_NAME")
-
 	switch apiType {
+	case IN_MEMORY_DB_API:
+		return NewOrderService(NewInMemoryOrderRepo()), nil
+	case POSTGRES_DB_API:
+		dbURI := getEnvVar("ORDER_DB_URI")
+		dbName := os.Getenv("ORDER_DB_NAME")
+		dbUsername := os.Getenv("ORDER_DB_USERNAME")
+		dbPassword := os.Getenv("ORDER_DB_PASSWORD")
+		postgresRepo, err := NewPostgresOrderRepo(dbURI, dbName, dbUsername, dbPassword)
+		if err != nil {
+			return nil, err
+		}
+		return NewOrderService(postgresRepo), nil
+	case SQLITE_DB_API:
+		dbPath := getEnvVar("ORDER_DB_PATH")
+		sqliteRepo, err := NewSQLiteOrderRepo(dbPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewOrderService(sqliteRepo), nil
 	case AZURE_COSMOS_DB_SQL_API:
+		dbName := getEnvVar("ORDER_DB_NAME")
 		dbURI := getEnvVar("AZURE_COSMOS_RESOURCEENDPOINT", "ORDER_DB_URI")
 		containerName := getEnvVar("ORDER_DB_CONTAINER_NAME")
 		dbPartitionKey := getEnvVar("ORDER_DB_PARTITION_KEY")
@@ -240,6 +605,7 @@ func initDatabase(apiType string) (*OrderService, error) {
 			return NewOrderService(cosmosRepo), nil
 		}
 	default:
+		dbName := getEnvVar("ORDER_DB_NAME")
 		collectionName := getEnvVar("ORDER_DB_COLLECTION_NAME")
 
 		// check if USE_WORKLOAD_IDENTITY_AUTH is set
@@ -249,7 +615,7 @@ func initDatabase(apiType string) (*OrderService, error) {
 		}
 
 		if useWorkloadIdentityAuth == "true" {
-			log.Printf("Authenticating with Workload Identity")
+			slog.Info("Authenticating with Workload Identity")
 			dbListConnStringsURL := getEnvVar("ORDER_DB_LIST_CONNECTION_STRING_URL")
 			mongoRepo, err := NewMongoDBOrderRepoWithManagedIdentity(dbListConnStringsURL, dbName, collectionName)
 			if err != nil {
@@ -257,7 +623,7 @@ func initDatabase(apiType string) (*OrderService, error) {
 			}
 			return NewOrderService(mongoRepo), nil
 		} else {
-			log.Printf("Authenticating with username and password")
+			slog.Info("Authenticating with username and password")
 			dbURI := getEnvVar("AZURE_COSMOS_RESOURCEENDPOINT", "ORDER_DB_URI")
 			dbUsername := os.Getenv("ORDER_DB_USERNAME")
 			dbPassword := os.Getenv("ORDER_DB_PASSWORD")
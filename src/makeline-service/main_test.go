@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter serves the order endpoints from repo, the way main does once
+// the database is ready
+func newTestRouter(repo OrderRepo) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(OrderMiddleware(NewOrderService(repo)))
+	router.GET("/order/fetch", fetchOrders)
+	router.GET("/orders", listOrders)
+	router.GET("/orders/stream", streamOrders)
+	router.GET("/order/:id", getOrder)
+	router.POST("/order/claim", claimOrders)
+	router.PUT("/order", updateOrder)
+	return router
+}
+
+// serve sends a request to router and records the response
+func serve(router http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// decodeResponse decodes the JSON body of a response into v
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response %q: %s", w.Body.String(), err)
+	}
+}
+
+func TestFetchOrders(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	insertTestOrders(t, repo, testOrder("1", Pending), testOrder("2", Complete), testOrder("3", Pending))
+
+	w := serve(newTestRouter(repo), http.MethodGet, "/order/fetch", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var orders []Order
+	decodeResponse(t, w, &orders)
+	if got, want := orderIDs(orders), []string{"1", "3"}; !slices.Equal(got, want) {
+		t.Errorf("got orders %v, want the pending orders %v", got, want)
+	}
+}
+
+func TestGetOrderHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantOrder  string
+	}{
+		{name: "existing order", path: "/order/2", wantStatus: http.StatusOK, wantOrder: "2"},
+		{name: "id with leading zeros", path: "/order/002", wantStatus: http.StatusOK, wantOrder: "2"},
+		{name: "ulid", path: "/order/01ARZ3NDEKTSV4RRFFQ69G5FAV", wantStatus: http.StatusOK, wantOrder: "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		{name: "lowercase ulid", path: "/order/01arz3ndektsv4rrffq69g5fav", wantStatus: http.StatusOK, wantOrder: "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		{name: "id that isn't a number or a ulid", path: "/order/abc", wantStatus: http.StatusBadRequest},
+		{name: "unknown order", path: "/order/3", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			insertTestOrders(t, repo, testOrder("1", Pending), testOrder("2", Pending), testOrder("01ARZ3NDEKTSV4RRFFQ69G5FAV", Pending))
+
+			w := serve(newTestRouter(repo), http.MethodGet, tt.path, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantOrder == "" {
+				return
+			}
+			var order Order
+			decodeResponse(t, w, &order)
+			if order.OrderID != tt.wantOrder {
+				t.Errorf("got order %s, want %s", order.OrderID, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		// want is the status order 1 is left in
+		want Status
+	}{
+		{name: "status change", body: `{"orderId":"1","status":1}`, wantStatus: http.StatusOK, want: Processing},
+		{name: "cancelled", body: `{"orderId":"1","status":3}`, wantStatus: http.StatusOK, want: Cancelled},
+		{name: "transition the state machine doesn't allow", body: `{"orderId":"1","status":2}`, wantStatus: http.StatusConflict, want: Pending},
+		{name: "unknown status", body: `{"orderId":"1","status":42}`, wantStatus: http.StatusBadRequest, want: Pending},
+		{name: "unknown order", body: `{"orderId":"2","status":1}`, wantStatus: http.StatusNotFound, want: Pending},
+		{name: "id that isn't a number or a ulid", body: `{"orderId":"abc","status":2}`, wantStatus: http.StatusBadRequest, want: Pending},
+		{name: "malformed body", body: `{"orderId":`, wantStatus: http.StatusBadRequest, want: Pending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			insertTestOrders(t, repo, testOrder("1", Pending))
+
+			w := serve(newTestRouter(repo), http.MethodPut, "/order", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			order, err := repo.GetOrder(t.Context(), "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Status != tt.want {
+				t.Errorf("order is in status %d, want %d", order.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderHandlerConflict(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	insertTestOrders(t, repo, testOrder("1", Complete))
+
+	w := serve(newTestRouter(repo), http.MethodPut, "/order", `{"orderId":"1","status":0}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	var body struct {
+		Error           string `json:"error"`
+		OrderID         string `json:"orderId"`
+		CurrentStatus   Status `json:"currentStatus"`
+		RequestedStatus Status `json:"requestedStatus"`
+	}
+	decodeResponse(t, w, &body)
+	if body.OrderID != "1" || body.CurrentStatus != Complete || body.RequestedStatus != Pending {
+		t.Errorf("got order %s moving from %s to %s, want order 1 moving from Complete to Pending", body.OrderID, body.CurrentStatus, body.RequestedStatus)
+	}
+	if body.Error == "" {
+		t.Error("got no error message")
+	}
+}
+
+func TestUpdateOrderHandlerLeaseConflict(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	insertTestOrders(t, repo, testOrder("1", Pending))
+	if _, err := repo.ClaimOrders(t.Context(), "worker-1", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(newTestRouter(repo), http.MethodPut, "/order", `{"orderId":"1","status":2,"workerId":"worker-2"}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	var body struct {
+		Error          string    `json:"error"`
+		OrderID        string    `json:"orderId"`
+		ClaimedBy      string    `json:"claimedBy"`
+		LeaseExpiresAt time.Time `json:"leaseExpiresAt"`
+	}
+	decodeResponse(t, w, &body)
+	if body.OrderID != "1" || body.ClaimedBy != "worker-1" || body.LeaseExpiresAt.IsZero() {
+		t.Errorf("got order %s claimed by %q until %v, want order 1 claimed by worker-1 under a lease", body.OrderID, body.ClaimedBy, body.LeaseExpiresAt)
+	}
+	if body.Error == "" {
+		t.Error("got no error message")
+	}
+
+	w = serve(newTestRouter(repo), http.MethodPut, "/order", `{"orderId":"1","status":2,"workerId":"worker-1"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d for the worker holding the lease, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestUpdateOrderHandlerActor(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "actor header", header: "store-admin", want: "store-admin"},
+		{name: "no actor header", want: "api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			insertTestOrders(t, repo, testOrder("1", Pending))
+
+			req := httptest.NewRequest(http.MethodPut, "/order", strings.NewReader(`{"orderId":"1","status":1}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("X-Actor", tt.header)
+			}
+			newTestRouter(repo).ServeHTTP(httptest.NewRecorder(), req)
+
+			order, err := repo.GetOrder(t.Context(), "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(order.StatusHistory); n != 2 || order.StatusHistory[n-1].Actor != tt.want {
+				t.Errorf("got status history %v, want the move recorded by %s", order.StatusHistory, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimOrdersHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantClaimed int
+	}{
+		{name: "one order by default", body: `{"workerId":"worker-1"}`, wantStatus: http.StatusOK, wantClaimed: 1},
+		{name: "count", body: `{"workerId":"worker-1","count":2,"leaseSeconds":60}`, wantStatus: http.StatusOK, wantClaimed: 2},
+		{name: "more than is pending", body: `{"workerId":"worker-1","count":10}`, wantStatus: http.StatusOK, wantClaimed: 3},
+		{name: "no worker", body: `{"count":1}`, wantStatus: http.StatusBadRequest},
+		{name: "count too large", body: `{"workerId":"worker-1","count":101}`, wantStatus: http.StatusBadRequest},
+		{name: "negative count", body: `{"workerId":"worker-1","count":-1}`, wantStatus: http.StatusBadRequest},
+		{name: "lease too long", body: `{"workerId":"worker-1","leaseSeconds":3601}`, wantStatus: http.StatusBadRequest},
+		{name: "negative lease", body: `{"workerId":"worker-1","leaseSeconds":-1}`, wantStatus: http.StatusBadRequest},
+		{name: "malformed body", body: `{"workerId":`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			insertTestOrders(t, repo, testOrder("1", Pending), testOrder("2", Pending), testOrder("3", Pending))
+
+			w := serve(newTestRouter(repo), http.MethodPost, "/order/claim", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			pending, err := repo.GetPendingOrders(t.Context())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(pending), 3-tt.wantClaimed; got != want {
+				t.Errorf("%d orders are left pending, want %d", got, want)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var claimed []Order
+			decodeResponse(t, w, &claimed)
+			if len(claimed) != tt.wantClaimed {
+				t.Fatalf("got %d claimed orders, want %d", len(claimed), tt.wantClaimed)
+			}
+			for _, order := range claimed {
+				if order.Status != Processing || order.ClaimedBy != "worker-1" {
+					t.Errorf("got order %s in status %s claimed by %q, want Processing claimed by worker-1", order.OrderID, order.Status, order.ClaimedBy)
+				}
+			}
+		})
+	}
+}
+
+func TestClaimOrdersHandlerNothingPending(t *testing.T) {
+	w := serve(newTestRouter(NewInMemoryOrderRepo()), http.MethodPost, "/order/claim", `{"workerId":"worker-1"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Errorf("got body %s, want an empty list", got)
+	}
+}
+
+func TestListOrdersHandler(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	insertTestOrders(t, repo, listTestOrders()...)
+	router := newTestRouter(repo)
+
+	// page through the pending orders, newest first
+	var got []string
+	path := "/orders?status=Pending&sort=-createdAt&limit=2"
+	for range 3 {
+		w := serve(router, http.MethodGet, path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		var page OrderPage
+		decodeResponse(t, w, &page)
+		for _, order := range page.Orders {
+			got = append(got, order.OrderID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		path = "/orders?status=Pending&sort=-createdAt&limit=2&cursor=" + page.NextCursor
+	}
+	if want := []string{"7", "4", "1"}; !slices.Equal(got, want) {
+		t.Errorf("got orders %v, want %v", got, want)
+	}
+}
+
+func TestListOrdersHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "unknown status", path: "/orders?status=Shipped"},
+		{name: "bad limit", path: "/orders?limit=0"},
+		{name: "bad time", path: "/orders?from=yesterday"},
+		{name: "invalid cursor", path: "/orders?cursor=not-a-cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			insertTestOrders(t, repo, listTestOrders()...)
+
+			w := serve(newTestRouter(repo), http.MethodGet, tt.path, "")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			var body struct {
+				Error string `json:"error"`
+			}
+			decodeResponse(t, w, &body)
+			if body.Error == "" {
+				t.Error("got no error message")
+			}
+		})
+	}
+}
+
+func TestListOrdersHandlerEmpty(t *testing.T) {
+	w := serve(newTestRouter(NewInMemoryOrderRepo()), http.MethodGet, "/orders", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var page map[string]any
+	decodeResponse(t, w, &page)
+	if orders, ok := page["orders"].([]any); !ok || len(orders) != 0 {
+		t.Errorf("got orders %v, want an empty list", page["orders"])
+	}
+	if _, ok := page["nextCursor"]; ok {
+		t.Errorf("got a nextCursor on the only page")
+	}
+}
+
+func TestStreamOrders(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	insertTestOrders(t, repo, testOrder("1", Pending))
+	server := httptest.NewServer(newTestRouter(repo))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/orders/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("got content type %s, want text/event-stream", got)
+	}
+
+	// the headers are only sent once the stream is subscribed, so the update
+	// can't be missed
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/order", strings.NewReader(`{"orderId":"1","status":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	update, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update.Body.Close()
+
+	var eventType string
+	var event OrderEvent
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		line := lines.Text()
+		if value, ok := strings.CutPrefix(line, "event:"); ok {
+			eventType = value
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			if err := json.Unmarshal([]byte(value), &event); err != nil {
+				t.Fatalf("failed to decode event %q: %s", value, err)
+			}
+			break
+		}
+	}
+	if eventType != ORDER_STATUS_CHANGED_EVENT || event.Type != ORDER_STATUS_CHANGED_EVENT {
+		t.Errorf("got %q event of type %q, want %s", eventType, event.Type, ORDER_STATUS_CHANGED_EVENT)
+	}
+	if event.Order.OrderID != "1" || event.Order.Status != Processing {
+		t.Errorf("got order %s in status %s, want order 1 in status Processing", event.Order.OrderID, event.Order.Status)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Message transports, as reported in consumer metrics
+const (
+	AMQP_TRANSPORT        = "amqp"
+	SERVICE_BUS_TRANSPORT = "servicebus"
+	KAFKA_TRANSPORT       = "kafka"
+)
+
+// Ways a consumed message can be settled, as reported in consumer metrics
+const (
+	OUTCOME_ACK         = "ack"
+	OUTCOME_DEAD_LETTER = "dead_letter"
+	OUTCOME_RELEASE     = "release"
+)
+
+// PENDING_ORDERS_INTERVAL is how often the pending orders gauge is refreshed
+const PENDING_ORDERS_INTERVAL = 15 * time.Second
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "makeline_consumer_messages_received_total",
+		Help: "Messages received from the order queue.",
+	}, []string{"transport"})
+
+	messagesSettled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "makeline_consumer_messages_settled_total",
+		Help: "Messages settled on the order queue, by outcome.",
+	}, []string{"transport", "outcome"})
+
+	messagesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "makeline_consumer_messages_in_flight",
+		Help: "Messages being processed by the consumer's workers.",
+	}, []string{"transport"})
+
+	lockRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "makeline_consumer_lock_renewals_total",
+		Help: "Message lock renewals on the order queue, by result.",
+	}, []string{"transport", "result"})
+
+	locksLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "makeline_consumer_locks_lost_total",
+		Help: "Messages whose lock expired before they were settled.",
+	}, []string{"transport"})
+
+	outboxEventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "makeline_outbox_events_published_total",
+		Help: "Order lifecycle events published from the outbox, by type.",
+	}, []string{"type"})
+
+	repoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "makeline_repo_operation_duration_seconds",
+		Help:    "Latency of order repository operations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "method", "result"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "makeline_http_requests_total",
+		Help: "HTTP requests handled, by route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "makeline_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	pendingOrders = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "makeline_pending_orders",
+		Help: "Orders waiting to be processed.",
+	})
+)
+
+// registerDBReadyGauge exposes whether the database is ready, as reported by ready
+func registerDBReadyGauge(ready func() bool) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "makeline_db_ready",
+		Help: "Whether the database connection is initialized (1) or not (0).",
+	}, func() float64 {
+		if ready() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// recordSettled counts a message settled by the consumer
+func recordSettled(transport string, outcome string) {
+	messagesSettled.WithLabelValues(transport, outcome).Inc()
+}
+
+// httpMetrics records a count and latency for every request. Requests that
+// match no route are grouped together so scanners can't blow up the number
+// of series.
+func httpMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// runPendingOrdersGauge periodically refreshes the pending orders gauge
+func runPendingOrdersGauge(ctx context.Context, repo OrderRepo) {
+	ticker := time.NewTicker(PENDING_ORDERS_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		count, err := repo.CountPendingOrders(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to count pending orders", errAttr(err))
+		} else {
+			pendingOrders.Set(float64(count))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// InstrumentedOrderRepo records the latency of every call to the repo it
+// wraps, and tags the log lines the repo writes with the backend name
+type InstrumentedOrderRepo struct {
+	repo    OrderRepo
+	backend string
+}
+
+func NewInstrumentedOrderRepo(repo OrderRepo, backend string) *InstrumentedOrderRepo {
+	return &InstrumentedOrderRepo{repo, backend}
+}
+
+// logContext adds the backend to the log attributes on ctx
+func (r *InstrumentedOrderRepo) logContext(ctx context.Context) context.Context {
+	return withLogAttrs(ctx, slog.String(LOG_BACKEND, r.backend))
+}
+
+// observe records how long a call to method took since start
+func (r *InstrumentedOrderRepo) observe(method string, start time.Time, err error) {
+	result := "ok"
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+		result = "not_found"
+	case err != nil:
+		result = "error"
+	}
+	repoDuration.WithLabelValues(r.backend, method, result).Observe(time.Since(start).Seconds())
+}
+
+func (r *InstrumentedOrderRepo) GetPendingOrders(ctx context.Context) (orders []Order, err error) {
+	defer func(start time.Time) { r.observe("GetPendingOrders", start, err) }(time.Now())
+	return r.repo.GetPendingOrders(r.logContext(ctx))
+}
+
+func (r *InstrumentedOrderRepo) CountPendingOrders(ctx context.Context) (count int, err error) {
+	defer func(start time.Time) { r.observe("CountPendingOrders", start, err) }(time.Now())
+	return r.repo.CountPendingOrders(r.logContext(ctx))
+}
+
+func (r *InstrumentedOrderRepo) GetOrder(ctx context.Context, id string) (order Order, err error) {
+	defer func(start time.Time) { r.observe("GetOrder", start, err) }(time.Now())
+	return r.repo.GetOrder(r.logContext(ctx), id)
+}
+
+func (r *InstrumentedOrderRepo) InsertOrders(ctx context.Context, orders []Order) (err error) {
+	defer func(start time.Time) { r.observe("InsertOrders", start, err) }(time.Now())
+	return r.repo.InsertOrders(r.logContext(ctx), orders)
+}
+
+func (r *InstrumentedOrderRepo) UpdateOrder(ctx context.Context, order Order, actor string) (err error) {
+	defer func(start time.Time) { r.observe("UpdateOrder", start, err) }(time.Now())
+	return r.repo.UpdateOrder(r.logContext(ctx), order, actor)
+}
+
+func (r *InstrumentedOrderRepo) ClaimOrders(ctx context.Context, workerID string, count int, ttl time.Duration) (orders []Order, err error) {
+	defer func(start time.Time) { r.observe("ClaimOrders", start, err) }(time.Now())
+	return r.repo.ClaimOrders(r.logContext(ctx), workerID, count, ttl)
+}
+
+func (r *InstrumentedOrderRepo) ReleaseExpiredLeases(ctx context.Context) (released int, err error) {
+	defer func(start time.Time) { r.observe("ReleaseExpiredLeases", start, err) }(time.Now())
+	return r.repo.ReleaseExpiredLeases(r.logContext(ctx))
+}
+
+func (r *InstrumentedOrderRepo) ListOrders(ctx context.Context, query OrderQuery) (page OrderPage, err error) {
+	defer func(start time.Time) { r.observe("ListOrders", start, err) }(time.Now())
+	return r.repo.ListOrders(r.logContext(ctx), query)
+}
+
+func (r *InstrumentedOrderRepo) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { r.observe("Ping", start, err) }(time.Now())
+	return r.repo.Ping(r.logContext(ctx))
+}
+
+func (r *InstrumentedOrderRepo) Close(ctx context.Context) error {
+	return r.repo.Close(ctx)
+}
@@ -4,21 +4,31 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 type MongoDBOrderRepo struct {
 	db *mongo.Collection
+	// uniqueMessageIDs is set when the database enforces unique message ids,
+	// so orders can be inserted without looking for an earlier copy first
+	uniqueMessageIDs bool
+	// outbox is set when lifecycle events are stored in the outbox array of
+	// their order's document
+	outbox bool
 }
 
 func NewMongoDBOrderRepoWithManagedIdentity(listConnectionStringsUrl string, mongoDb string, mongoCollection string) (*MongoDBOrderRepo, error) {
@@ -28,7 +38,7 @@ func NewMongoDBOrderRepoWithManagedIdentity(listConnectionStringsUrl string, mon
 	// get a default azure credential
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
-		log.Printf("failed to get default azure credential: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to get default Azure credential", errAttr(err))
 		return nil, err
 	}
 
@@ -38,14 +48,14 @@ func NewMongoDBOrderRepoWithManagedIdentity(listConnectionStringsUrl string, mon
 	}
 	token, err := cred.GetToken(ctx, opts)
 	if err != nil {
-		log.Printf("failed to get token: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to get token", errAttr(err))
 		return nil, err
 	}
 
 	// create a request to get the connection string
 	req, err := http.NewRequestWithContext(ctx, "POST", listConnectionStringsUrl, nil)
 	if err != nil {
-		log.Printf("failed to create request: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to create request", errAttr(err))
 		return nil, err
 	}
 	req.Header.Add("Authorization", "Bearer "+token.Token)
@@ -53,7 +63,7 @@ func NewMongoDBOrderRepoWithManagedIdentity(listConnectionStringsUrl string, mon
 	// get the connection strings
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("failed to get connection string: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to get connection string", errAttr(err))
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -66,14 +76,14 @@ func NewMongoDBOrderRepoWithManagedIdentity(listConnectionStringsUrl string, mon
 	// read the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("failed to read response body: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to read response body", errAttr(err))
 		return nil, err
 	}
 
 	// parse the response body
 	var responseData map[string]interface{}
 	if err := json.Unmarshal(body, &responseData); err != nil {
-		log.Printf("failed to parse response: %v\n", err)
+		slog.ErrorContext(ctx, "Failed to parse response", errAttr(err))
 		return nil, err
 	}
 
@@ -101,27 +111,27 @@ func NewMongoDBOrderRepoWithManagedIdentity(listConnectionStringsUrl string, mon
 	}
 
 	// create a mongo client with the connection string
-	var clientOptions *options.ClientOptions = options.Client().ApplyURI(connectionString)
+	var clientOptions *options.ClientOptions = options.Client().ApplyURI(connectionString).SetMonitor(otelmongo.NewMonitor())
 	mongoClient, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Printf("failed to connect to mongodb: %s", err)
+		slog.ErrorContext(ctx, "Failed to connect to MongoDB", errAttr(err))
 		return nil, err
 	}
 
 	// ping the database
 	err = mongoClient.Ping(ctx, nil)
 	if err != nil {
-		log.Printf("failed to ping database: %s", err)
+		slog.ErrorContext(ctx, "Failed to ping database", errAttr(err))
 		return nil, err
 	} else {
-		log.Printf("pong from database")
+		slog.Debug("Pong from database")
 	}
 
 	// get a handle for the collection
 	collection := mongoClient.Database(mongoDb).Collection(mongoCollection)
-	//defer collection.Database().Client().Disconnect(context.Background())
+	uniqueMessageIDs := ensureMongoIndexes(ctx, collection)
 
-	return &MongoDBOrderRepo{collection}, nil
+	return &MongoDBOrderRepo{db: collection, uniqueMessageIDs: uniqueMessageIDs}, nil
 }
 
 func NewMongoDBOrderRepo(mongoUri string, mongoDb string, mongoCollection string, mongoUser string, mongoPassword string) (*MongoDBOrderRepo, error) {
@@ -146,41 +156,76 @@ func NewMongoDBOrderRepo(mongoUri string, mongoDb string, mongoCollection string
 			SetTLSConfig(&tls.Config{InsecureSkipVerify: insecure})
 	}
 
+	clientOptions.SetMonitor(otelmongo.NewMonitor())
+
 	mongoClient, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Printf("failed to connect to mongodb: %s", err)
+		slog.ErrorContext(ctx, "Failed to connect to MongoDB", errAttr(err))
 		return nil, err
 	}
 
 	err = mongoClient.Ping(ctx, nil)
 	if err != nil {
-		log.Printf("failed to ping database: %s", err)
+		slog.ErrorContext(ctx, "Failed to ping database", errAttr(err))
 		return nil, err
 	} else {
-		log.Printf("pong from database")
+		slog.Debug("Pong from database")
 	}
 
 	// get a handle for the collection
 	collection := mongoClient.Database(mongoDb).Collection(mongoCollection)
-	//defer collection.Database().Client().Disconnect(context.Background())
+	uniqueMessageIDs := ensureMongoIndexes(ctx, collection)
 
-	return &MongoDBOrderRepo{collection}, nil
+	return &MongoDBOrderRepo{db: collection, uniqueMessageIDs: uniqueMessageIDs}, nil
 }
 
-func (r *MongoDBOrderRepo) GetPendingOrders() ([]Order, error) {
-	ctx := context.TODO()
+// ensureMongoIndexes creates the indexes the repo queries on and reports
+// whether message ids are enforced as unique. Failures are logged rather than
+// returned, since some MongoDB-compatible services restrict index management
+// and the repo still works without them, only slower.
+func ensureMongoIndexes(ctx context.Context, collection *mongo.Collection) bool {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "orderid", Value: 1}}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create orderid index", errAttr(err))
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "outbox.id", Value: 1}}})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create outbox.id index", errAttr(err))
+	}
+
+	// only orders from a message with an id are deduplicated
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "messageid", Value: 1}},
+		Options: options.Index().
+			SetName("messageid_unique").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "messageid", Value: bson.D{
+				{Key: "$exists", Value: true},
+				{Key: "$gt", Value: ""},
+			}}}),
+	})
+	if err != nil {
+		// Azure Cosmos DB for MongoDB (RU) doesn't support partial indexes
+		// and only creates unique indexes on empty collections
+		slog.WarnContext(ctx, "Failed to create unique messageid index, orders are checked for an earlier copy before they are inserted instead", errAttr(err))
+		return false
+	}
+	return true
+}
 
+func (r *MongoDBOrderRepo) GetPendingOrders(ctx context.Context) ([]Order, error) {
 	var orders []Order
 	cursor, err := r.db.Find(ctx, bson.M{"status": Pending})
 	if err != nil {
-		log.Printf("Failed to find records: %s", err)
+		slog.ErrorContext(ctx, "Failed to find records", errAttr(err))
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
 	// Check if there was an error during iteration
 	if err := cursor.Err(); err != nil {
-		log.Printf("Failed to find records: %s", err)
+		slog.ErrorContext(ctx, "Failed to find records", errAttr(err))
 		return nil, err
 	}
 
@@ -188,7 +233,7 @@ func (r *MongoDBOrderRepo) GetPendingOrders() ([]Order, error) {
 	for cursor.Next(ctx) {
 		var pendingOrder Order
 		if err := cursor.Decode(&pendingOrder); err != nil {
-			log.Printf("Failed to decode order: %s", err)
+			slog.ErrorContext(ctx, "Failed to decode order", errAttr(err))
 			return nil, err
 		}
 		orders = append(orders, pendingOrder)
@@ -197,65 +242,536 @@ func (r *MongoDBOrderRepo) GetPendingOrders() ([]Order, error) {
 	return orders, nil
 }
 
-func (r *MongoDBOrderRepo) GetOrder(id string) (Order, error) {
-	var ctx = context.TODO()
+func (r *MongoDBOrderRepo) CountPendingOrders(ctx context.Context) (int, error) {
+	count, err := r.db.CountDocuments(ctx, bson.M{"status": Pending})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to count records", errAttr(err))
+		return 0, err
+	}
+	return int(count), nil
+}
 
+func (r *MongoDBOrderRepo) GetOrder(ctx context.Context, id string) (Order, error) {
 	filter := bson.D{{Key: "orderid", Value: bson.D{{Key: "$eq", Value: id}}}}
 
 	singleResult := r.db.FindOne(ctx, filter)
 
 	var order Order
 	err := singleResult.Decode(&order)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		slog.DebugContext(ctx, "Order not found")
+		return order, ErrOrderNotFound
+	}
 	if err != nil {
-		log.Printf("Failed to decode order: %s", err)
+		slog.ErrorContext(ctx, "Failed to decode order", errAttr(err))
 		return order, err
 	}
 
 	return order, nil
 }
 
-func (r *MongoDBOrderRepo) InsertOrders(orders []Order) error {
-	ctx := context.TODO()
-
-	var ordersInterface []interface{}
+func (r *MongoDBOrderRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	var models []mongo.WriteModel
 	for _, o := range orders {
-		ordersInterface = append(ordersInterface, interface{}(o))
+		// the received event is written with the document, so it is only
+		// recorded for an order that is actually inserted
+		document := mongoOutboxDocument{Order: o}
+		if r.outbox {
+			document.Outbox = []OutboxEvent{newOrderReceivedEvent(o)}
+		}
+
+		// the unique index rejects a second order from the same message
+		if o.MessageID == "" || r.uniqueMessageIDs {
+			models = append(models, mongo.NewInsertOneModel().SetDocument(document))
+			continue
+		}
+
+		// Only insert if no order from this message exists yet. Without the
+		// unique index, two replicas that get the same message at once can
+		// both insert it.
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "messageid", Value: o.MessageID}}).
+			SetUpdate(bson.D{{Key: "$setOnInsert", Value: document}}).
+			SetUpsert(true))
 	}
 
-	if len(ordersInterface) == 0 {
-		log.Printf("No orders to insert into database")
+	if len(models) == 0 {
+		slog.DebugContext(ctx, "No orders to insert into database")
 	} else {
-		// Insert orders
-		insertResult, err := r.db.InsertMany(ctx, ordersInterface)
-		if err != nil {
-			log.Printf("Failed to insert order: %s", err)
+		// Insert orders. The writes are unordered, so an order that was
+		// already ingested doesn't stop the ones after it.
+		writeResult, err := r.db.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil && !onlyDuplicateKeys(err) {
+			slog.ErrorContext(ctx, "Failed to insert order", errAttr(err))
 			return err
 		}
 
-		log.Printf("Inserted %v documents into database\n", len(insertResult.InsertedIDs))
+		inserted := writeResult.InsertedCount + writeResult.UpsertedCount
+		slog.InfoContext(ctx, "Inserted orders into database", "count", inserted)
+		if skipped := int64(len(orders)) - inserted; skipped > 0 {
+			slog.InfoContext(ctx, "Skipped orders that were already ingested", "count", skipped)
+		}
 	}
 	return nil
 }
 
-func (r *MongoDBOrderRepo) UpdateOrder(order Order) error {
-	var ctx = context.TODO()
+// onlyDuplicateKeys reports whether every write of a bulk write failed only
+// because the unique messageid index already holds an order from the same
+// message, so those orders were already ingested
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr.WriteError) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *MongoDBOrderRepo) UpdateOrder(ctx context.Context, order Order, actor string) error {
+	change := newStatusChange(order.Status, actor)
 
 	filter := bson.D{{Key: "orderid", Value: bson.D{{Key: "$eq", Value: order.OrderID}}}}
 
+	current := func() (Order, error) {
+		var existing Order
+		err := r.db.FindOne(ctx, filter).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return existing, ErrOrderNotFound
+		}
+		return existing, err
+	}
+
+	// Only update if the status and lease holder are still the ones the
+	// transition was checked against, and record the events in the same
+	// document update
+	swap := func(from Order) (bool, error) {
+		// an order that isn't claimed has an empty or no claimedby
+		claimedBy := bson.A{from.ClaimedBy}
+		if from.ClaimedBy == "" {
+			claimedBy = append(claimedBy, nil)
+		}
+		updateResult, err := r.db.UpdateOne(
+			ctx,
+			bson.D{
+				{Key: "orderid", Value: bson.D{{Key: "$eq", Value: order.OrderID}}},
+				{Key: "status", Value: from.Status},
+				{Key: "claimedby", Value: bson.D{{Key: "$in", Value: claimedBy}}},
+			},
+			bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "status", Value: order.Status},
+					{Key: "updatedat", Value: change.Timestamp},
+				}},
+				{Key: "$unset", Value: bson.D{
+					{Key: "claimedby", Value: ""},
+					{Key: "leaseexpiresat", Value: ""},
+				}},
+				{Key: "$push", Value: r.pushHistory(change, newStatusChangeEvents(order.OrderID, from.Status, change))},
+			},
+		)
+		if err != nil {
+			return false, err
+		}
+
+		slog.DebugContext(ctx, "Updated orders", "matched", updateResult.MatchedCount, "modified", updateResult.ModifiedCount)
+		return updateResult.MatchedCount > 0, nil
+	}
+
 	// Update the order
-	log.Printf("Updating order: %v", order)
-	updateResult, err := r.db.UpdateMany(
+	slog.DebugContext(ctx, "Updating order", "status", order.Status.String())
+	if err := applyStatusTransition(order.OrderID, order.Status, order.ClaimedBy, current, swap); err != nil {
+		slog.WarnContext(ctx, "Failed to update order", errAttr(err))
+		return err
+	}
+
+	return nil
+}
+
+func (r *MongoDBOrderRepo) ClaimOrders(ctx context.Context, workerID string, count int, ttl time.Duration) ([]Order, error) {
+	change := newStatusChange(Processing, workerID)
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	// Each findOneAndUpdate claims a single order atomically, so concurrent
+	// workers never get the same one
+	var claimed []Order
+	for len(claimed) < count {
+		// the order isn't known until it is claimed; events take the order id
+		// from their document when they are read from the outbox
+		events := newStatusChangeEvents("", Pending, change)
+		update := bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "status", Value: Processing},
+				{Key: "updatedat", Value: change.Timestamp},
+				{Key: "claimedby", Value: workerID},
+				{Key: "leaseexpiresat", Value: change.Timestamp.Add(ttl)},
+			}},
+			{Key: "$push", Value: r.pushHistory(change, events)},
+		}
+
+		var order Order
+		err := r.db.FindOneAndUpdate(ctx, bson.D{{Key: "status", Value: Pending}}, update, opts).Decode(&order)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to claim order", errAttr(err))
+			return claimed, err
+		}
+		claimed = append(claimed, order)
+	}
+
+	slog.InfoContext(ctx, "Claimed orders", "count", len(claimed), "workerId", workerID)
+	return claimed, nil
+}
+
+func (r *MongoDBOrderRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	// Orders that were never claimed store the zero time, which must not count
+	// as an expired lease
+	change := newStatusChange(Pending, LEASE_EXPIRED_ACTOR)
+	filter := bson.D{
+		{Key: "status", Value: Processing},
+		{Key: "leaseexpiresat", Value: bson.D{
+			{Key: "$gt", Value: time.Time{}},
+			{Key: "$lt", Value: change.Timestamp},
+		}},
+	}
+
+	// Orders are released one at a time, so each gets lifecycle events with
+	// their own ids
+	var released int
+	for {
+		events := newStatusChangeEvents("", Processing, change)
+		update := bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "status", Value: Pending},
+				{Key: "updatedat", Value: change.Timestamp},
+			}},
+			{Key: "$unset", Value: bson.D{
+				{Key: "claimedby", Value: ""},
+				{Key: "leaseexpiresat", Value: ""},
+			}},
+			{Key: "$push", Value: r.pushHistory(change, events)},
+		}
+		updateResult, err := r.db.UpdateOne(ctx, filter, update)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to release expired leases", errAttr(err))
+			return released, err
+		}
+		if updateResult.ModifiedCount == 0 {
+			return released, nil
+		}
+		released++
+	}
+}
+
+func (r *MongoDBOrderRepo) EnableOutbox() {
+	r.outbox = true
+}
+
+// ClaimOutboxEvents claims the oldest documents with events for the relay,
+// so the events of a document are published by one relay at a time. Documents
+// the relay already claimed are claimed again, which renews the claim.
+func (r *MongoDBOrderRepo) ClaimOutboxEvents(ctx context.Context, relayID string, limit int) ([]OutboxEvent, error) {
+	now := time.Now().UTC()
+	// a document never claimed has no claim expiry, which $not matches too
+	claimable := bson.D{
+		{Key: "outbox.id", Value: bson.D{{Key: "$exists", Value: true}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "outboxclaimedby", Value: relayID}},
+			bson.D{{Key: "outboxclaimexpiresat", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: now}}}}}},
+		}},
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetProjection(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := r.db.Find(ctx, claimable, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find outbox events", errAttr(err))
+		return nil, err
+	}
+	var candidates []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &candidates); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode outbox events", errAttr(err))
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	ids := make(bson.A, len(candidates))
+	for i, candidate := range candidates {
+		ids[i] = candidate.ID
+	}
+
+	// the filter is checked again as each document is updated, so a document
+	// another relay claimed in the meantime is left to it
+	_, err = r.db.UpdateMany(
+		ctx,
+		append(claimable, bson.E{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}),
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "outboxclaimedby", Value: relayID},
+			{Key: "outboxclaimexpiresat", Value: now.Add(OUTBOX_CLAIM_TTL)},
+		}}},
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to claim outbox events", errAttr(err))
+		return nil, err
+	}
+
+	opts = options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetProjection(bson.D{{Key: "orderid", Value: 1}, {Key: "outbox", Value: 1}})
+	cursor, err = r.db.Find(ctx, bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}},
+		{Key: "outboxclaimedby", Value: relayID},
+	}, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find outbox events", errAttr(err))
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var documents []mongoOutboxDocument
+	if err := cursor.All(ctx, &documents); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode outbox events", errAttr(err))
+		return nil, err
+	}
+
+	var events []OutboxEvent
+	for _, document := range documents {
+		for _, event := range document.Outbox {
+			if len(events) == limit {
+				return events, nil
+			}
+			event.OrderID = document.OrderID
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (r *MongoDBOrderRepo) DeleteOutboxEvents(ctx context.Context, ids []string) error {
+	_, err := r.db.UpdateMany(
 		ctx,
-		filter,
+		bson.D{{Key: "outbox.id", Value: bson.D{{Key: "$in", Value: ids}}}},
 		bson.D{
-			{Key: "$set", Value: bson.D{{Key: "status", Value: order.Status}}},
+			{Key: "$pull", Value: bson.D{
+				{Key: "outbox", Value: bson.D{{Key: "id", Value: bson.D{{Key: "$in", Value: ids}}}}},
+			}},
+			// events added since the claim are left to whichever relay claims
+			// them next
+			{Key: "$unset", Value: bson.D{
+				{Key: "outboxclaimedby", Value: ""},
+				{Key: "outboxclaimexpiresat", Value: ""},
+			}},
 		},
 	)
 	if err != nil {
-		log.Printf("Failed to update order: %s", err)
+		slog.ErrorContext(ctx, "Failed to delete outbox events", errAttr(err))
+	}
+	return err
+}
+
+// pushHistory appends a status change to the order's history, and its events
+// to the order's outbox if enabled, in the same document update
+func (r *MongoDBOrderRepo) pushHistory(change StatusChange, events []OutboxEvent) bson.D {
+	push := bson.D{{Key: "statushistory", Value: change}}
+	if r.outbox {
+		push = append(push, bson.E{Key: "outbox", Value: bson.D{{Key: "$each", Value: events}}})
+	}
+	return push
+}
+
+// mongoOutboxDocument is an order together with the lifecycle events waiting
+// to be published for it. A single document is written atomically, so the
+// events are stored with the change they describe without a transaction.
+type mongoOutboxDocument struct {
+	Order  `bson:",inline"`
+	Outbox []OutboxEvent `bson:"outbox,omitempty"`
+}
+
+// mongoOrderDocument is an order together with its document id, which
+// ListOrders uses as the sort key and cursor
+type mongoOrderDocument struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	Order `bson:",inline"`
+}
+
+func (r *MongoDBOrderRepo) ListOrders(ctx context.Context, query OrderQuery) (OrderPage, error) {
+	// Object ids start with their creation time, so sorting by _id follows
+	// insertion order
+	direction, after := 1, "$gt"
+	if query.Descending {
+		direction, after = -1, "$lt"
+	}
+
+	filter := bson.D{}
+	if query.Cursor != "" {
+		position, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return OrderPage{}, err
+		}
+		lastID, err := primitive.ObjectIDFromHex(position)
+		if err != nil {
+			return OrderPage{}, ErrInvalidCursor
+		}
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: after, Value: lastID}}})
+	}
+	if len(query.Statuses) > 0 {
+		filter = append(filter, bson.E{Key: "status", Value: bson.D{{Key: "$in", Value: query.Statuses}}})
+	}
+	if query.CustomerID != "" {
+		filter = append(filter, bson.E{Key: "customerid", Value: query.CustomerID})
+	}
+	if query.ProductID != 0 {
+		filter = append(filter, bson.E{Key: "items.product", Value: query.ProductID})
+	}
+	createdAt := bson.D{}
+	if !query.CreatedFrom.IsZero() {
+		createdAt = append(createdAt, bson.E{Key: "$gte", Value: query.CreatedFrom})
+	}
+	if !query.CreatedTo.IsZero() {
+		createdAt = append(createdAt, bson.E{Key: "$lt", Value: query.CreatedTo})
+	}
+	if len(createdAt) > 0 {
+		filter = append(filter, bson.E{Key: "createdat", Value: createdAt})
+	}
+
+	// fetch one extra document to know whether there is another page
+	limit := query.PageSize()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: direction}}).
+		SetLimit(int64(limit + 1))
+
+	cursor, err := r.db.Find(ctx, filter, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find records", errAttr(err))
+		return OrderPage{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var documents []mongoOrderDocument
+	if err := cursor.All(ctx, &documents); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode order", errAttr(err))
+		return OrderPage{}, err
+	}
+
+	page := OrderPage{Orders: []Order{}}
+	if len(documents) > limit {
+		documents = documents[:limit]
+		page.NextCursor = encodeCursor(documents[len(documents)-1].ID.Hex())
+	}
+	for _, document := range documents {
+		page.Orders = append(page.Orders, document.Order)
+	}
+
+	return page, nil
+}
+
+func (r *MongoDBOrderRepo) Ping(ctx context.Context) error {
+	return r.db.Database().Client().Ping(ctx, nil)
+}
+
+func (r *MongoDBOrderRepo) Close(ctx context.Context) error {
+	return r.db.Database().Client().Disconnect(ctx)
+}
+
+// WatchOrders publishes order inserts and status changes from a MongoDB change
+// stream, so every replica sees the changes made by all of them. Change
+// streams need a replica set. The stream resumes where it left off after an
+// error.
+func (r *MongoDBOrderRepo) WatchOrders(ctx context.Context, events *EventBus) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"insert", "update"}}}},
+		}}},
+	}
+
+	var resumeToken bson.Raw
+	for {
+		opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+		if resumeToken != nil {
+			opts.SetResumeAfter(resumeToken)
+		}
+
+		err := r.watchOrders(ctx, pipeline, opts, events, &resumeToken)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Order change stream error, resuming in 5s", errAttr(err))
+		} else {
+			slog.WarnContext(ctx, "Order change stream closed, resuming in 5s")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// watchOrders runs one change stream until it fails, keeping resumeToken up
+// to date with the last change seen
+func (r *MongoDBOrderRepo) watchOrders(ctx context.Context, pipeline mongo.Pipeline, opts *options.ChangeStreamOptions, events *EventBus, resumeToken *bson.Raw) error {
+	stream, err := r.db.Watch(ctx, pipeline, opts)
+	if err != nil {
 		return err
 	}
+	defer stream.Close(context.Background())
 
-	log.Printf("Matched %v documents and updated %v documents.\n", updateResult.MatchedCount, updateResult.ModifiedCount)
-	return nil
+	slog.InfoContext(ctx, "Watching order changes")
+
+	for stream.Next(ctx) {
+		*resumeToken = stream.ResumeToken()
+
+		var change struct {
+			OperationType     string    `bson:"operationType"`
+			WallTime          time.Time `bson:"wallTime"`
+			FullDocument      *Order    `bson:"fullDocument"`
+			UpdateDescription struct {
+				UpdatedFields bson.M `bson:"updatedFields"`
+			} `bson:"updateDescription"`
+		}
+		if err := stream.Decode(&change); err != nil {
+			slog.ErrorContext(ctx, "Failed to decode order change", errAttr(err))
+			continue
+		}
+
+		// the order was deleted before the update could be looked up
+		if change.FullDocument == nil {
+			continue
+		}
+
+		event := OrderEvent{Order: *change.FullDocument, Timestamp: change.WallTime}
+		switch change.OperationType {
+		case "insert":
+			event.Type = ORDER_CREATED_EVENT
+		case "update":
+			if _, ok := change.UpdateDescription.UpdatedFields["status"]; !ok {
+				continue
+			}
+			event.Type = ORDER_STATUS_CHANGED_EVENT
+		default:
+			continue
+		}
+		// servers before MongoDB 6.0 don't report wallTime
+		if event.Timestamp.IsZero() {
+			event.Timestamp = time.Now().UTC()
+		}
+
+		events.Publish(event)
+	}
+
+	return stream.Err()
 }
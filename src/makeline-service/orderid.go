@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Valid order ID generator types
+const (
+	SNOWFLAKE_ORDER_ID = "snowflake"
+	ULID_ORDER_ID      = "ulid"
+)
+
+var errInvalidOrderID = errors.New("order id must be numeric or a ULID")
+
+// OrderIDGenerator hands out unique IDs for orders read off the queue
+type OrderIDGenerator interface {
+	NextID() (string, error)
+}
+
+// NewOrderIDGenerator returns the generator selected by ORDER_ID_GENERATOR.
+// ULIDs are the default because they need no per-replica configuration to
+// stay unique.
+func NewOrderIDGenerator() (OrderIDGenerator, error) {
+	switch os.Getenv("ORDER_ID_GENERATOR") {
+	case "", ULID_ORDER_ID:
+		slog.Info("Using ULID order IDs")
+		return NewULIDGenerator(), nil
+	case SNOWFLAKE_ORDER_ID:
+		nodeID, err := snowflakeNodeID()
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Using snowflake order IDs", "nodeId", nodeID)
+		return NewSnowflakeGenerator(nodeID)
+	default:
+		return nil, fmt.Errorf("unknown ORDER_ID_GENERATOR: %s", os.Getenv("ORDER_ID_GENERATOR"))
+	}
+}
+
+// parseOrderID validates an order ID received over HTTP and returns it in its
+// canonical form, so only IDs this service could have generated reach the repo
+func parseOrderID(raw string) (string, error) {
+	if id, err := strconv.ParseInt(raw, 10, 64); err == nil && id >= 0 {
+		return strconv.FormatInt(id, 10), nil
+	}
+	if id, err := ulid.ParseStrict(raw); err == nil {
+		return id.String(), nil
+	}
+	return "", errInvalidOrderID
+}
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNode      = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+// snowflakeEpoch is the zero point for snowflake timestamps
+var snowflakeEpoch = time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// SnowflakeGenerator builds 63-bit IDs from a millisecond timestamp, a node ID
+// and a per-millisecond sequence. IDs are unique across replicas as long as
+// every replica has its own node ID.
+type SnowflakeGenerator struct {
+	mu       sync.Mutex
+	nodeID   int64
+	lastTime int64
+	sequence int64
+}
+
+func NewSnowflakeGenerator(nodeID int64) (*SnowflakeGenerator, error) {
+	if nodeID < 0 || nodeID > snowflakeMaxNode {
+		return nil, fmt.Errorf("snowflake node id must be between 0 and %d", snowflakeMaxNode)
+	}
+	return &SnowflakeGenerator{nodeID: nodeID}, nil
+}
+
+func (g *SnowflakeGenerator) NextID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Since(snowflakeEpoch).Milliseconds()
+
+	// never go backwards, even if the wall clock does
+	if now < g.lastTime {
+		now = g.lastTime
+	}
+
+	if now == g.lastTime {
+		g.sequence = (g.sequence + 1) & snowflakeMaxSequence
+		if g.sequence == 0 {
+			// sequence exhausted for this millisecond, borrow the next one
+			now++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastTime = now
+
+	id := now<<(snowflakeNodeBits+snowflakeSequenceBits) | g.nodeID<<snowflakeSequenceBits | g.sequence
+	return strconv.FormatInt(id, 10), nil
+}
+
+// snowflakeNodeID reads the node ID from ORDER_ID_NODE. There is no default,
+// as replicas that share a node ID hand out the same order IDs.
+func snowflakeNodeID() (int64, error) {
+	value := os.Getenv("ORDER_ID_NODE")
+	if value == "" {
+		return 0, errors.New("ORDER_ID_NODE must be set to a node ID no other replica uses, or ORDER_ID_GENERATOR to ulid")
+	}
+	nodeID, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ORDER_ID_NODE: %w", err)
+	}
+	return nodeID, nil
+}
+
+// ULIDGenerator builds lexicographically sortable IDs that are monotonic
+// within the same millisecond
+type ULIDGenerator struct {
+	mu      sync.Mutex
+	entropy *ulid.MonotonicEntropy
+}
+
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{entropy: ulid.Monotonic(rand.Reader, 0)}
+}
+
+func (g *ULIDGenerator) NextID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id, err := ulid.New(ulid.Timestamp(time.Now()), g.entropy)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
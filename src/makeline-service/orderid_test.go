@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestParseOrderID(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{name: "numeric", raw: "42", want: "42"},
+		{name: "leading zeros", raw: "0042", want: "42"},
+		{name: "zero", raw: "0", want: "0"},
+		{name: "snowflake", raw: "7262083315236864001", want: "7262083315236864001"},
+		{name: "ulid", raw: "01ARZ3NDEKTSV4RRFFQ69G5FAV", want: "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		{name: "lowercase ulid", raw: "01arz3ndektsv4rrffq69g5fav", want: "01ARZ3NDEKTSV4RRFFQ69G5FAV"},
+		{name: "negative", raw: "-1", wantErr: true},
+		{name: "empty", raw: "", wantErr: true},
+		{name: "too large", raw: "99999999999999999999", wantErr: true},
+		{name: "ulid with invalid character", raw: "01ARZ3NDEKTSV4RRFFQ69G5FAU", wantErr: true},
+		{name: "injection", raw: `{"$ne": null}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOrderID(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewOrderIDGenerator(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator string
+		node      string
+		want      string
+		wantErr   bool
+	}{
+		{name: "default", want: "*main.ULIDGenerator"},
+		{name: "ulid", generator: ULID_ORDER_ID, want: "*main.ULIDGenerator"},
+		{name: "snowflake", generator: SNOWFLAKE_ORDER_ID, node: "3", want: "*main.SnowflakeGenerator"},
+		{name: "snowflake without a node id", generator: SNOWFLAKE_ORDER_ID, wantErr: true},
+		{name: "snowflake with a node id that isn't a number", generator: SNOWFLAKE_ORDER_ID, node: "pod-1", wantErr: true},
+		{name: "snowflake with a node id out of range", generator: SNOWFLAKE_ORDER_ID, node: "1024", wantErr: true},
+		{name: "unknown generator", generator: "uuid", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ORDER_ID_GENERATOR", tt.generator)
+			t.Setenv("ORDER_ID_NODE", tt.node)
+
+			got, err := NewOrderIDGenerator()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got a %T, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%T", got); got != tt.want {
+				t.Errorf("got a %s, want a %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderIDGenerators(t *testing.T) {
+	snowflake, err := NewSnowflakeGenerator(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generators := []struct {
+		name string
+		ids  OrderIDGenerator
+		less func(a, b string) bool
+	}{
+		{name: "snowflake", ids: snowflake, less: func(a, b string) bool {
+			x, _ := strconv.ParseInt(a, 10, 64)
+			y, _ := strconv.ParseInt(b, 10, 64)
+			return x < y
+		}},
+		{name: "ulid", ids: NewULIDGenerator(), less: func(a, b string) bool { return a < b }},
+	}
+
+	for _, g := range generators {
+		t.Run(g.name, func(t *testing.T) {
+			// enough IDs to run through a snowflake sequence more than once
+			const n = 10000
+			seen := make(map[string]bool, n)
+			var last string
+			for range n {
+				id, err := g.ids.NextID()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seen[id] {
+					t.Fatalf("got id %s twice", id)
+				}
+				seen[id] = true
+				if _, err := parseOrderID(id); err != nil {
+					t.Fatalf("generated id %s is rejected: %s", id, err)
+				}
+				if last != "" && !g.less(last, id) {
+					t.Fatalf("got id %s after %s, want increasing ids", id, last)
+				}
+				last = id
+			}
+		})
+	}
+}
+
+func TestSnowflakeNodeIDs(t *testing.T) {
+	a, err := NewSnowflakeGenerator(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSnowflakeGenerator(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replicas with different node ids never hand out the same id, even in
+	// the same millisecond
+	seen := map[string]bool{}
+	for range 1000 {
+		for _, g := range []*SnowflakeGenerator{a, b} {
+			id, err := g.NextID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[id] {
+				t.Fatalf("got id %s twice", id)
+			}
+			seen[id] = true
+		}
+	}
+
+	for _, nodeID := range []int64{-1, snowflakeMaxNode + 1} {
+		if _, err := NewSnowflakeGenerator(nodeID); err == nil {
+			t.Errorf("got a generator for node id %d, want an error", nodeID)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_PAGE_SIZE is the number of orders returned when no limit is given
+	DEFAULT_PAGE_SIZE = 50
+	// MAX_PAGE_SIZE caps the number of orders returned in one page
+	MAX_PAGE_SIZE = 500
+)
+
+// ErrInvalidCursor is returned when a page cursor was not issued by the repo
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// OrderQuery filters, sorts and pages an order listing. Zero values mean no
+// filter on that field.
+type OrderQuery struct {
+	Statuses   []Status
+	CustomerID string
+	// ProductID matches orders with at least one item for the product
+	ProductID int
+	// CreatedFrom is inclusive and CreatedTo is exclusive
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// Orders are sorted by creation time, oldest first unless Descending
+	Descending bool
+	Limit      int
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+}
+
+// OrderPage is one page of an order listing. NextCursor is empty on the last page.
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+// Matches reports whether o passes the query's filters. Repos that can't
+// filter in the database use it directly.
+func (q OrderQuery) Matches(o Order) bool {
+	if len(q.Statuses) > 0 && !slices.Contains(q.Statuses, o.Status) {
+		return false
+	}
+	if q.CustomerID != "" && o.CustomerID != q.CustomerID {
+		return false
+	}
+	if q.ProductID != 0 && !slices.ContainsFunc(o.Items, func(i Item) bool { return i.Product == q.ProductID }) {
+		return false
+	}
+	if !q.CreatedFrom.IsZero() && o.CreatedAt.Before(q.CreatedFrom) {
+		return false
+	}
+	if !q.CreatedTo.IsZero() && !o.CreatedAt.Before(q.CreatedTo) {
+		return false
+	}
+	return true
+}
+
+// parseOrderQuery reads the query string of GET /orders. Statuses may be given
+// by number or name, repeated or comma separated. Dates are RFC 3339.
+func parseOrderQuery(values url.Values) (OrderQuery, error) {
+	var query OrderQuery
+
+	for _, value := range values["status"] {
+		for _, raw := range strings.Split(value, ",") {
+			status, err := parseStatus(strings.TrimSpace(raw))
+			if err != nil {
+				return query, err
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+
+	query.CustomerID = values.Get("customerId")
+
+	if raw := values.Get("productId"); raw != "" {
+		productID, err := strconv.Atoi(raw)
+		if err != nil || productID <= 0 {
+			return query, fmt.Errorf("invalid productId %q", raw)
+		}
+		query.ProductID = productID
+	}
+
+	for name, target := range map[string]*time.Time{"from": &query.CreatedFrom, "to": &query.CreatedTo} {
+		if raw := values.Get(name); raw != "" {
+			t, err := time.Parse(time.RFC3339Nano, raw)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s %q, expected an RFC 3339 time", name, raw)
+			}
+			*target = t
+		}
+	}
+
+	switch values.Get("sort") {
+	case "", "createdAt":
+	case "-createdAt":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("invalid sort %q, expected createdAt or -createdAt", values.Get("sort"))
+	}
+
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > MAX_PAGE_SIZE {
+			return query, fmt.Errorf("limit must be between 1 and %d", MAX_PAGE_SIZE)
+		}
+		query.Limit = limit
+	}
+
+	query.Cursor = values.Get("cursor")
+	return query, nil
+}
+
+// parseStatus accepts a status number or a case insensitive status name
+func parseStatus(raw string) (Status, error) {
+	if n, err := strconv.Atoi(raw); err == nil {
+		if status := Status(n); status.Valid() {
+			return status, nil
+		}
+	}
+	for status, name := range statusNames {
+		if strings.EqualFold(name, raw) {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown status %q", raw)
+}
+
+// PageSize returns the query's limit, defaulted and capped
+func (q OrderQuery) PageSize() int {
+	if q.Limit <= 0 {
+		return DEFAULT_PAGE_SIZE
+	}
+	return min(q.Limit, MAX_PAGE_SIZE)
+}
+
+// encodeCursor wraps a repo specific position so it is opaque and URL safe
+func encodeCursor(position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// decodeCursor unwraps a cursor made by encodeCursor
+func decodeCursor(cursor string) (string, error) {
+	position, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(position), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseOrderQuery(t *testing.T) {
+	from := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		query   string
+		want    OrderQuery
+		wantErr bool
+	}{
+		{name: "no parameters", query: ""},
+		{name: "status by number", query: "status=1", want: OrderQuery{Statuses: []Status{Processing}}},
+		{name: "status by name", query: "status=onhold", want: OrderQuery{Statuses: []Status{OnHold}}},
+		{name: "comma separated statuses", query: "status=Pending,%20Failed", want: OrderQuery{Statuses: []Status{Pending, Failed}}},
+		{name: "repeated status", query: "status=Pending&status=2", want: OrderQuery{Statuses: []Status{Pending, Complete}}},
+		{name: "customer and product", query: "customerId=c1&productId=7", want: OrderQuery{CustomerID: "c1", ProductID: 7}},
+		{name: "time range", query: "from=2024-05-01T12:00:00Z&to=2024-05-01T14:00:00%2B02:00", want: OrderQuery{CreatedFrom: from, CreatedTo: from}},
+		{name: "newest first", query: "sort=-createdAt", want: OrderQuery{Descending: true}},
+		{name: "oldest first", query: "sort=createdAt"},
+		{name: "limit and cursor", query: "limit=20&cursor=abc", want: OrderQuery{Limit: 20, Cursor: "abc"}},
+		{name: "unknown status", query: "status=Shipped", wantErr: true},
+		{name: "status number out of range", query: "status=42", wantErr: true},
+		{name: "product that isn't a number", query: "productId=abc", wantErr: true},
+		{name: "product zero", query: "productId=0", wantErr: true},
+		{name: "time that isn't RFC 3339", query: "from=2024-05-01", wantErr: true},
+		{name: "unknown sort", query: "sort=customerId", wantErr: true},
+		{name: "limit zero", query: "limit=0", wantErr: true},
+		{name: "limit too large", query: fmt.Sprintf("limit=%d", MAX_PAGE_SIZE+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseOrderQuery(values)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.Statuses, tt.want.Statuses) || got.CustomerID != tt.want.CustomerID || got.ProductID != tt.want.ProductID ||
+				!got.CreatedFrom.Equal(tt.want.CreatedFrom) || !got.CreatedTo.Equal(tt.want.CreatedTo) ||
+				got.Descending != tt.want.Descending || got.Limit != tt.want.Limit || got.Cursor != tt.want.Cursor {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// listTestOrders are created a minute apart, starting at listTestStart, so
+// their order IDs sort the same as their creation times
+var listTestStart = time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+func listTestOrders() []Order {
+	statuses := []Status{Pending, Processing, Complete, Pending, OnHold, Complete, Pending}
+	var orders []Order
+	for i, status := range statuses {
+		order := testOrder(fmt.Sprint(i+1), status)
+		order.CustomerID = fmt.Sprintf("customer-%d", i%2)
+		order.Items = []Item{{Product: i%3 + 1, Quantity: 1, Price: 10}}
+		order.CreatedAt = listTestStart.Add(time.Duration(i) * time.Minute)
+		order.UpdatedAt = order.CreatedAt
+		orders = append(orders, order)
+	}
+	return orders
+}
+
+func TestListOrders(t *testing.T) {
+	tests := []struct {
+		name  string
+		query OrderQuery
+		// want is every order the query lists, in order, across all pages
+		want []string
+	}{
+		{name: "everything", want: []string{"1", "2", "3", "4", "5", "6", "7"}},
+		{name: "newest first", query: OrderQuery{Descending: true}, want: []string{"7", "6", "5", "4", "3", "2", "1"}},
+		{name: "one status", query: OrderQuery{Statuses: []Status{Pending}}, want: []string{"1", "4", "7"}},
+		{name: "several statuses", query: OrderQuery{Statuses: []Status{Complete, OnHold}}, want: []string{"3", "5", "6"}},
+		{name: "customer", query: OrderQuery{CustomerID: "customer-1"}, want: []string{"2", "4", "6"}},
+		{name: "product", query: OrderQuery{ProductID: 2}, want: []string{"2", "5"}},
+		{name: "time range", query: OrderQuery{CreatedFrom: listTestStart.Add(2 * time.Minute), CreatedTo: listTestStart.Add(5 * time.Minute)}, want: []string{"3", "4", "5"}},
+		{name: "filters combined", query: OrderQuery{Statuses: []Status{Pending}, CustomerID: "customer-0"}, want: []string{"1", "7"}},
+		{name: "nothing matches", query: OrderQuery{CustomerID: "customer-2"}, want: []string{}},
+		{name: "pages", query: OrderQuery{Limit: 2}, want: []string{"1", "2", "3", "4", "5", "6", "7"}},
+		{name: "pages that divide evenly", query: OrderQuery{Statuses: []Status{Pending, Processing, Complete}, Limit: 3}, want: []string{"1", "2", "3", "4", "6", "7"}},
+		{name: "pages newest first", query: OrderQuery{Descending: true, Limit: 3}, want: []string{"7", "6", "5", "4", "3", "2", "1"}},
+		{name: "filtered pages", query: OrderQuery{Statuses: []Status{Pending}, Limit: 1}, want: []string{"1", "4", "7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				insertTestOrders(t, repo, listTestOrders()...)
+
+				got := []string{}
+				query := tt.query
+				for range len(tt.want) + 1 {
+					page, err := repo.ListOrders(t.Context(), query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(page.Orders) > query.PageSize() {
+						t.Fatalf("got a page of %d orders, want at most %d", len(page.Orders), query.PageSize())
+					}
+					for _, order := range page.Orders {
+						got = append(got, order.OrderID)
+					}
+					if page.NextCursor == "" {
+						break
+					}
+					query.Cursor = page.NextCursor
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("got orders %v, want %v", got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestListOrdersInvalidCursor(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+		insertTestOrders(t, repo, listTestOrders()...)
+
+		for _, cursor := range []string{"not base64!", encodeCursor("not a position")} {
+			if _, err := repo.ListOrders(t.Context(), OrderQuery{Cursor: cursor}); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("got %v for cursor %q, want %v", err, cursor, ErrInvalidCursor)
+			}
+		}
+	})
+}
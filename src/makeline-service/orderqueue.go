@@ -2,25 +2,31 @@ package main
 
 import (
 	"encoding/json"
-	"log"
-	"math/rand"
-	"strconv"
+	"fmt"
 )
 
-func unmarshalOrderFromQueue(data []byte) (Order, error) {
+func unmarshalOrderFromQueue(data []byte, ids OrderIDGenerator) (Order, error) {
 	var order Order
 
 	err := json.Unmarshal(data, &order)
 	if err != nil {
-		log.Printf("failed to unmarshal order: %v\n", err)
-		return Order{}, err
+		return Order{}, fmt.Errorf("failed to unmarshal order: %w", err)
 	}
 
 	// add orderkey to order
-	order.OrderID = strconv.Itoa(rand.Intn(100000))
+	order.OrderID, err = ids.NextID()
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to generate order id: %w", err)
+	}
 
 	// set the status to pending
 	order.Status = Pending
 
+	// start the status history
+	received := newStatusChange(Pending, SYSTEM_ACTOR)
+	order.CreatedAt = received.Timestamp
+	order.UpdatedAt = received.Timestamp
+	order.StatusHistory = []StatusChange{received}
+
 	return order, nil
 }
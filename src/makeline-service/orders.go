@@ -1,10 +1,54 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrOrderNotFound is returned when no order matches the requested order ID
+var ErrOrderNotFound = errors.New("order not found")
+
+// ErrInvalidStatus is returned when an order is updated to an unknown status
+var ErrInvalidStatus = errors.New("invalid order status")
+
+// ErrConcurrentUpdate is returned when an order kept changing while a status
+// transition was being applied to it
+var ErrConcurrentUpdate = errors.New("order was modified concurrently")
+
 type Order struct {
 	OrderID    string `json:"orderId"`
 	CustomerID string `json:"customerId"`
 	Items      []Item `json:"items"`
 	Status     Status `json:"status"`
+	// MessageID identifies the queue message the order was read from. Repos
+	// skip orders whose MessageID has already been stored, which makes
+	// redelivered messages safe to insert again.
+	MessageID string `json:"messageId,omitempty"`
+	// CreatedAt and UpdatedAt are zero for orders stored before they were tracked
+	CreatedAt     time.Time      `json:"createdAt,omitzero"`
+	UpdatedAt     time.Time      `json:"updatedAt,omitzero"`
+	StatusHistory []StatusChange `json:"statusHistory,omitempty"`
+	// ClaimedBy and LeaseExpiresAt are set while a worker holds the order
+	// through ClaimOrders
+	ClaimedBy      string    `json:"claimedBy,omitempty"`
+	LeaseExpiresAt time.Time `json:"leaseExpiresAt,omitzero"`
+}
+
+// StatusChange is an entry in an order's append-only status history
+type StatusChange struct {
+	Status    Status    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+}
+
+// SYSTEM_ACTOR is recorded for status changes made by the service itself
+const SYSTEM_ACTOR = "makeline-service"
+
+// newStatusChange records a move to status by actor at the current time
+func newStatusChange(status Status, actor string) StatusChange {
+	return StatusChange{Status: status, Timestamp: time.Now().UTC(), Actor: actor}
 }
 
 type Status int
@@ -13,8 +57,111 @@ const (
 	Pending Status = iota
 	Processing
 	Complete
+	Cancelled
+	OnHold
+	Failed
 )
 
+var statusNames = map[Status]string{
+	Pending:    "Pending",
+	Processing: "Processing",
+	Complete:   "Complete",
+	Cancelled:  "Cancelled",
+	OnHold:     "OnHold",
+	Failed:     "Failed",
+}
+
+// statusTransitions lists the statuses each status may move to. Complete and
+// Cancelled are terminal. Moving to the current status is always allowed and
+// is a no-op.
+var statusTransitions = map[Status][]Status{
+	Pending:    {Processing, OnHold, Cancelled},
+	Processing: {Pending, Complete, OnHold, Failed, Cancelled},
+	OnHold:     {Pending, Processing, Cancelled},
+	Failed:     {Pending, Cancelled},
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Valid reports whether s is a known status
+func (s Status) Valid() bool {
+	_, ok := statusNames[s]
+	return ok
+}
+
+// CanTransitionTo reports whether an order in status s may move to next
+func (s Status) CanTransitionTo(next Status) bool {
+	if s == next {
+		return true
+	}
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned when an order cannot move from its current
+// status to the requested one
+type TransitionError struct {
+	OrderID string
+	From    Status
+	To      Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %s cannot move from %s to %s", e.OrderID, e.From, e.To)
+}
+
+// maxTransitionAttempts bounds how often a status change is retried when the
+// order is modified between reading and updating it
+const maxTransitionAttempts = 3
+
+// applyStatusTransition validates a status change against the state machine
+// and the order's lease, and applies it with the repo's compare-and-set
+// primitive. current reads the order's status and lease, and swap writes next
+// only if the order still has the status and lease holder of from, reporting
+// whether it did. A claimed order is only changed for workerID, the worker
+// holding its lease. Every OrderRepo goes through here so the rules are the
+// same for all backends.
+func applyStatusTransition(orderID string, next Status, workerID string, current func() (Order, error), swap func(from Order) (bool, error)) error {
+	if !next.Valid() {
+		return fmt.Errorf("%w: %s", ErrInvalidStatus, next)
+	}
+
+	for attempt := 0; attempt < maxTransitionAttempts; attempt++ {
+		from, err := current()
+		if err != nil {
+			return err
+		}
+		if err := checkLease(orderID, from, workerID, time.Now()); err != nil {
+			return err
+		}
+		if !from.Status.CanTransitionTo(next) {
+			return &TransitionError{OrderID: orderID, From: from.Status, To: next}
+		}
+		if from.Status == next {
+			return nil
+		}
+
+		swapped, err := swap(from)
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("order %s: %w", orderID, ErrConcurrentUpdate)
+}
+
 type Item struct {
 	Product  int     `json:"productId"`
 	Quantity int     `json:"quantity"`
@@ -22,16 +169,34 @@ type Item struct {
 }
 
 type OrderRepo interface {
-	GetPendingOrders() ([]Order, error)
-	GetOrder(id string) (Order, error)
-	InsertOrders(orders []Order) error
-	UpdateOrder(order Order) error
+	GetPendingOrders(ctx context.Context) ([]Order, error)
+	CountPendingOrders(ctx context.Context) (int, error)
+	GetOrder(ctx context.Context, id string) (Order, error)
+	InsertOrders(ctx context.Context, orders []Order) error
+	// UpdateOrder moves the order to order.Status and records the change in
+	// its status history under actor. An order claimed by a worker is only
+	// updated if order.ClaimedBy is that worker and its lease hasn't expired.
+	UpdateOrder(ctx context.Context, order Order, actor string) error
+	// ClaimOrders atomically moves up to count pending orders to Processing
+	// and leases them to workerID until ttl has passed
+	ClaimOrders(ctx context.Context, workerID string, count int, ttl time.Duration) ([]Order, error)
+	// ReleaseExpiredLeases moves claimed orders whose lease has expired back
+	// to Pending and returns how many were released
+	ReleaseExpiredLeases(ctx context.Context) (int, error)
+	// ListOrders returns one page of the orders matching query
+	ListOrders(ctx context.Context, query OrderQuery) (OrderPage, error)
+	// Ping checks that the database can be reached
+	Ping(ctx context.Context) error
+	// Close releases the repo's database connections
+	Close(ctx context.Context) error
 }
 
 type OrderService struct {
-	repo OrderRepo
+	repo     OrderRepo
+	events   *EventBus
+	consumer *ConsumerLink
 }
 
 func NewOrderService(repo OrderRepo) *OrderService {
-	return &OrderService{repo}
+	return &OrderService{repo, NewEventBus(), NewConsumerLink()}
 }
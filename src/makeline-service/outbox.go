@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Order lifecycle event types, as published to ORDER_EVENTS_ADDRESS
+const (
+	ORDER_RECEIVED_LIFECYCLE_EVENT       = "OrderReceived"
+	ORDER_STATUS_CHANGED_LIFECYCLE_EVENT = "OrderStatusChanged"
+	ORDER_COMPLETED_LIFECYCLE_EVENT      = "OrderCompleted"
+)
+
+const (
+	// OUTBOX_POLL_INTERVAL is how often the relay looks for events to publish
+	// once the outbox is empty
+	OUTBOX_POLL_INTERVAL = time.Second
+	// OUTBOX_BATCH_SIZE is how many events the relay publishes before it
+	// removes them from the outbox
+	OUTBOX_BATCH_SIZE = 100
+	// OUTBOX_CLAIM_TTL is how long events claimed by a relay are left to it.
+	// A relay renews its claims on every pass, so they only expire once it
+	// stops, and another replica then takes the events over.
+	OUTBOX_CLAIM_TTL = 30 * time.Second
+)
+
+// OutboxEvent is an order lifecycle event. It is stored in the outbox in the
+// same write as the change it describes, and published by the outbox relay.
+// Events of an order are published in the order they happened.
+type OutboxEvent struct {
+	// ID identifies the event, and stays the same if the event is published
+	// more than once
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	OrderID    string `json:"orderId"`
+	CustomerID string `json:"customerId,omitempty"`
+	Status     Status `json:"status"`
+	// PreviousStatus is the status the order moved from, for status changes
+	PreviousStatus *Status `json:"previousStatus,omitempty"`
+	// Items are the ordered items, for received orders
+	Items     []Item    `json:"items,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// newOrderReceivedEvent records that the order was stored
+func newOrderReceivedEvent(o Order) OutboxEvent {
+	timestamp := o.CreatedAt
+	if timestamp.IsZero() {
+		timestamp = time.Now().UTC()
+	}
+	return OutboxEvent{
+		ID:         uuid.Must(uuid.NewV4()).String(),
+		Type:       ORDER_RECEIVED_LIFECYCLE_EVENT,
+		OrderID:    o.OrderID,
+		CustomerID: o.CustomerID,
+		Status:     o.Status,
+		Items:      slices.Clone(o.Items),
+		Actor:      SYSTEM_ACTOR,
+		Timestamp:  timestamp,
+	}
+}
+
+// newStatusChangeEvents records that the order moved from one status to
+// another. A move to Complete is also an OrderCompleted event.
+func newStatusChangeEvents(orderID string, from Status, change StatusChange) []OutboxEvent {
+	events := []OutboxEvent{{
+		ID:             uuid.Must(uuid.NewV4()).String(),
+		Type:           ORDER_STATUS_CHANGED_LIFECYCLE_EVENT,
+		OrderID:        orderID,
+		Status:         change.Status,
+		PreviousStatus: &from,
+		Actor:          change.Actor,
+		Timestamp:      change.Timestamp,
+	}}
+	if change.Status == Complete {
+		completed := events[0]
+		completed.ID = uuid.Must(uuid.NewV4()).String()
+		completed.Type = ORDER_COMPLETED_LIFECYCLE_EVENT
+		events = append(events, completed)
+	}
+	return events
+}
+
+// OutboxRepo is implemented by repos that can store lifecycle events in the
+// same write as the order change they describe, so an event is never lost
+// and never published for a change that didn't happen
+type OutboxRepo interface {
+	// EnableOutbox makes the repo store lifecycle events from now on. It must
+	// be called before the repo is used.
+	EnableOutbox()
+	// ClaimOutboxEvents returns up to limit events that haven't been
+	// published yet, oldest first for each order, and claims them for the
+	// relay for OUTBOX_CLAIM_TTL so other relays skip them. The events of an
+	// order are claimed together, so they are published in order.
+	ClaimOutboxEvents(ctx context.Context, relayID string, limit int) ([]OutboxEvent, error)
+	// DeleteOutboxEvents removes events once they have been published
+	DeleteOutboxEvents(ctx context.Context, ids []string) error
+}
+
+// EventPublisher sends lifecycle events to a message broker
+type EventPublisher interface {
+	// Name is the address or topic events are sent to, for logs
+	Name() string
+	Open(ctx context.Context) error
+	Close(ctx context.Context) error
+	// Publish sends the event and returns once the broker has accepted it
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+// newEventPublisher picks where lifecycle events are published: the Service
+// Bus topic ORDER_EVENTS_ADDRESS if Service Bus is set up, and the AMQP
+// address ORDER_EVENTS_ADDRESS on the order queue broker otherwise. Events
+// are sent as CloudEvents in the content mode ORDER_EVENTS_CONTENT_MODE. It
+// returns nil if ORDER_EVENTS_ADDRESS isn't set.
+func newEventPublisher() EventPublisher {
+	address := os.Getenv("ORDER_EVENTS_ADDRESS")
+	switch {
+	case address == "":
+		return nil
+	case os.Getenv("ORDER_QUEUE_TRANSPORT") == KAFKA_TRANSPORT:
+		slog.Warn("Lifecycle events can't be published to Kafka, ORDER_EVENTS_ADDRESS is ignored")
+		return nil
+	}
+
+	mode := os.Getenv("ORDER_EVENTS_CONTENT_MODE")
+	switch mode {
+	case "":
+		mode = STRUCTURED_CONTENT_MODE
+	case STRUCTURED_CONTENT_MODE, BINARY_CONTENT_MODE:
+	default:
+		logFatal("ORDER_EVENTS_CONTENT_MODE must be structured or binary", "value", mode)
+	}
+
+	if connection, ok := serviceBusConnectionFromEnv(); ok {
+		return NewServiceBusEventPublisher(connection, address, mode)
+	}
+	return NewAMQPEventPublisher(address, mode)
+}
+
+// OutboxRelay publishes the events in a repo's outbox and removes them once
+// the broker has them. Every replica runs a relay, and each publishes the
+// events it has claimed. An event is published at least once: if the relay
+// stops between publishing and removing it, it is published again with the
+// same ID once its claim expires.
+type OutboxRelay struct {
+	// id identifies the relay's claims on outbox events
+	id        string
+	repo      OutboxRepo
+	publisher EventPublisher
+}
+
+// newOutboxRelay sets up the outbox on repo if lifecycle events are to be
+// published, and returns nil otherwise. The outbox depends on the backend's
+// own type, so it is set up before the repo is wrapped for metrics.
+func newOutboxRelay(repo OrderRepo) *OutboxRelay {
+	publisher := newEventPublisher()
+	if publisher == nil {
+		return nil
+	}
+
+	outbox, ok := repo.(OutboxRepo)
+	if !ok {
+		slog.Warn("The outbox is not supported by this database, lifecycle events won't be published")
+		return nil
+	}
+	outbox.EnableOutbox()
+
+	return &OutboxRelay{id: uuid.Must(uuid.NewV4()).String(), repo: outbox, publisher: publisher}
+}
+
+// Run publishes events until ctx is done. A broker that can't be reached is
+// retried with a growing backoff, while events wait in the outbox. The
+// backoff only starts over once events have been relayed, so a broker that
+// accepts connections but fails every publish isn't retried in a busy loop.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ctx = withLogAttrs(ctx, slog.String("address", r.publisher.Name()))
+
+	var retries int
+	for {
+		err := r.publisher.Open(ctx)
+		if err == nil {
+			slog.InfoContext(ctx, "Publishing lifecycle events")
+			var relayed bool
+			relayed, err = r.relay(ctx)
+			r.publisher.Close(context.WithoutCancel(ctx))
+			if relayed {
+				retries = 0
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		backoff := retryBackoff(retries)
+		retries++
+		slog.ErrorContext(ctx, "Failed to publish lifecycle events, retrying", "backoff", backoff, errAttr(err))
+		if !sleepContext(ctx, backoff) {
+			return
+		}
+	}
+}
+
+// relay publishes events from the outbox until ctx is done or publishing
+// fails. Events that were published before a failure are still removed. It
+// reports whether a pass over the outbox completed before it returned.
+func (r *OutboxRelay) relay(ctx context.Context) (bool, error) {
+	var relayed bool
+	for {
+		events, err := r.repo.ClaimOutboxEvents(ctx, r.id, OUTBOX_BATCH_SIZE)
+		if err != nil {
+			return relayed, err
+		}
+
+		published := make([]string, 0, len(events))
+		var publishErr error
+		for _, event := range events {
+			if publishErr = r.publisher.Publish(ctx, event); publishErr != nil {
+				break
+			}
+			published = append(published, event.ID)
+			outboxEventsPublished.WithLabelValues(event.Type).Inc()
+		}
+
+		if len(published) > 0 {
+			// removing the events must not be cut short by shutdown, or they
+			// are published again on the next start
+			if err := r.repo.DeleteOutboxEvents(context.WithoutCancel(ctx), published); err != nil {
+				return relayed, err
+			}
+			slog.DebugContext(ctx, "Published lifecycle events", "count", len(published))
+		}
+		if publishErr != nil {
+			return relayed, publishErr
+		}
+		relayed = true
+
+		if len(events) < OUTBOX_BATCH_SIZE && !sleepContext(ctx, OUTBOX_POLL_INTERVAL) {
+			return relayed, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// enableTestOutbox turns on the repo's outbox, failing the test if the
+// backend has none
+func enableTestOutbox(t *testing.T, repo OrderRepo) OutboxRepo {
+	t.Helper()
+	outbox, ok := repo.(OutboxRepo)
+	if !ok {
+		t.Fatalf("%T has no outbox", repo)
+	}
+	outbox.EnableOutbox()
+	return outbox
+}
+
+// claimAllOutboxEvents claims every event in the outbox for relayID
+func claimAllOutboxEvents(t *testing.T, outbox OutboxRepo, relayID string) []OutboxEvent {
+	t.Helper()
+	events, err := outbox.ClaimOutboxEvents(t.Context(), relayID, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+// eventsByOrder groups events by order, keeping their order
+func eventsByOrder(events []OutboxEvent) map[string][]OutboxEvent {
+	byOrder := make(map[string][]OutboxEvent)
+	for _, event := range events {
+		byOrder[event.OrderID] = append(byOrder[event.OrderID], event)
+	}
+	return byOrder
+}
+
+func TestOutboxRecordsLifecycleEvents(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+		outbox := enableTestOutbox(t, repo)
+		insertTestOrders(t, repo, testOrder("1", Pending))
+		for _, status := range []Status{Processing, Complete} {
+			if err := repo.UpdateOrder(t.Context(), Order{OrderID: "1", Status: status}, "store-admin"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// a move the state machine rejects records nothing
+		var transitionErr *TransitionError
+		if err := repo.UpdateOrder(t.Context(), Order{OrderID: "1", Status: Pending}, "store-admin"); !errors.As(err, &transitionErr) {
+			t.Fatalf("got %v, want a TransitionError", err)
+		}
+		insertTestOrders(t, repo, testOrder("2", Pending))
+		if _, err := repo.ClaimOrders(t.Context(), "worker-1", 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		type event struct {
+			Type          string
+			Status, From  Status
+			Actor         string
+			CustomerID    string
+			ItemsRecorded bool
+		}
+		want := map[string][]event{
+			"1": {
+				{Type: ORDER_RECEIVED_LIFECYCLE_EVENT, Status: Pending, Actor: SYSTEM_ACTOR, CustomerID: "customer-1", ItemsRecorded: true},
+				{Type: ORDER_STATUS_CHANGED_LIFECYCLE_EVENT, Status: Processing, From: Pending, Actor: "store-admin"},
+				{Type: ORDER_STATUS_CHANGED_LIFECYCLE_EVENT, Status: Complete, From: Processing, Actor: "store-admin"},
+				{Type: ORDER_COMPLETED_LIFECYCLE_EVENT, Status: Complete, From: Processing, Actor: "store-admin"},
+			},
+			"2": {
+				{Type: ORDER_RECEIVED_LIFECYCLE_EVENT, Status: Pending, Actor: SYSTEM_ACTOR, CustomerID: "customer-2", ItemsRecorded: true},
+				{Type: ORDER_STATUS_CHANGED_LIFECYCLE_EVENT, Status: Processing, From: Pending, Actor: "worker-1"},
+			},
+		}
+
+		claimed := claimAllOutboxEvents(t, outbox, "relay-1")
+		for orderID, events := range eventsByOrder(claimed) {
+			var got []event
+			for _, e := range events {
+				var from Status
+				if e.PreviousStatus != nil {
+					from = *e.PreviousStatus
+				}
+				got = append(got, event{Type: e.Type, Status: e.Status, From: from, Actor: e.Actor, CustomerID: e.CustomerID, ItemsRecorded: len(e.Items) > 0})
+			}
+			if !slices.Equal(got, want[orderID]) {
+				t.Errorf("order %s: got events %+v, want %+v", orderID, got, want[orderID])
+			}
+		}
+		if got := len(claimed); got != 6 {
+			t.Errorf("got %d events, want 6", got)
+		}
+
+		// orders in memory are only seen by one replica, so there is no
+		// other relay to keep out
+		if _, ok := repo.(*InMemoryOrderRepo); !ok {
+			if got := claimAllOutboxEvents(t, outbox, "relay-2"); len(got) != 0 {
+				t.Errorf("another relay claimed %d events, want none", len(got))
+			}
+		}
+		// claiming again renews the relay's claims
+		if got := claimAllOutboxEvents(t, outbox, "relay-1"); len(got) != len(claimed) {
+			t.Errorf("got %d events claimed again, want %d", len(got), len(claimed))
+		}
+
+		var ids []string
+		for _, e := range claimed {
+			ids = append(ids, e.ID)
+		}
+		if err := outbox.DeleteOutboxEvents(t.Context(), ids); err != nil {
+			t.Fatal(err)
+		}
+		// deleting events that are already gone isn't an error
+		if err := outbox.DeleteOutboxEvents(t.Context(), ids); err != nil {
+			t.Fatal(err)
+		}
+		if got := claimAllOutboxEvents(t, outbox, "relay-1"); len(got) != 0 {
+			t.Errorf("got %d events after deleting them, want none", len(got))
+		}
+
+		// the orders are left as they were, and the outbox doesn't show up
+		// among them
+		page, err := repo.ListOrders(t.Context(), OrderQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := orderIDs(page.Orders); !slices.Equal(got, []string{"1", "2"}) {
+			t.Errorf("got orders %v, want [1 2]", got)
+		}
+	})
+}
+
+// fakePublisher is an EventPublisher that records the events it publishes
+type fakePublisher struct {
+	mu        sync.Mutex
+	published []OutboxEvent
+	// failAfter makes Publish fail once this many events were published, if
+	// set
+	failAfter int
+}
+
+func (p *fakePublisher) Name() string                    { return "order-events" }
+func (p *fakePublisher) Open(ctx context.Context) error  { return nil }
+func (p *fakePublisher) Close(ctx context.Context) error { return nil }
+
+func (p *fakePublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failAfter > 0 && len(p.published) == p.failAfter {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, event)
+	return nil
+}
+
+func (p *fakePublisher) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.published)
+}
+
+func TestOutboxRelay(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	outbox := enableTestOutbox(t, repo)
+	insertTestOrders(t, repo, testOrder("1", Pending), testOrder("2", Pending))
+	if err := repo.UpdateOrder(t.Context(), Order{OrderID: "1", Status: Processing}, "store-admin"); err != nil {
+		t.Fatal(err)
+	}
+	want := claimAllOutboxEvents(t, outbox, "relay-1")
+
+	publisher := &fakePublisher{}
+	relay := &OutboxRelay{id: "relay-1", repo: outbox, publisher: publisher}
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() {
+		_, err := relay.relay(ctx)
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for publisher.count() < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	var gotIDs, wantIDs []string
+	for i := range want {
+		wantIDs = append(wantIDs, want[i].ID)
+	}
+	for _, event := range publisher.published {
+		gotIDs = append(gotIDs, event.ID)
+	}
+	if !slices.Equal(gotIDs, wantIDs) {
+		t.Errorf("published events %v, want %v", gotIDs, wantIDs)
+	}
+	if got := claimAllOutboxEvents(t, outbox, "relay-1"); len(got) != 0 {
+		t.Errorf("got %d events left in the outbox, want none", len(got))
+	}
+}
+
+func TestOutboxRelayPublishFails(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	outbox := enableTestOutbox(t, repo)
+	insertTestOrders(t, repo, testOrder("1", Pending), testOrder("2", Pending), testOrder("3", Pending))
+	events := claimAllOutboxEvents(t, outbox, "relay-1")
+
+	publisher := &fakePublisher{failAfter: 1}
+	relay := &OutboxRelay{id: "relay-1", repo: outbox, publisher: publisher}
+	if _, err := relay.relay(t.Context()); err == nil {
+		t.Fatal("got no error, want the publish failure")
+	}
+
+	// the event that was published is removed, and the rest wait for the
+	// broker to come back
+	left := claimAllOutboxEvents(t, outbox, "relay-1")
+	if got, want := len(left), len(events)-1; got != want {
+		t.Fatalf("got %d events left in the outbox, want %d", got, want)
+	}
+	if left[0].ID != events[1].ID {
+		t.Errorf("got event %s first in the outbox, want %s", left[0].ID, events[1].ID)
+	}
+}
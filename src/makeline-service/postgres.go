@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresMigrations are applied in order on startup. Each entry is a schema
+// version; never edit a migration that has shipped, append a new one instead.
+var postgresMigrations = []string{
+	// 1: orders and their line items
+	`CREATE TABLE IF NOT EXISTS orders (
+		id          BIGSERIAL PRIMARY KEY,
+		order_id    TEXT    NOT NULL,
+		customer_id TEXT    NOT NULL,
+		status      INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS orders_order_id_idx ON orders (order_id);
+	CREATE INDEX IF NOT EXISTS orders_status_idx ON orders (status);
+	CREATE TABLE IF NOT EXISTS order_items (
+		order_pk    BIGINT           NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+		line_number INTEGER          NOT NULL,
+		product_id  INTEGER          NOT NULL,
+		quantity    INTEGER          NOT NULL,
+		price       DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (order_pk, line_number)
+	);`,
+	// 2: message id of the queue message each order came from, for idempotent inserts
+	`ALTER TABLE orders ADD COLUMN message_id TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS orders_message_id_idx ON orders (message_id) WHERE message_id IS NOT NULL;`,
+	// 3: timestamps and status history
+	`ALTER TABLE orders ADD COLUMN created_at TIMESTAMPTZ;
+	ALTER TABLE orders ADD COLUMN updated_at TIMESTAMPTZ;
+	CREATE TABLE IF NOT EXISTS order_status_history (
+		id         BIGSERIAL   PRIMARY KEY,
+		order_pk   BIGINT      NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+		status     INTEGER     NOT NULL,
+		changed_at TIMESTAMPTZ NOT NULL,
+		actor      TEXT        NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS order_status_history_order_pk_idx ON order_status_history (order_pk);`,
+	// 4: leases held by workers that claimed an order
+	`ALTER TABLE orders ADD COLUMN claimed_by TEXT;
+	ALTER TABLE orders ADD COLUMN lease_expires_at TIMESTAMPTZ;`,
+	// 5: outbox of lifecycle events waiting to be published
+	`CREATE TABLE IF NOT EXISTS order_outbox (
+		id         BIGSERIAL   PRIMARY KEY,
+		event_id   TEXT        NOT NULL UNIQUE,
+		payload    TEXT        NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	);`,
+	// 6: lease of the replica that relays the outbox
+	`CREATE TABLE IF NOT EXISTS outbox_relay (
+		id               INTEGER PRIMARY KEY,
+		relay_id         TEXT,
+		lease_expires_at TIMESTAMPTZ
+	);
+	INSERT INTO outbox_relay (id) VALUES (1);`,
+}
+
+// postgresMigrationLockID is the advisory lock key that serializes migrations
+// when several replicas start at the same time
+const postgresMigrationLockID = 7_300_001
+
+type PostgresOrderRepo struct {
+	sqlOrderRepo
+}
+
+func NewPostgresOrderRepo(postgresUri string, postgresDb string, postgresUser string, postgresPassword string) (*PostgresOrderRepo, error) {
+	ctx := context.Background()
+
+	// parse the connection uri and apply any explicit overrides
+	config, err := pgx.ParseConfig(postgresUri)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to parse PostgreSQL connection URI", errAttr(err))
+		return nil, err
+	}
+	if postgresDb != "" {
+		config.Database = postgresDb
+	}
+	if postgresUser != "" {
+		config.User = postgresUser
+	}
+	if postgresPassword != "" {
+		config.Password = postgresPassword
+	}
+
+	db := stdlib.OpenDB(*config)
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to ping database", errAttr(err))
+		db.Close()
+		return nil, err
+	} else {
+		slog.Debug("Pong from database")
+	}
+
+	repo := &PostgresOrderRepo{sqlOrderRepo{db: db, numberedPlaceholder: true, lockClause: "FOR UPDATE SKIP LOCKED"}}
+	lock := &migrationLock{
+		lock:   fmt.Sprintf("SELECT pg_advisory_lock(%d)", postgresMigrationLockID),
+		unlock: fmt.Sprintf("SELECT pg_advisory_unlock(%d)", postgresMigrationLockID),
+	}
+	if err := repo.migrate(ctx, postgresMigrations, lock); err != nil {
+		slog.ErrorContext(ctx, "Failed to migrate database schema", errAttr(err))
+		db.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// READY_CHECK_TIMEOUT bounds each dependency check made by /ready, so a hung
+// dependency fails the probe rather than timing it out
+const READY_CHECK_TIMEOUT = 2 * time.Second
+
+// Dependency check results
+const (
+	DEPENDENCY_UP   = "up"
+	DEPENDENCY_DOWN = "down"
+)
+
+// errConsumerDisconnected is reported while the consumer has no queue link
+var errConsumerDisconnected = errors.New("consumer is not connected to the queue")
+
+// DependencyStatus is the result of checking one dependency
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	Transport string  `json:"transport,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ReadinessReport is the body of /ready
+type ReadinessReport struct {
+	Status string                      `json:"status"`
+	Checks map[string]DependencyStatus `json:"checks"`
+}
+
+// ConsumerLink tracks whether the queue consumer currently has a live link to
+// the broker, and how to check that the broker still answers on it
+type ConsumerLink struct {
+	mu        sync.Mutex
+	transport string
+	// probe makes a round trip to the broker; it is nil while disconnected
+	probe   func(ctx context.Context) error
+	lastErr error
+}
+
+func NewConsumerLink() *ConsumerLink {
+	return &ConsumerLink{lastErr: errConsumerDisconnected}
+}
+
+// Connected records that the consumer has a live link over transport
+func (l *ConsumerLink) Connected(transport string, probe func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.transport = transport
+	l.probe = probe
+	l.lastErr = nil
+}
+
+// Disconnected records that the consumer has no link over transport because
+// of err
+func (l *ConsumerLink) Disconnected(transport string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.transport = transport
+	l.probe = nil
+	if err == nil {
+		err = errConsumerDisconnected
+	}
+	l.lastErr = err
+}
+
+// Check probes the broker over the consumer's link
+func (l *ConsumerLink) Check(ctx context.Context) DependencyStatus {
+	l.mu.Lock()
+	transport, probe, lastErr := l.transport, l.probe, l.lastErr
+	l.mu.Unlock()
+
+	if probe == nil {
+		return DependencyStatus{Status: DEPENDENCY_DOWN, Transport: transport, Error: lastErr.Error()}
+	}
+	status := checkDependency(ctx, probe)
+	status.Transport = transport
+	return status
+}
+
+// checkDependency runs check with READY_CHECK_TIMEOUT and times it
+func checkDependency(ctx context.Context, check func(ctx context.Context) error) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, READY_CHECK_TIMEOUT)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	status := DependencyStatus{
+		Status:    DEPENDENCY_UP,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Status = DEPENDENCY_DOWN
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// readiness reports whether the replica can do its work: the database answers
+// a ping and the consumer has a live link to the broker. Unlike /health, it
+// checks the dependencies on every call, so a replica that loses either stops
+// getting traffic. orderService is nil until the database is initialized.
+func readiness(orderService func() *OrderService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := ReadinessReport{Status: "ready", Checks: map[string]DependencyStatus{}}
+
+		service := orderService()
+		if service == nil {
+			report.Checks["database"] = DependencyStatus{Status: DEPENDENCY_DOWN, Error: "database not ready"}
+			report.Checks["queue"] = DependencyStatus{Status: DEPENDENCY_DOWN, Error: errConsumerDisconnected.Error()}
+		} else {
+			// check both at once so a slow dependency doesn't delay the other
+			var wg sync.WaitGroup
+			var database, queue DependencyStatus
+			wg.Go(func() { database = checkDependency(c.Request.Context(), service.repo.Ping) })
+			wg.Go(func() { queue = service.consumer.Check(c.Request.Context()) })
+			wg.Wait()
+			report.Checks["database"] = database
+			report.Checks["queue"] = queue
+		}
+
+		status := http.StatusOK
+		for _, check := range report.Checks {
+			if check.Status != DEPENDENCY_UP {
+				report.Status = "unavailable"
+				status = http.StatusServiceUnavailable
+			}
+		}
+		c.JSON(status, report)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// repoBackend is a database the repo tests run against
+type repoBackend struct {
+	name string
+	// open returns a new, empty repo, or skips the test if the database
+	// isn't available
+	open func(t *testing.T) OrderRepo
+}
+
+// repoBackends are the databases the repo tests run against. The in-memory
+// and SQLite repos always run; the others only run when their TEST_ variables
+// point at a database.
+var repoBackends = []repoBackend{
+	{name: "memory", open: func(t *testing.T) OrderRepo { return NewInMemoryOrderRepo() }},
+	{name: "sqlite", open: openTestSQLite},
+	{name: "postgres", open: openTestPostgres},
+	{name: "mongodb", open: openTestMongoDB},
+	{name: "cosmosdb", open: openTestCosmosDB},
+}
+
+// forEachRepo runs test against a new, empty repo of every backend
+func forEachRepo(t *testing.T, test func(t *testing.T, repo OrderRepo)) {
+	t.Helper()
+	for _, backend := range repoBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t))
+		})
+	}
+}
+
+// openTestSQLite creates a database file in the test's temporary directory
+func openTestSQLite(t *testing.T) OrderRepo {
+	repo, err := NewSQLiteOrderRepo(filepath.Join(t.TempDir(), "orders.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close(context.Background()) })
+	return repo
+}
+
+// openTestPostgres connects to TEST_POSTGRES_URI, with a schema of the test's
+// own that is dropped once the test is done
+func openTestPostgres(t *testing.T) OrderRepo {
+	uri := os.Getenv("TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("TEST_POSTGRES_URI is not set")
+	}
+
+	admin, err := sql.Open("pgx", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := testName("makeline")
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+
+	// the repo migrates and uses the test's schema
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	repo, err := NewPostgresOrderRepo(u.String(), "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close(context.Background()) })
+	return repo
+}
+
+// openTestMongoDB connects to TEST_MONGODB_URI, with a collection of the
+// test's own that is dropped once the test is done
+func openTestMongoDB(t *testing.T) OrderRepo {
+	uri := os.Getenv("TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGODB_URI is not set")
+	}
+	repo, err := NewMongoDBOrderRepo(uri, "orderdb", testName("orders"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cleanups run last first, so the collection is dropped before the
+	// client disconnects
+	t.Cleanup(func() { repo.Close(context.Background()) })
+	t.Cleanup(func() {
+		if err := repo.db.Drop(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return repo
+}
+
+// openTestCosmosDB connects to the orders container of the orderdb database
+// at TEST_COSMOSDB_ENDPOINT, with a partition of the test's own
+func openTestCosmosDB(t *testing.T) OrderRepo {
+	endpoint := os.Getenv("TEST_COSMOSDB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TEST_COSMOSDB_ENDPOINT is not set")
+	}
+	repo, err := NewCosmosDBOrderRepo(endpoint, "orderdb", "orders", os.Getenv("TEST_COSMOSDB_KEY"), PartitionKey{"storeId", testName("store")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// testName returns a name no other test run uses
+func testName(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano())
+}
+
+// testOrder is an order as the consumer stores it
+func testOrder(orderID string, status Status) Order {
+	received := newStatusChange(status, SYSTEM_ACTOR)
+	return Order{
+		OrderID:       orderID,
+		CustomerID:    "customer-" + orderID,
+		Items:         []Item{{Product: 1, Quantity: 2, Price: 10}},
+		Status:        status,
+		CreatedAt:     received.Timestamp,
+		UpdatedAt:     received.Timestamp,
+		StatusHistory: []StatusChange{received},
+	}
+}
+
+// insertTestOrders stores orders, failing the test if they can't be
+func insertTestOrders(t *testing.T, repo OrderRepo, orders ...Order) {
+	t.Helper()
+	if err := repo.InsertOrders(t.Context(), orders); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// orderIDs returns the IDs of orders, sorted, as backends don't agree on the
+// order they return orders in
+func orderIDs(orders []Order) []string {
+	ids := make([]string, 0, len(orders))
+	for _, o := range orders {
+		ids = append(ids, o.OrderID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// numbered is prefix followed by each number from first to last
+func numbered(prefix string, first, last int) []string {
+	var s []string
+	for i := first; i <= last; i++ {
+		s = append(s, fmt.Sprint(prefix, i))
+	}
+	return s
+}
+
+func TestGetPendingOrders(t *testing.T) {
+	tests := []struct {
+		name   string
+		orders []Order
+		want   []string
+	}{
+		{name: "no orders", want: []string{}},
+		{name: "only pending orders", orders: []Order{testOrder("1", Pending), testOrder("2", Pending)}, want: []string{"1", "2"}},
+		{name: "mixed statuses", orders: []Order{testOrder("1", Pending), testOrder("2", Processing), testOrder("3", Complete), testOrder("4", Pending)}, want: []string{"1", "4"}},
+		{name: "nothing pending", orders: []Order{testOrder("1", Complete)}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				if len(tt.orders) > 0 {
+					insertTestOrders(t, repo, tt.orders...)
+				}
+
+				orders, err := repo.GetPendingOrders(t.Context())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := orderIDs(orders); !slices.Equal(got, tt.want) {
+					t.Errorf("got pending orders %v, want %v", got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+		want := testOrder("2", Processing)
+		insertTestOrders(t, repo, testOrder("1", Pending), want)
+
+		got, err := repo.GetOrder(t.Context(), "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.OrderID != want.OrderID || got.CustomerID != want.CustomerID || got.Status != want.Status {
+			t.Errorf("got order %s of %s in status %d, want %s of %s in status %d", got.OrderID, got.CustomerID, got.Status, want.OrderID, want.CustomerID, want.Status)
+		}
+		if !slices.Equal(got.Items, want.Items) {
+			t.Errorf("got items %v, want %v", got.Items, want.Items)
+		}
+		// some backends store timestamps to the millisecond
+		if got.CreatedAt.Sub(want.CreatedAt).Abs() > time.Millisecond {
+			t.Errorf("got created at %s, want %s", got.CreatedAt, want.CreatedAt)
+		}
+		if len(got.StatusHistory) != 1 || got.StatusHistory[0].Status != Processing || got.StatusHistory[0].Actor != SYSTEM_ACTOR {
+			t.Errorf("got status history %v, want the order received as Processing by %s", got.StatusHistory, SYSTEM_ACTOR)
+		}
+	})
+}
+
+func TestUpdateOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		from Status
+		to   Status
+	}{
+		{name: "pending to processing", from: Pending, to: Processing},
+		{name: "processing to complete", from: Processing, to: Complete},
+		{name: "same status", from: Pending, to: Pending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				insertTestOrders(t, repo, testOrder("1", tt.from), testOrder("2", tt.from))
+
+				if err := repo.UpdateOrder(t.Context(), Order{OrderID: "1", Status: tt.to}, "store-admin"); err != nil {
+					t.Fatal(err)
+				}
+
+				updated, err := repo.GetOrder(t.Context(), "1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if updated.Status != tt.to {
+					t.Errorf("got status %d, want %d", updated.Status, tt.to)
+				}
+				other, err := repo.GetOrder(t.Context(), "2")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if other.Status != tt.from {
+					t.Errorf("other order got status %d, want it left at %d", other.Status, tt.from)
+				}
+			})
+		})
+	}
+}
+
+func TestInsertOrdersIdempotent(t *testing.T) {
+	tests := []struct {
+		name string
+		// batches are the message IDs of the orders in each InsertOrders call.
+		// Orders are numbered from 1 in the order they are inserted.
+		batches [][]string
+		want    []string
+	}{
+		{name: "different messages", batches: [][]string{{"m1", "m2"}}, want: []string{"1", "2"}},
+		{name: "same message twice in a batch", batches: [][]string{{"m1", "m1"}}, want: []string{"1"}},
+		{name: "message delivered again", batches: [][]string{{"m1", "m2"}, {"m2", "m3"}}, want: []string{"1", "2", "4"}},
+		{name: "message delivered again on its own", batches: [][]string{{"m1"}, {"m1"}}, want: []string{"1"}},
+		{name: "orders without a message", batches: [][]string{{"", ""}, {""}}, want: []string{"1", "2", "3"}},
+		{
+			// Cosmos DB writes a batch in transactional batches of at most
+			// MAX_COSMOS_BATCH_OPERATIONS
+			name:    "more orders than fit in a transactional batch",
+			batches: [][]string{numbered("m", 1, 120), numbered("m", 100, 130)},
+			want:    slices.Concat(numbered("", 1, 120), numbered("", 142, 151)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				outbox := enableTestOutbox(t, repo)
+				var next int
+				for _, batch := range tt.batches {
+					var orders []Order
+					for _, messageID := range batch {
+						next++
+						order := testOrder(fmt.Sprint(next), Pending)
+						order.MessageID = messageID
+						orders = append(orders, order)
+					}
+					insertTestOrders(t, repo, orders...)
+				}
+
+				// the first order from each message is the one that is kept
+				orders, err := repo.GetPendingOrders(t.Context())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := orderIDs(orders), slices.Sorted(slices.Values(tt.want)); !slices.Equal(got, want) {
+					t.Errorf("got orders %v, want %v", got, want)
+				}
+
+				// only the orders that were kept are announced
+				var received []string
+				for _, event := range claimAllOutboxEvents(t, outbox, "relay-1") {
+					if event.Type == ORDER_RECEIVED_LIFECYCLE_EVENT {
+						received = append(received, event.OrderID)
+					}
+				}
+				slices.Sort(received)
+				if want := slices.Sorted(slices.Values(tt.want)); !slices.Equal(received, want) {
+					t.Errorf("got received events for orders %v, want %v", received, want)
+				}
+			})
+		})
+	}
+}
+
+func TestUpdateOrderStatusTransitions(t *testing.T) {
+	tests := []struct {
+		name string
+		from Status
+		to   Status
+		// rejected is set if the state machine doesn't allow the move
+		rejected bool
+	}{
+		{name: "pending to processing", from: Pending, to: Processing},
+		{name: "pending to on hold", from: Pending, to: OnHold},
+		{name: "pending to cancelled", from: Pending, to: Cancelled},
+		{name: "pending straight to complete", from: Pending, to: Complete, rejected: true},
+		{name: "pending to failed", from: Pending, to: Failed, rejected: true},
+		{name: "processing to complete", from: Processing, to: Complete},
+		{name: "processing back to pending", from: Processing, to: Pending},
+		{name: "processing to failed", from: Processing, to: Failed},
+		{name: "on hold to processing", from: OnHold, to: Processing},
+		{name: "on hold to complete", from: OnHold, to: Complete, rejected: true},
+		{name: "failed back to pending", from: Failed, to: Pending},
+		{name: "failed to complete", from: Failed, to: Complete, rejected: true},
+		{name: "complete is terminal", from: Complete, to: Pending, rejected: true},
+		{name: "cancelled is terminal", from: Cancelled, to: Processing, rejected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				insertTestOrders(t, repo, testOrder("1", tt.from))
+
+				err := repo.UpdateOrder(t.Context(), Order{OrderID: "1", Status: tt.to}, "store-admin")
+
+				order, getErr := repo.GetOrder(t.Context(), "1")
+				if getErr != nil {
+					t.Fatal(getErr)
+				}
+				if tt.rejected {
+					var transitionErr *TransitionError
+					if !errors.As(err, &transitionErr) {
+						t.Fatalf("got %v, want a TransitionError", err)
+					}
+					if transitionErr.OrderID != "1" || transitionErr.From != tt.from || transitionErr.To != tt.to {
+						t.Errorf("got TransitionError for order %s from %s to %s, want order 1 from %s to %s", transitionErr.OrderID, transitionErr.From, transitionErr.To, tt.from, tt.to)
+					}
+					if order.Status != tt.from || len(order.StatusHistory) != 1 {
+						t.Errorf("order is %s with %d history entries, want it left %s", order.Status, len(order.StatusHistory), tt.from)
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("got %v, want the move to be allowed", err)
+				}
+				if order.Status != tt.to {
+					t.Errorf("order is %s, want %s", order.Status, tt.to)
+				}
+				if len(order.StatusHistory) != 2 {
+					t.Fatalf("order has %d history entries, want the move recorded", len(order.StatusHistory))
+				}
+				last := order.StatusHistory[1]
+				if last.Status != tt.to || last.Actor != "store-admin" {
+					t.Errorf("last history entry is %s by %s, want %s by store-admin", last.Status, last.Actor, tt.to)
+				}
+				if order.UpdatedAt.Sub(last.Timestamp).Abs() > time.Millisecond {
+					t.Errorf("order updated at %s, want the time of the move %s", order.UpdatedAt, last.Timestamp)
+				}
+			})
+		})
+	}
+}
+
+func TestUpdateOrderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		update Order
+		want   error
+	}{
+		{name: "same status is a no-op", update: Order{OrderID: "1", Status: Pending}},
+		{name: "unknown status", update: Order{OrderID: "1", Status: Status(42)}, want: ErrInvalidStatus},
+		{name: "unknown order", update: Order{OrderID: "2", Status: Processing}, want: ErrOrderNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+				insertTestOrders(t, repo, testOrder("1", Pending))
+
+				if err := repo.UpdateOrder(t.Context(), tt.update, "store-admin"); !errors.Is(err, tt.want) {
+					t.Errorf("got %v, want %v", err, tt.want)
+				}
+
+				order, err := repo.GetOrder(t.Context(), "1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if order.Status != Pending || len(order.StatusHistory) != 1 {
+					t.Errorf("order is %s with %d history entries, want it left Pending with 1", order.Status, len(order.StatusHistory))
+				}
+			})
+		})
+	}
+}
+
+func TestGetOrderNotFound(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo OrderRepo) {
+		insertTestOrders(t, repo, testOrder("1", Pending))
+
+		if _, err := repo.GetOrder(t.Context(), "2"); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("got %v, want %v", err, ErrOrderNotFound)
+		}
+	})
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// ServiceBusConnection is how to connect to a Service Bus namespace: with a
+// connection string if one is set, or with Workload Identity to the hostname
+type ServiceBusConnection struct {
+	Hostname         string
+	ConnectionString string
+}
+
+// serviceBusConnectionFromEnv reads the Service Bus connection from the
+// environment. ORDER_QUEUE_CONNECTION_STRING is used as is, which also suits
+// the Service Bus emulator. ORDER_QUEUE_SAS_KEY_NAME and ORDER_QUEUE_SAS_KEY
+// make a connection string for the namespace hostname. Otherwise the hostname
+// is used with Workload Identity if USE_WORKLOAD_IDENTITY_AUTH is true. It
+// returns false if none of these are set.
+func serviceBusConnectionFromEnv() (ServiceBusConnection, bool) {
+	hostname := os.Getenv("AZURE_SERVICEBUS_FULLYQUALIFIEDNAMESPACE")
+	if hostname == "" {
+		hostname = os.Getenv("ORDER_QUEUE_HOSTNAME")
+	}
+
+	if connectionString := os.Getenv("ORDER_QUEUE_CONNECTION_STRING"); connectionString != "" {
+		return ServiceBusConnection{ConnectionString: connectionString}, true
+	}
+
+	keyName, key := os.Getenv("ORDER_QUEUE_SAS_KEY_NAME"), os.Getenv("ORDER_QUEUE_SAS_KEY")
+	if hostname != "" && keyName != "" && key != "" {
+		return ServiceBusConnection{
+			Hostname:         hostname,
+			ConnectionString: fmt.Sprintf("Endpoint=sb://%s/;SharedAccessKeyName=%s;SharedAccessKey=%s", hostname, keyName, key),
+		}, true
+	}
+
+	if hostname != "" && os.Getenv("USE_WORKLOAD_IDENTITY_AUTH") == "true" {
+		return ServiceBusConnection{Hostname: hostname}, true
+	}
+	return ServiceBusConnection{}, false
+}
+
+// newServiceBusClient connects to a Service Bus namespace
+func newServiceBusClient(connection ServiceBusConnection) (*azservicebus.Client, error) {
+	if connection.ConnectionString != "" {
+		client, err := azservicebus.NewClientFromConnectionString(connection.ConnectionString, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create service bus client: %w", err)
+		}
+		return client, nil
+	}
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credential: %w", err)
+	}
+
+	client, err := azservicebus.NewClient(connection.Hostname, cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service bus client: %w", err)
+	}
+	return client, nil
+}
+
+// LOCK_RENEWAL_RETRY is the least time between two renewals of a message lock,
+// so a renewal that fails isn't retried in a tight loop
+const LOCK_RENEWAL_RETRY = time.Second
+
+// ServiceBusOrderSource consumes orders from an Azure Service Bus queue,
+// authenticating with Workload Identity or a connection string
+type ServiceBusOrderSource struct {
+	connection ServiceBusConnection
+	queueName  string
+	// maxLockRenewal is how long the locks on received messages are renewed
+	// while they are processed
+	maxLockRenewal time.Duration
+	// prefetch is how many messages are received, and locked, at once
+	prefetch int
+	client   *azservicebus.Client
+	receiver *azservicebus.Receiver
+	mu       sync.Mutex
+	// renewals stops the lock renewal of each message in hand
+	renewals map[*azservicebus.ReceivedMessage]context.CancelFunc
+}
+
+func NewServiceBusOrderSource(connection ServiceBusConnection, queueName string, prefetch int, maxLockRenewal time.Duration) *ServiceBusOrderSource {
+	return &ServiceBusOrderSource{
+		connection:     connection,
+		queueName:      queueName,
+		prefetch:       prefetch,
+		maxLockRenewal: maxLockRenewal,
+		renewals:       make(map[*azservicebus.ReceivedMessage]context.CancelFunc),
+	}
+}
+
+func (s *ServiceBusOrderSource) Transport() string {
+	return SERVICE_BUS_TRANSPORT
+}
+
+func (s *ServiceBusOrderSource) Name() string {
+	return s.queueName
+}
+
+func (s *ServiceBusOrderSource) Open(ctx context.Context) error {
+	client, err := newServiceBusClient(s.connection)
+	if err != nil {
+		return err
+	}
+
+	receiver, err := client.NewReceiverForQueue(s.queueName, nil)
+	if err != nil {
+		client.Close(ctx)
+		return fmt.Errorf("failed to create receiver: %w", err)
+	}
+
+	s.client, s.receiver = client, receiver
+	return nil
+}
+
+func (s *ServiceBusOrderSource) Close(ctx context.Context) error {
+	s.mu.Lock()
+	for message, stop := range s.renewals {
+		stop()
+		delete(s.renewals, message)
+	}
+	s.mu.Unlock()
+
+	s.receiver.Close(ctx)
+	return s.client.Close(ctx)
+}
+
+// Receive waits for up to prefetch messages. Messages are locked until they
+// are settled, and their locks are renewed in the background for up to
+// maxLockRenewal, so a slow database write doesn't let them be delivered
+// again.
+func (s *ServiceBusOrderSource) Receive(ctx context.Context) ([]*QueueMessage, error) {
+	received, err := s.receiver.ReceiveMessages(ctx, s.prefetch, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*QueueMessage, 0, len(received))
+	for _, message := range received {
+		messages = append(messages, &QueueMessage{
+			ID:            serviceBusIdempotencyKey(message),
+			Body:          unwrapServiceBusBody(message.Body),
+			ContentType:   serviceBusContentType(message),
+			Properties:    message.ApplicationProperties,
+			DeliveryCount: int(message.DeliveryCount),
+			raw:           message,
+		})
+		s.startLockRenewal(ctx, message)
+	}
+	return messages, nil
+}
+
+func (s *ServiceBusOrderSource) Ack(ctx context.Context, msg *QueueMessage) error {
+	message := s.stopLockRenewal(msg)
+	return s.settled(s.receiver.CompleteMessage(ctx, message, nil))
+}
+
+// Nack abandons the message, so it is delivered again straight away rather
+// than once its lock expires. Service Bus counts every delivery, and
+// dead-letters the message itself once the queue's maximum delivery count is
+// reached.
+func (s *ServiceBusOrderSource) Nack(ctx context.Context, msg *QueueMessage, failed bool) error {
+	message := s.stopLockRenewal(msg)
+	return s.settled(s.receiver.AbandonMessage(ctx, message, nil))
+}
+
+// DeadLetter moves the message to the queue's dead-letter subqueue
+func (s *ServiceBusOrderSource) DeadLetter(ctx context.Context, msg *QueueMessage, reason string, description string) error {
+	message := s.stopLockRenewal(msg)
+	return s.settled(s.receiver.DeadLetterMessage(ctx, message, &azservicebus.DeadLetterOptions{
+		Reason:           &reason,
+		ErrorDescription: &description,
+	}))
+}
+
+// Ping peeks at the queue. Peeking goes over the management link, so it
+// doesn't disturb receiving.
+func (s *ServiceBusOrderSource) Ping(ctx context.Context) error {
+	_, err := s.receiver.PeekMessages(ctx, 1, nil)
+	return err
+}
+
+// startLockRenewal renews the lock on message in the background until it is
+// settled or maxLockRenewal has passed. The renewal outlives ctx, which only
+// bounds the receive.
+func (s *ServiceBusOrderSource) startLockRenewal(ctx context.Context, message *azservicebus.ReceivedMessage) {
+	if s.maxLockRenewal <= 0 || message.LockedUntil == nil {
+		return
+	}
+
+	ctx, stop := context.WithTimeout(context.WithoutCancel(ctx), s.maxLockRenewal)
+	ctx = withLogAttrs(ctx, slog.String(LOG_MESSAGE_ID, message.MessageID))
+	s.mu.Lock()
+	s.renewals[message] = stop
+	s.mu.Unlock()
+
+	go s.renewLock(ctx, message)
+}
+
+// stopLockRenewal stops renewing the lock on the message before it is
+// settled
+func (s *ServiceBusOrderSource) stopLockRenewal(msg *QueueMessage) *azservicebus.ReceivedMessage {
+	message := msg.raw.(*azservicebus.ReceivedMessage)
+	s.mu.Lock()
+	if stop, ok := s.renewals[message]; ok {
+		stop()
+		delete(s.renewals, message)
+	}
+	s.mu.Unlock()
+	return message
+}
+
+// renewLock renews the lock on message once half of it has run out, until
+// ctx is done or the lock is lost
+func (s *ServiceBusOrderSource) renewLock(ctx context.Context, message *azservicebus.ReceivedMessage) {
+	for {
+		wait := max(time.Until(*message.LockedUntil)/2, LOCK_RENEWAL_RETRY)
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				slog.WarnContext(ctx, "Stopped renewing message lock, the message is taking longer than the maximum lock renewal",
+					"maxLockRenewal", s.maxLockRenewal.String())
+			}
+			return
+		case <-time.After(wait):
+		}
+
+		err := s.receiver.RenewMessageLock(ctx, message, nil)
+		switch {
+		case ctx.Err() != nil:
+			// settled or given up while renewing
+		case isLockLost(err):
+			// the message itself is counted in locksLost when settling it
+			// fails, so only the renewal is counted here
+			lockRenewals.WithLabelValues(SERVICE_BUS_TRANSPORT, "lost").Inc()
+			slog.WarnContext(ctx, "Message lock was lost", errAttr(err))
+			return
+		case err != nil:
+			lockRenewals.WithLabelValues(SERVICE_BUS_TRANSPORT, "error").Inc()
+			slog.ErrorContext(ctx, "Failed to renew message lock", errAttr(err))
+		default:
+			lockRenewals.WithLabelValues(SERVICE_BUS_TRANSPORT, "ok").Inc()
+		}
+	}
+}
+
+// settled counts a message whose lock was lost before it could be settled.
+// It will be delivered again, and skipped then if its order was stored.
+func (s *ServiceBusOrderSource) settled(err error) error {
+	if isLockLost(err) {
+		locksLost.WithLabelValues(SERVICE_BUS_TRANSPORT).Inc()
+	}
+	return err
+}
+
+// isLockLost reports whether err is Service Bus saying the message lock expired
+func isLockLost(err error) bool {
+	var sbErr *azservicebus.Error
+	return errors.As(err, &sbErr) && sbErr.Code == azservicebus.CodeLockLost
+}
+
+// ServiceBusDeadLetterQueue is the dead-letter subqueue of a Service Bus
+// queue. Messages are identified by their sequence number.
+type ServiceBusDeadLetterQueue struct {
+	connection ServiceBusConnection
+	queueName  string
+	client     *azservicebus.Client
+	receiver   *azservicebus.Receiver
+}
+
+func NewServiceBusDeadLetterQueue(connection ServiceBusConnection, queueName string) *ServiceBusDeadLetterQueue {
+	return &ServiceBusDeadLetterQueue{connection: connection, queueName: queueName}
+}
+
+func (q *ServiceBusDeadLetterQueue) Name() string {
+	return q.queueName + "/$DeadLetterQueue"
+}
+
+func (q *ServiceBusDeadLetterQueue) Open(ctx context.Context) error {
+	client, err := newServiceBusClient(q.connection)
+	if err != nil {
+		return err
+	}
+
+	receiver, err := client.NewReceiverForQueue(q.queueName, &azservicebus.ReceiverOptions{
+		SubQueue: azservicebus.SubQueueDeadLetter,
+	})
+	if err != nil {
+		client.Close(ctx)
+		return fmt.Errorf("failed to create receiver: %w", err)
+	}
+
+	q.client, q.receiver = client, receiver
+	return nil
+}
+
+func (q *ServiceBusDeadLetterQueue) Close(ctx context.Context) error {
+	q.receiver.Close(ctx)
+	return q.client.Close(ctx)
+}
+
+func (q *ServiceBusDeadLetterQueue) Peek(ctx context.Context, max int) ([]*DeadLetteredMessage, error) {
+	peeked, err := q.receiver.PeekMessages(ctx, max, nil)
+	if err != nil {
+		return nil, err
+	}
+	return serviceBusDeadLetters(peeked), nil
+}
+
+func (q *ServiceBusDeadLetterQueue) Receive(ctx context.Context, max int) ([]*DeadLetteredMessage, error) {
+	recvCtx, cancel := context.WithTimeout(ctx, DEAD_LETTER_RECEIVE_TIMEOUT)
+	defer cancel()
+
+	received, err := q.receiver.ReceiveMessages(recvCtx, max, nil)
+	if err != nil {
+		// Timeout just means the queue has no more messages
+		if ctx.Err() == nil && recvCtx.Err() != nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return serviceBusDeadLetters(received), nil
+}
+
+func (q *ServiceBusDeadLetterQueue) Remove(ctx context.Context, msg *DeadLetteredMessage) error {
+	return q.receiver.CompleteMessage(ctx, msg.raw.(*azservicebus.ReceivedMessage), nil)
+}
+
+func (q *ServiceBusDeadLetterQueue) Release(ctx context.Context, msg *DeadLetteredMessage) error {
+	return q.receiver.AbandonMessage(ctx, msg.raw.(*azservicebus.ReceivedMessage), nil)
+}
+
+// serviceBusDeadLetters converts messages from the dead-letter subqueue
+func serviceBusDeadLetters(received []*azservicebus.ReceivedMessage) []*DeadLetteredMessage {
+	messages := make([]*DeadLetteredMessage, 0, len(received))
+	for _, message := range received {
+		msg := &DeadLetteredMessage{
+			Body:          string(unwrapServiceBusBody(message.Body)),
+			DeliveryCount: int(message.DeliveryCount),
+			key:           serviceBusIdempotencyKey(message),
+			contentType:   serviceBusContentType(message),
+			properties:    message.ApplicationProperties,
+			raw:           message,
+		}
+		if message.SequenceNumber != nil {
+			msg.ID = strconv.FormatInt(*message.SequenceNumber, 10)
+		}
+		if message.DeadLetterReason != nil {
+			msg.Reason = *message.DeadLetterReason
+		}
+		if message.DeadLetterErrorDescription != nil {
+			msg.Description = *message.DeadLetterErrorDescription
+		}
+		if message.EnqueuedTime != nil {
+			msg.EnqueuedAt = *message.EnqueuedTime
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// ServiceBusEventPublisher sends lifecycle events to a Service Bus topic
+type ServiceBusEventPublisher struct {
+	connection ServiceBusConnection
+	topicName  string
+	mode       string
+	client     *azservicebus.Client
+	sender     *azservicebus.Sender
+}
+
+func NewServiceBusEventPublisher(connection ServiceBusConnection, topicName string, mode string) *ServiceBusEventPublisher {
+	return &ServiceBusEventPublisher{connection: connection, topicName: topicName, mode: mode}
+}
+
+func (p *ServiceBusEventPublisher) Name() string {
+	return p.topicName
+}
+
+func (p *ServiceBusEventPublisher) Open(ctx context.Context) error {
+	client, err := newServiceBusClient(p.connection)
+	if err != nil {
+		return err
+	}
+
+	sender, err := client.NewSender(p.topicName, nil)
+	if err != nil {
+		client.Close(ctx)
+		return fmt.Errorf("failed to create sender: %w", err)
+	}
+
+	p.client, p.sender = client, sender
+	return nil
+}
+
+func (p *ServiceBusEventPublisher) Close(ctx context.Context) error {
+	p.sender.Close(ctx)
+	return p.client.Close(ctx)
+}
+
+// Publish sends the event with its ID as the MessageID, so duplicate
+// detection on the topic drops events that were published twice
+func (p *ServiceBusEventPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	cloudEvent, err := newLifecycleCloudEvent(event)
+	if err != nil {
+		return err
+	}
+	body, contentType, properties, err := encodeCloudEvent(cloudEvent, p.mode)
+	if err != nil {
+		return err
+	}
+
+	return p.sender.SendMessage(ctx, &azservicebus.Message{
+		MessageID:             &event.ID,
+		Subject:               &event.Type,
+		ContentType:           &contentType,
+		ApplicationProperties: properties,
+		Body:                  body,
+	}, nil)
+}
+
+// unwrapServiceBusBody returns the order JSON in a Service Bus message body,
+// which wraps the JSON as a quoted string. A body that isn't wrapped is
+// returned as is, and fails to unmarshal as an order.
+func unwrapServiceBusBody(body []byte) []byte {
+	var jsonStr string
+	if err := json.Unmarshal(body, &jsonStr); err != nil {
+		return body
+	}
+	return []byte(jsonStr)
+}
+
+// serviceBusContentType returns the content type of a Service Bus message,
+// if the producer set one
+func serviceBusContentType(message *azservicebus.ReceivedMessage) string {
+	if message.ContentType == nil {
+		return ""
+	}
+	return *message.ContentType
+}
+
+// serviceBusIdempotencyKey returns the key used to deduplicate a Service Bus
+// message: the producer's idempotency key if set, otherwise the MessageID
+func serviceBusIdempotencyKey(message *azservicebus.ReceivedMessage) string {
+	if key, ok := message.ApplicationProperties[IDEMPOTENCY_KEY_PROPERTY].(string); ok && key != "" {
+		return key
+	}
+	return message.MessageID
+}
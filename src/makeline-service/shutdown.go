@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SHUTDOWN_TIMEOUT bounds how long the service waits on shutdown for HTTP
+// requests to drain and the consumer to settle its current message. It is
+// kept below the 30 second grace period Kubernetes gives a pod by default.
+const SHUTDOWN_TIMEOUT = 20 * time.Second
+
+// sleepContext waits for d, or until ctx is done. It reports whether the full
+// duration passed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// waitContext waits for wg, or until ctx is done, and returns ctx's error if
+// it gave up waiting
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
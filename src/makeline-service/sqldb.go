@@ -0,0 +1,839 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlOrderRepo implements OrderRepo on top of database/sql for the relational
+// backends. Queries are written with ? placeholders and rewritten for drivers
+// that use numbered placeholders.
+type sqlOrderRepo struct {
+	db                  *sql.DB
+	numberedPlaceholder bool
+	// lockClause is appended to queries that pick rows to claim, so concurrent
+	// claims skip rows that are already being claimed
+	lockClause string
+	// outbox is set when lifecycle events are stored in order_outbox
+	outbox bool
+}
+
+// orderColumns are the columns scanOrderRows expects, in order, from a query
+// over orders o left joined with order_items i
+const orderColumns = `o.id, o.order_id, o.customer_id, o.status, o.message_id, o.created_at, o.updated_at,
+	o.claimed_by, o.lease_expires_at, i.product_id, i.quantity, i.price`
+
+// bind rewrites ? placeholders to $1, $2, ... when the driver needs them
+func (r *sqlOrderRepo) bind(query string) string {
+	if !r.numberedPlaceholder {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// migrationLock serializes replicas that migrate the same database at the
+// same time. lock takes a lock held by the connection's session, and unlock
+// releases it.
+type migrationLock struct {
+	lock   string
+	unlock string
+}
+
+// migrate brings the schema up to the latest version in migrations. Each
+// migration runs in its own transaction together with its version record.
+// The whole run happens on one connection, which holds lock, if set, from
+// before schema_migrations is created until the last migration is applied.
+func (r *sqlOrderRepo) migrate(ctx context.Context, migrations []string, lock *migrationLock) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if lock != nil {
+		if _, err := conn.ExecContext(ctx, lock.lock); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), lock.unlock); err != nil {
+				slog.WarnContext(ctx, "Failed to release schema migration lock", errAttr(err))
+			}
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	for i, migration := range migrations {
+		version := i + 1
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		var applied bool
+		err = tx.QueryRowContext(ctx, r.bind("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)"), version).Scan(&applied)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if applied {
+			tx.Rollback()
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, migration); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, r.bind("INSERT INTO schema_migrations (version) VALUES (?)"), version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		slog.Info("Applied database schema migration", "version", version)
+	}
+
+	return nil
+}
+
+func (r *sqlOrderRepo) GetPendingOrders(ctx context.Context) ([]Order, error) {
+	rows, err := r.db.QueryContext(ctx, r.bind(`
+		SELECT `+orderColumns+`
+		FROM orders o
+		LEFT JOIN order_items i ON i.order_pk = o.id
+		WHERE o.status = ?
+		ORDER BY o.id, i.line_number`), Pending)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find records", errAttr(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders, pks, err := scanOrderRows(rows)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to decode order", errAttr(err))
+		return nil, err
+	}
+
+	err = r.loadStatusHistory(ctx, orders, pks, `
+		SELECT h.order_pk, h.status, h.changed_at, h.actor
+		FROM order_status_history h
+		JOIN orders o ON o.id = h.order_pk
+		WHERE o.status = ?
+		ORDER BY h.order_pk, h.id`, Pending)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load status history", errAttr(err))
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (r *sqlOrderRepo) CountPendingOrders(ctx context.Context) (int, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, r.bind("SELECT COUNT(*) FROM orders WHERE status = ?"), Pending).Scan(&count)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to count records", errAttr(err))
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *sqlOrderRepo) GetOrder(ctx context.Context, id string) (Order, error) {
+	order, err := r.getOrder(ctx, "(SELECT id FROM orders WHERE order_id = ? ORDER BY id LIMIT 1)", id)
+	if errors.Is(err, ErrOrderNotFound) {
+		slog.DebugContext(ctx, "Order not found")
+	}
+	return order, err
+}
+
+// getOrder loads the order whose primary key is pkExpr, a SQL expression
+// with a single placeholder bound to arg
+func (r *sqlOrderRepo) getOrder(ctx context.Context, pkExpr string, arg any) (Order, error) {
+	rows, err := r.db.QueryContext(ctx, r.bind(`
+		SELECT `+orderColumns+`
+		FROM orders o
+		LEFT JOIN order_items i ON i.order_pk = o.id
+		WHERE o.id = `+pkExpr+`
+		ORDER BY i.line_number`), arg)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find order", errAttr(err))
+		return Order{}, err
+	}
+	defer rows.Close()
+
+	orders, pks, err := scanOrderRows(rows)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to decode order", errAttr(err))
+		return Order{}, err
+	}
+	if len(orders) == 0 {
+		return Order{}, ErrOrderNotFound
+	}
+
+	err = r.loadStatusHistory(ctx, orders, pks, `
+		SELECT order_pk, status, changed_at, actor
+		FROM order_status_history
+		WHERE order_pk = ?
+		ORDER BY id`, pks[0])
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load status history", errAttr(err))
+		return Order{}, err
+	}
+
+	return orders[0], nil
+}
+
+func (r *sqlOrderRepo) InsertOrders(ctx context.Context, orders []Order) error {
+	if len(orders) == 0 {
+		slog.DebugContext(ctx, "No orders to insert into database")
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to begin transaction", errAttr(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	var inserted int
+	for _, o := range orders {
+		var orderPk int64
+		err := tx.QueryRowContext(ctx, r.bind(`
+			INSERT INTO orders (order_id, customer_id, status, message_id, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (message_id) WHERE message_id IS NOT NULL DO NOTHING
+			RETURNING id`),
+			o.OrderID, o.CustomerID, o.Status, nullString(o.MessageID), nullTime(o.CreatedAt), nullTime(o.UpdatedAt)).Scan(&orderPk)
+		if errors.Is(err, sql.ErrNoRows) {
+			// an order from this message was already ingested
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to insert order", errAttr(err))
+			return err
+		}
+		inserted++
+
+		if err := r.insertOutboxEvents(ctx, tx, newOrderReceivedEvent(o)); err != nil {
+			slog.ErrorContext(ctx, "Failed to insert outbox event", errAttr(err))
+			return err
+		}
+
+		for line, item := range o.Items {
+			_, err := tx.ExecContext(ctx, r.bind(
+				"INSERT INTO order_items (order_pk, line_number, product_id, quantity, price) VALUES (?, ?, ?, ?, ?)"),
+				orderPk, line, item.Product, item.Quantity, item.Price)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to insert order item", errAttr(err))
+				return err
+			}
+		}
+
+		for _, change := range o.StatusHistory {
+			if err := r.insertStatusChange(ctx, tx, orderPk, change); err != nil {
+				slog.ErrorContext(ctx, "Failed to insert order status history", errAttr(err))
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(ctx, "Failed to commit orders", errAttr(err))
+		return err
+	}
+
+	slog.InfoContext(ctx, "Inserted orders into database", "count", inserted)
+	if skipped := len(orders) - inserted; skipped > 0 {
+		slog.InfoContext(ctx, "Skipped orders that were already ingested", "count", skipped)
+	}
+	return nil
+}
+
+func (r *sqlOrderRepo) UpdateOrder(ctx context.Context, order Order, actor string) error {
+	var orderPk int64
+	current := func() (Order, error) {
+		var existing Order
+		var claimedBy sql.NullString
+		var leaseExpiresAt sql.NullTime
+		err := r.db.QueryRowContext(ctx, r.bind(
+			"SELECT id, status, claimed_by, lease_expires_at FROM orders WHERE order_id = ? ORDER BY id LIMIT 1"),
+			order.OrderID).Scan(&orderPk, &existing.Status, &claimedBy, &leaseExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return existing, ErrOrderNotFound
+		}
+		existing.ClaimedBy = claimedBy.String
+		existing.LeaseExpiresAt = leaseExpiresAt.Time
+		return existing, err
+	}
+
+	// Only update if the status and lease holder are still the ones the
+	// transition was checked against, and record the change in the same
+	// transaction
+	swap := func(from Order) (bool, error) {
+		change := newStatusChange(order.Status, actor)
+
+		tx, err := r.db.BeginTx(ctx, nil)
+		if err != nil {
+			return false, err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.ExecContext(ctx, r.bind(
+			"UPDATE orders SET status = ?, updated_at = ?, claimed_by = NULL, lease_expires_at = NULL WHERE id = ? AND status = ? AND COALESCE(claimed_by, '') = ?"),
+			order.Status, change.Timestamp, orderPk, from.Status, from.ClaimedBy)
+		if err != nil {
+			return false, err
+		}
+
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if updated == 0 {
+			return false, nil
+		}
+
+		if err := r.insertStatusChange(ctx, tx, orderPk, change); err != nil {
+			return false, err
+		}
+		if err := r.insertOutboxEvents(ctx, tx, newStatusChangeEvents(order.OrderID, from.Status, change)...); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+
+		slog.DebugContext(ctx, "Updated orders", "count", updated)
+		return true, nil
+	}
+
+	// Update the order
+	slog.DebugContext(ctx, "Updating order", "status", order.Status.String())
+	if err := applyStatusTransition(order.OrderID, order.Status, order.ClaimedBy, current, swap); err != nil {
+		slog.WarnContext(ctx, "Failed to update order", errAttr(err))
+		return err
+	}
+
+	return nil
+}
+
+func (r *sqlOrderRepo) ClaimOrders(ctx context.Context, workerID string, count int, ttl time.Duration) ([]Order, error) {
+	change := newStatusChange(Processing, workerID)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to begin transaction", errAttr(err))
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Pick the oldest pending orders. The rows stay locked until commit, so a
+	// concurrent claim picks different ones.
+	pks, err := queryPks(ctx, tx, r.bind("SELECT id FROM orders WHERE status = ? ORDER BY id LIMIT ? "+r.lockClause), Pending, count)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find pending orders", errAttr(err))
+		return nil, err
+	}
+
+	for _, pk := range pks {
+		_, err := tx.ExecContext(ctx, r.bind(
+			"UPDATE orders SET status = ?, updated_at = ?, claimed_by = ?, lease_expires_at = ? WHERE id = ?"),
+			Processing, change.Timestamp, workerID, change.Timestamp.Add(ttl), pk)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to claim order", errAttr(err))
+			return nil, err
+		}
+		if err := r.insertStatusChange(ctx, tx, pk, change); err != nil {
+			slog.ErrorContext(ctx, "Failed to insert order status history", errAttr(err))
+			return nil, err
+		}
+		if r.outbox {
+			var orderID string
+			if err := tx.QueryRowContext(ctx, r.bind("SELECT order_id FROM orders WHERE id = ?"), pk).Scan(&orderID); err != nil {
+				return nil, err
+			}
+			if err := r.insertOutboxEvents(ctx, tx, newStatusChangeEvents(orderID, Pending, change)...); err != nil {
+				slog.ErrorContext(ctx, "Failed to insert outbox event", errAttr(err))
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(ctx, "Failed to commit claimed orders", errAttr(err))
+		return nil, err
+	}
+
+	var claimed []Order
+	for _, pk := range pks {
+		order, err := r.getOrder(ctx, "?", pk)
+		if err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, order)
+	}
+
+	slog.InfoContext(ctx, "Claimed orders", "count", len(claimed), "workerId", workerID)
+	return claimed, nil
+}
+
+func (r *sqlOrderRepo) ReleaseExpiredLeases(ctx context.Context) (int, error) {
+	change := newStatusChange(Pending, LEASE_EXPIRED_ACTOR)
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to begin transaction", errAttr(err))
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, r.bind(
+		"SELECT id, order_id, lease_expires_at FROM orders WHERE status = ? AND lease_expires_at IS NOT NULL "+r.lockClause),
+		Processing)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find claimed orders", errAttr(err))
+		return 0, err
+	}
+
+	// Lease expiry is compared here rather than in the query, since not every
+	// driver stores timestamps in a form that compares correctly in SQL
+	var expired []int64
+	var orderIDs []string
+	for rows.Next() {
+		var pk int64
+		var orderID string
+		var leaseExpiresAt time.Time
+		if err := rows.Scan(&pk, &orderID, &leaseExpiresAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if leaseExpiresAt.Before(change.Timestamp) {
+			expired = append(expired, pk)
+			orderIDs = append(orderIDs, orderID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, pk := range expired {
+		_, err := tx.ExecContext(ctx, r.bind(
+			"UPDATE orders SET status = ?, updated_at = ?, claimed_by = NULL, lease_expires_at = NULL WHERE id = ?"),
+			Pending, change.Timestamp, pk)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to release order", errAttr(err))
+			return 0, err
+		}
+		if err := r.insertStatusChange(ctx, tx, pk, change); err != nil {
+			slog.ErrorContext(ctx, "Failed to insert order status history", errAttr(err))
+			return 0, err
+		}
+		if err := r.insertOutboxEvents(ctx, tx, newStatusChangeEvents(orderIDs[i], Processing, change)...); err != nil {
+			slog.ErrorContext(ctx, "Failed to insert outbox event", errAttr(err))
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(ctx, "Failed to commit released orders", errAttr(err))
+		return 0, err
+	}
+
+	return len(expired), nil
+}
+
+func (r *sqlOrderRepo) ListOrders(ctx context.Context, query OrderQuery) (OrderPage, error) {
+	// The primary key follows insertion order, so it doubles as the sort key
+	// and the cursor
+	direction, after := "ASC", ">"
+	if query.Descending {
+		direction, after = "DESC", "<"
+	}
+
+	var conditions []string
+	var args []any
+	if query.Cursor != "" {
+		position, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return OrderPage{}, err
+		}
+		lastPk, err := strconv.ParseInt(position, 10, 64)
+		if err != nil {
+			return OrderPage{}, ErrInvalidCursor
+		}
+		conditions = append(conditions, "o.id "+after+" ?")
+		args = append(args, lastPk)
+	}
+	if len(query.Statuses) > 0 {
+		conditions = append(conditions, "o.status IN ("+placeholders(len(query.Statuses))+")")
+		for _, status := range query.Statuses {
+			args = append(args, status)
+		}
+	}
+	if query.CustomerID != "" {
+		conditions = append(conditions, "o.customer_id = ?")
+		args = append(args, query.CustomerID)
+	}
+	if query.ProductID != 0 {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM order_items i WHERE i.order_pk = o.id AND i.product_id = ?)")
+		args = append(args, query.ProductID)
+	}
+	// timestamps are always written in UTC, so bounds must be too for the
+	// comparison to hold on drivers that store them as text
+	if !query.CreatedFrom.IsZero() {
+		conditions = append(conditions, "o.created_at >= ?")
+		args = append(args, query.CreatedFrom.UTC())
+	}
+	if !query.CreatedTo.IsZero() {
+		conditions = append(conditions, "o.created_at < ?")
+		args = append(args, query.CreatedTo.UTC())
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// fetch one extra row to know whether there is another page
+	limit := query.PageSize()
+	pks, err := queryPks(ctx, r.db, r.bind("SELECT o.id FROM orders o "+where+" ORDER BY o.id "+direction+" LIMIT ?"), append(args, limit+1)...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find records", errAttr(err))
+		return OrderPage{}, err
+	}
+
+	page := OrderPage{Orders: []Order{}}
+	if len(pks) > limit {
+		pks = pks[:limit]
+		page.NextCursor = encodeCursor(strconv.FormatInt(pks[len(pks)-1], 10))
+	}
+	if len(pks) == 0 {
+		return page, nil
+	}
+
+	pkArgs := make([]any, len(pks))
+	for i, pk := range pks {
+		pkArgs[i] = pk
+	}
+
+	rows, err := r.db.QueryContext(ctx, r.bind(`
+		SELECT `+orderColumns+`
+		FROM orders o
+		LEFT JOIN order_items i ON i.order_pk = o.id
+		WHERE o.id IN (`+placeholders(len(pks))+`)
+		ORDER BY o.id `+direction+`, i.line_number`), pkArgs...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find records", errAttr(err))
+		return OrderPage{}, err
+	}
+	defer rows.Close()
+
+	orders, orderPks, err := scanOrderRows(rows)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to decode order", errAttr(err))
+		return OrderPage{}, err
+	}
+
+	err = r.loadStatusHistory(ctx, orders, orderPks, `
+		SELECT order_pk, status, changed_at, actor
+		FROM order_status_history
+		WHERE order_pk IN (`+placeholders(len(pks))+`)
+		ORDER BY order_pk, id`, pkArgs...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load status history", errAttr(err))
+		return OrderPage{}, err
+	}
+
+	page.Orders = append(page.Orders, orders...)
+	return page, nil
+}
+
+func (r *sqlOrderRepo) EnableOutbox() {
+	r.outbox = true
+}
+
+// ClaimOutboxEvents only returns events to the relay that holds the lease in
+// outbox_relay, so a single replica publishes the outbox in order. Another
+// replica takes over once the lease expires.
+func (r *sqlOrderRepo) ClaimOutboxEvents(ctx context.Context, relayID string, limit int) ([]OutboxEvent, error) {
+	leased, err := r.leaseOutbox(ctx, relayID)
+	if err != nil || !leased {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, r.bind("SELECT payload FROM order_outbox ORDER BY id LIMIT ?"), limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to find outbox events", errAttr(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var event OutboxEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			slog.ErrorContext(ctx, "Failed to decode outbox event", errAttr(err))
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// leaseOutbox takes or renews the outbox lease for the relay, and reports
+// whether the relay holds it
+func (r *sqlOrderRepo) leaseOutbox(ctx context.Context, relayID string) (bool, error) {
+	now := time.Now().UTC()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to begin transaction", errAttr(err))
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var holder sql.NullString
+	var leaseExpiresAt sql.NullTime
+	err = tx.QueryRowContext(ctx, "SELECT relay_id, lease_expires_at FROM outbox_relay WHERE id = 1 "+r.lockClause).Scan(&holder, &leaseExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		// another replica is taking or renewing the lease
+		return false, nil
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read outbox lease", errAttr(err))
+		return false, err
+	}
+
+	// Lease expiry is compared here rather than in the query, as for orders
+	if holder.String != relayID && leaseExpiresAt.Valid && !leaseExpiresAt.Time.Before(now) {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, r.bind("UPDATE outbox_relay SET relay_id = ?, lease_expires_at = ? WHERE id = 1"), relayID, now.Add(OUTBOX_CLAIM_TTL))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to renew outbox lease", errAttr(err))
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(ctx, "Failed to commit outbox lease", errAttr(err))
+		return false, err
+	}
+
+	if holder.String != relayID {
+		slog.InfoContext(ctx, "Acquired the outbox lease", "relayId", relayID)
+	}
+	return true, nil
+}
+
+func (r *sqlOrderRepo) DeleteOutboxEvents(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := r.db.ExecContext(ctx, r.bind("DELETE FROM order_outbox WHERE event_id IN ("+placeholders(len(ids))+")"), args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to delete outbox events", errAttr(err))
+	}
+	return err
+}
+
+func (r *sqlOrderRepo) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+func (r *sqlOrderRepo) Close(ctx context.Context) error {
+	return r.db.Close()
+}
+
+func (r *sqlOrderRepo) insertStatusChange(ctx context.Context, tx *sql.Tx, orderPk int64, change StatusChange) error {
+	_, err := tx.ExecContext(ctx, r.bind(
+		"INSERT INTO order_status_history (order_pk, status, changed_at, actor) VALUES (?, ?, ?, ?)"),
+		orderPk, change.Status, change.Timestamp, change.Actor)
+	return err
+}
+
+// insertOutboxEvents stores events in the outbox in the transaction of the
+// change they describe, if the outbox is enabled
+func (r *sqlOrderRepo) insertOutboxEvents(ctx context.Context, tx *sql.Tx, events ...OutboxEvent) error {
+	if !r.outbox {
+		return nil
+	}
+
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, r.bind(
+			"INSERT INTO order_outbox (event_id, payload, created_at) VALUES (?, ?, ?)"),
+			event.ID, string(payload), event.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadStatusHistory runs query, which must return (order_pk, status,
+// changed_at, actor) rows in history order, and attaches the entries to the
+// orders with the matching primary keys
+func (r *sqlOrderRepo) loadStatusHistory(ctx context.Context, orders []Order, pks []int64, query string, args ...any) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byPk := make(map[int64]*Order, len(orders))
+	for i := range orders {
+		byPk[pks[i]] = &orders[i]
+	}
+
+	rows, err := r.db.QueryContext(ctx, r.bind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pk int64
+		var change StatusChange
+		if err := rows.Scan(&pk, &change.Status, &change.Timestamp, &change.Actor); err != nil {
+			return err
+		}
+		if order, ok := byPk[pk]; ok {
+			order.StatusHistory = append(order.StatusHistory, change)
+		}
+	}
+
+	return rows.Err()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// queryPks runs a query that selects a single primary key column
+func queryPks(ctx context.Context, q queryer, query string, args ...any) ([]int64, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pks []int64
+	for rows.Next() {
+		var pk int64
+		if err := rows.Scan(&pk); err != nil {
+			return nil, err
+		}
+		pks = append(pks, pk)
+	}
+	return pks, rows.Err()
+}
+
+// scanOrderRows folds the rows of an orders/order_items join back into orders
+// and returns them with their primary keys. Rows must select orderColumns and
+// be sorted so that all items of an order are adjacent.
+func scanOrderRows(rows *sql.Rows) ([]Order, []int64, error) {
+	var orders []Order
+	var pks []int64
+
+	for rows.Next() {
+		var (
+			pk        int64
+			order     Order
+			messageId sql.NullString
+			createdAt sql.NullTime
+			updatedAt sql.NullTime
+			claimedBy sql.NullString
+			leaseEnd  sql.NullTime
+			productId sql.NullInt64
+			quantity  sql.NullInt64
+			price     sql.NullFloat64
+		)
+		if err := rows.Scan(&pk, &order.OrderID, &order.CustomerID, &order.Status, &messageId, &createdAt, &updatedAt, &claimedBy, &leaseEnd, &productId, &quantity, &price); err != nil {
+			return nil, nil, err
+		}
+
+		order.MessageID = messageId.String
+		order.CreatedAt = createdAt.Time
+		order.UpdatedAt = updatedAt.Time
+		order.ClaimedBy = claimedBy.String
+		order.LeaseExpiresAt = leaseEnd.Time
+
+		if len(orders) == 0 || pk != pks[len(pks)-1] {
+			orders = append(orders, order)
+			pks = append(pks, pk)
+		}
+
+		if productId.Valid {
+			current := &orders[len(orders)-1]
+			current.Items = append(current.Items, Item{
+				Product:  int(productId.Int64),
+				Quantity: int(quantity.Int64),
+				Price:    price.Float64,
+			})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return orders, pks, nil
+}
+
+// placeholders returns n comma separated ? placeholders for an IN list
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// nullString maps an empty string to SQL NULL, so optional columns with a
+// unique index don't collide on empty values
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullTime maps the zero time to SQL NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
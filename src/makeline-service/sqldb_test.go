@@ -0,0 +1,87 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "migrations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	repo := &sqlOrderRepo{db: db}
+
+	// each migration records that it ran, and the later ones depend on the
+	// table the first one creates
+	migrations := []string{
+		`CREATE TABLE steps (version INTEGER)`,
+		`INSERT INTO steps (version) VALUES (2)`,
+		`INSERT INTO steps (version) VALUES (3)`,
+	}
+
+	versions := func(query string) []int {
+		t.Helper()
+		rows, err := db.QueryContext(t.Context(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var versions []int
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				t.Fatal(err)
+			}
+			versions = append(versions, version)
+		}
+		return versions
+	}
+	steps := func() []int { return versions("SELECT version FROM steps ORDER BY rowid") }
+	applied := func() []int { return versions("SELECT version FROM schema_migrations ORDER BY version") }
+
+	if err := repo.migrate(t.Context(), migrations, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := steps(), []int{2, 3}; !slices.Equal(got, want) {
+		t.Errorf("got steps %v, want %v", got, want)
+	}
+	if got, want := applied(), []int{1, 2, 3}; !slices.Equal(got, want) {
+		t.Errorf("got versions %v applied, want %v", got, want)
+	}
+
+	// migrating again is a no-op
+	if err := repo.migrate(t.Context(), migrations, nil); err != nil {
+		t.Fatalf("got error %v migrating twice", err)
+	}
+	if got, want := steps(), []int{2, 3}; !slices.Equal(got, want) {
+		t.Errorf("got steps %v after migrating twice, want %v", got, want)
+	}
+
+	// only a new migration is applied
+	migrations = append(migrations, `INSERT INTO steps (version) VALUES (4)`)
+	if err := repo.migrate(t.Context(), migrations, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := steps(), []int{2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("got steps %v after adding a migration, want %v", got, want)
+	}
+	if got, want := applied(), []int{1, 2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("got versions %v applied, want %v", got, want)
+	}
+
+	// a failing migration is rolled back with its version
+	migrations = append(migrations, `INSERT INTO steps (version) VALUES (5); INSERT INTO missing (version) VALUES (5)`)
+	if err := repo.migrate(t.Context(), migrations, nil); err == nil {
+		t.Fatal("got no error from a failing migration")
+	}
+	if got, want := steps(), []int{2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("got steps %v after a failing migration, want %v", got, want)
+	}
+	if got, want := applied(), []int{1, 2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("got versions %v applied after a failing migration, want %v", got, want)
+	}
+}
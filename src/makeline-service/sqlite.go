@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order on startup. Each entry is a schema
+// version; never edit a migration that has shipped, append a new one instead.
+var sqliteMigrations = []string{
+	// 1: orders and their line items
+	`CREATE TABLE IF NOT EXISTS orders (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id    TEXT    NOT NULL,
+		customer_id TEXT    NOT NULL,
+		status      INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS orders_order_id_idx ON orders (order_id);
+	CREATE INDEX IF NOT EXISTS orders_status_idx ON orders (status);
+	CREATE TABLE IF NOT EXISTS order_items (
+		order_pk    INTEGER NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+		line_number INTEGER NOT NULL,
+		product_id  INTEGER NOT NULL,
+		quantity    INTEGER NOT NULL,
+		price       REAL    NOT NULL,
+		PRIMARY KEY (order_pk, line_number)
+	);`,
+	// 2: message id of the queue message each order came from, for idempotent inserts
+	`ALTER TABLE orders ADD COLUMN message_id TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS orders_message_id_idx ON orders (message_id) WHERE message_id IS NOT NULL;`,
+	// 3: timestamps and status history
+	`ALTER TABLE orders ADD COLUMN created_at DATETIME;
+	ALTER TABLE orders ADD COLUMN updated_at DATETIME;
+	CREATE TABLE IF NOT EXISTS order_status_history (
+		id         INTEGER  PRIMARY KEY AUTOINCREMENT,
+		order_pk   INTEGER  NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+		status     INTEGER  NOT NULL,
+		changed_at DATETIME NOT NULL,
+		actor      TEXT     NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS order_status_history_order_pk_idx ON order_status_history (order_pk);`,
+	// 4: leases held by workers that claimed an order
+	`ALTER TABLE orders ADD COLUMN claimed_by TEXT;
+	ALTER TABLE orders ADD COLUMN lease_expires_at DATETIME;`,
+	// 5: outbox of lifecycle events waiting to be published
+	`CREATE TABLE IF NOT EXISTS order_outbox (
+		id         INTEGER  PRIMARY KEY AUTOINCREMENT,
+		event_id   TEXT     NOT NULL UNIQUE,
+		payload    TEXT     NOT NULL,
+		created_at DATETIME NOT NULL
+	);`,
+	// 6: lease of the replica that relays the outbox
+	`CREATE TABLE IF NOT EXISTS outbox_relay (
+		id               INTEGER PRIMARY KEY,
+		relay_id         TEXT,
+		lease_expires_at DATETIME
+	);
+	INSERT INTO outbox_relay (id) VALUES (1);`,
+}
+
+// SQLiteOrderRepo stores orders in a local SQLite file using a pure Go driver,
+// so the service needs neither a database server nor cgo.
+type SQLiteOrderRepo struct {
+	sqlOrderRepo
+}
+
+func NewSQLiteOrderRepo(path string) (*SQLiteOrderRepo, error) {
+	ctx := context.Background()
+
+	// WAL lets readers run alongside the writer, and immediate transactions make
+	// writers wait on busy_timeout instead of failing on lock upgrade
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", "journal_mode(WAL)")
+	pragmas.Add("_pragma", "busy_timeout(5000)")
+	pragmas.Add("_pragma", "foreign_keys(1)")
+	pragmas.Add("_pragma", "synchronous(NORMAL)")
+	pragmas.Set("_txlock", "immediate")
+	dsn := "file:" + path + "?" + pragmas.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to open SQLite database", errAttr(err))
+		return nil, err
+	}
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to ping database", errAttr(err))
+		db.Close()
+		return nil, err
+	} else {
+		slog.Info("Opened SQLite database", "path", path)
+	}
+
+	repo := &SQLiteOrderRepo{sqlOrderRepo{db: db}}
+	if err := repo.migrate(ctx, sqliteMigrations, nil); err != nil {
+		slog.ErrorContext(ctx, "Failed to migrate database schema", errAttr(err))
+		db.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// SERVICE_NAME identifies this service in traces unless OTEL_SERVICE_NAME is set
+	SERVICE_NAME = "makeline-service"
+	// ORDER_ID_ATTRIBUTE is the span attribute for the order a span works on
+	ORDER_ID_ATTRIBUTE = "order.id"
+)
+
+// tracer creates the spans this service starts itself
+var tracer = otel.Tracer("aks-store-demo/makeline-service")
+
+// initTracing sets up the global tracer provider to export spans over OTLP.
+// Tracing stays off unless an OTLP endpoint is configured with the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// variables. The returned function flushes pending spans.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	// trace context is propagated even when spans aren't exported, so traces
+	// from upstream services aren't broken by this one
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		slog.Info("OTEL_EXPORTER_OTLP_ENDPOINT is not set, tracing is disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = SERVICE_NAME
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(os.Getenv("APP_VERSION")),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	slog.Info("Exporting traces over OTLP", "serviceName", serviceName)
+	return provider.Shutdown, nil
+}
+
+// tracedRoute reports whether a request should be traced. Probes and metric
+// scrapes would only add noise.
+func tracedRoute(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/health", "/liveness", "/ready", "/metrics":
+		return false
+	}
+	return true
+}
+
+// startMessageSpan starts the span that covers processing one queue message,
+// continuing the trace of the producer if the message carries trace context
+// in its application properties
+func startMessageSpan(ctx context.Context, transport string, queueName string, messageID string, properties map[string]any) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, applicationPropertiesCarrier(properties))
+	return tracer.Start(ctx, queueName+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(transport),
+			semconv.MessagingDestinationName(queueName),
+			semconv.MessagingMessageID(messageID),
+		),
+	)
+}
+
+// failSpan records err on span and marks the span as failed
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.End()
+}
+
+// applicationPropertiesCarrier reads and writes trace context in the
+// application properties of an AMQP or Service Bus message
+type applicationPropertiesCarrier map[string]any
+
+func (c applicationPropertiesCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c applicationPropertiesCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c applicationPropertiesCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// azureTracingProvider hands the spans the Azure SDK creates, such as those
+// for Cosmos DB requests, to the global OpenTelemetry tracer provider
+func azureTracingProvider() tracing.Provider {
+	return tracing.NewProvider(func(name, version string) tracing.Tracer {
+		otelTracer := otel.Tracer(name, trace.WithInstrumentationVersion(version))
+
+		return tracing.NewTracer(func(ctx context.Context, spanName string, options *tracing.SpanOptions) (context.Context, tracing.Span) {
+			startOptions := []trace.SpanStartOption{}
+			if options != nil {
+				// the Azure SDK span kinds use the same values as OpenTelemetry
+				startOptions = append(startOptions,
+					trace.WithSpanKind(trace.SpanKind(options.Kind)),
+					trace.WithAttributes(azureAttributes(options.Attributes)...),
+				)
+			}
+			ctx, span := otelTracer.Start(ctx, spanName, startOptions...)
+			return ctx, azureSpan(span)
+		}, &tracing.TracerOptions{
+			SpanFromContext: func(ctx context.Context) tracing.Span {
+				return azureSpan(trace.SpanFromContext(ctx))
+			},
+		})
+	}, nil)
+}
+
+// azureSpan wraps an OpenTelemetry span for the Azure SDK
+func azureSpan(span trace.Span) tracing.Span {
+	return tracing.NewSpan(tracing.SpanImpl{
+		End: func() { span.End() },
+		SetAttributes: func(attrs ...tracing.Attribute) {
+			span.SetAttributes(azureAttributes(attrs)...)
+		},
+		AddEvent: func(name string, attrs ...tracing.Attribute) {
+			span.AddEvent(name, trace.WithAttributes(azureAttributes(attrs)...))
+		},
+		SetStatus: func(code tracing.SpanStatus, description string) {
+			switch code {
+			case tracing.SpanStatusError:
+				span.SetStatus(codes.Error, description)
+			case tracing.SpanStatusOK:
+				span.SetStatus(codes.Ok, description)
+			}
+		},
+	})
+}
+
+// azureAttributes converts Azure SDK span attributes to OpenTelemetry ones
+func azureAttributes(attrs []tracing.Attribute) []attribute.KeyValue {
+	converted := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		switch value := attr.Value.(type) {
+		case string:
+			converted = append(converted, attribute.String(attr.Key, value))
+		case int:
+			converted = append(converted, attribute.Int(attr.Key, value))
+		case int64:
+			converted = append(converted, attribute.Int64(attr.Key, value))
+		case float64:
+			converted = append(converted, attribute.Float64(attr.Key, value))
+		case bool:
+			converted = append(converted, attribute.Bool(attr.Key, value))
+		default:
+			converted = append(converted, attribute.String(attr.Key, fmt.Sprint(value)))
+		}
+	}
+	return converted
+}